@@ -0,0 +1,20 @@
+module github.com/asp2insp/runnel-go
+
+go 1.23
+
+require (
+	github.com/cheekybits/genny v1.0.0
+	github.com/edsrzf/mmap-go v1.0.0
+	github.com/pborman/uuid v1.2.1
+	github.com/pkg/profile v1.3.0
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.36.9
+)
+
+require (
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/net v0.32.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
+)
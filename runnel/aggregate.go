@@ -0,0 +1,208 @@
+package runnel
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+)
+
+// Aggregations
+const (
+	AggCount   = "count"
+	AggSum     = "sum"
+	AggMin     = "min"
+	AggMax     = "max"
+	AggAverage = "average"
+	AggStdev   = "stdev"
+	AggUnique  = "unique"
+)
+
+// Aggregators keep a checkpoint of their state in a side file
+// of their output stream
+const checkpointSuffix = "_checkpoint"
+
+// How many messages an aggregator folds in between checkpoints.
+// Updates published after the last checkpoint are published
+// again if the aggregator is restarted after a crash.
+const checkpointInterval = 100
+
+// A single state change published by an aggregator
+type Aggregate struct {
+	// One past the offset of the last message in the
+	// source stream reflected by this update
+	Source uint64
+	// GroupHash of the group the update is for,
+	// 0 when the aggregator isn't grouped
+	Group uint64
+	// Number of messages aggregated in the group
+	Count uint64
+	// The aggregated value of the group
+	Value float64
+	// Bounds of the window the update is for, as unix
+	// nanoseconds. Both 0 when the aggregator isn't windowed.
+	Start int64
+	End   int64
+}
+
+// Identifies a group in the Aggregates published by an aggregator
+func GroupHash(group string) uint64 {
+	if group == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(group))
+	return h.Sum64()
+}
+
+// The running state of a single group. Every statistic is kept
+// so that the same state serves each kind of aggregation.
+type accumulator struct {
+	Count uint64
+	Sum   float64
+	Min   float64
+	Max   float64
+	// Running mean and sum of squared differences, see
+	// Welford's algorithm
+	Mean float64
+	M2   float64
+	// Distinct keys seen, only kept for unique
+	Keys map[string]bool `json:",omitempty"`
+}
+
+func (acc *accumulator) add(kind string, value float64, key string) {
+	acc.Count++
+	acc.Sum += value
+	if acc.Count == 1 || value < acc.Min {
+		acc.Min = value
+	}
+	if acc.Count == 1 || value > acc.Max {
+		acc.Max = value
+	}
+	delta := value - acc.Mean
+	acc.Mean += delta / float64(acc.Count)
+	acc.M2 += delta * (value - acc.Mean)
+	if kind == AggUnique {
+		if acc.Keys == nil {
+			acc.Keys = make(map[string]bool)
+		}
+		acc.Keys[key] = true
+	}
+}
+
+// Fold another accumulator into this one, as when two
+// session windows are joined
+func (acc *accumulator) merge(other *accumulator) {
+	if other.Count == 0 {
+		return
+	}
+	if acc.Count == 0 || other.Min < acc.Min {
+		acc.Min = other.Min
+	}
+	if acc.Count == 0 || other.Max > acc.Max {
+		acc.Max = other.Max
+	}
+	// Chan et al.'s parallel form of Welford's algorithm
+	count := acc.Count + other.Count
+	delta := other.Mean - acc.Mean
+	acc.M2 += other.M2 + delta*delta*float64(acc.Count)*float64(other.Count)/float64(count)
+	acc.Mean += delta * float64(other.Count) / float64(count)
+	acc.Count = count
+	acc.Sum += other.Sum
+	for key := range other.Keys {
+		if acc.Keys == nil {
+			acc.Keys = make(map[string]bool)
+		}
+		acc.Keys[key] = true
+	}
+}
+
+func (acc *accumulator) value(kind string) float64 {
+	switch kind {
+	case AggCount:
+		return float64(acc.Count)
+	case AggSum:
+		return acc.Sum
+	case AggMin:
+		return acc.Min
+	case AggMax:
+		return acc.Max
+	case AggAverage:
+		return acc.Mean
+	case AggStdev:
+		if acc.Count == 0 {
+			return 0
+		}
+		return math.Sqrt(acc.M2 / float64(acc.Count))
+	case AggUnique:
+		return float64(len(acc.Keys))
+	}
+	return 0
+}
+
+// The state of an aggregator, as checkpointed
+type aggregation struct {
+	Kind string
+	// Offset in the source stream that the state reflects
+	Source uint64
+	Groups map[string]*accumulator
+	// Set when the aggregator is windowed
+	Window *WindowSpec `json:",omitempty"`
+	// Windows which are still open to late messages
+	Windows []*window `json:",omitempty"`
+	// Latest timestamp seen, which drives the watermark
+	MaxTime int64 `json:",omitempty"`
+	// Messages which arrived too late for any window
+	Dropped uint64 `json:",omitempty"`
+}
+
+func newAggregation(kind string, window *WindowSpec) *aggregation {
+	return &aggregation{Kind: kind, Groups: make(map[string]*accumulator), Window: window}
+}
+
+// Fold a message into the state and return the updates to publish.
+// Without a window that is the new state of the group, with one it
+// is the result of every window that closed.
+func (agg *aggregation) fold(source uint64, group string, value float64, key string, t int64) []Aggregate {
+	update := agg.add(source, group, value, key)
+	if agg.Window == nil {
+		return []Aggregate{update}
+	}
+	return agg.addWindowed(source, group, value, key, t)
+}
+
+// Fold a message into the given group and return the update
+func (agg *aggregation) add(source uint64, group string, value float64, key string) Aggregate {
+	acc := agg.Groups[group]
+	if acc == nil {
+		acc = &accumulator{}
+		agg.Groups[group] = acc
+	}
+	acc.add(agg.Kind, value, key)
+	agg.Source = source
+	return agg.aggregate(group)
+}
+
+func (agg *aggregation) aggregate(group string) Aggregate {
+	ret := Aggregate{Source: agg.Source, Group: GroupHash(group)}
+	if acc := agg.Groups[group]; acc != nil {
+		ret.Count = acc.Count
+		ret.Value = acc.value(agg.Kind)
+	}
+	return ret
+}
+
+// Load the checkpointed state, if there is one of the right kind
+func loadAggregation(kind string, window *WindowSpec, data []byte) *aggregation {
+	agg := newAggregation(kind, nil)
+	if data == nil || json.Unmarshal(data, agg) != nil || agg.Kind != kind || !sameWindow(agg.Window, window) {
+		return newAggregation(kind, window)
+	}
+	return agg
+}
+
+func sameWindow(a, b *WindowSpec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
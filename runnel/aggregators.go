@@ -0,0 +1,552 @@
+package runnel
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Extracts a numeric value from a message
+type TypedValueFunc func(*Typed) float64
+
+// Builds an aggregator over a stream
+type TypedAggregatorBuilder struct {
+	source *TypedStream
+	name   string
+	group  TypedPropertyFunc
+	window *WindowSpec
+}
+
+// Start building an aggregator. The name identifies the
+// aggregator's output stream and checkpoint, so building
+// an aggregator with the same name resumes where the last
+// one left off.
+func (s *TypedStream) Aggregate(name string) *TypedAggregatorBuilder {
+	return &TypedAggregatorBuilder{source: s, name: name}
+}
+
+// Aggregate each value of the given property separately
+func (b *TypedAggregatorBuilder) Group(group TypedPropertyFunc) *TypedAggregatorBuilder {
+	b.group = group
+	return b
+}
+
+// Aggregate each window of the stream separately. The result
+// of a window is published to the output once it closes, while
+// Get and Value keep reflecting the whole stream.
+func (b *TypedAggregatorBuilder) Window(spec WindowSpec) *TypedAggregatorBuilder {
+	b.window = &spec
+	return b
+}
+
+// Count the messages
+func (b *TypedAggregatorBuilder) Count() *TypedAggregator {
+	return b.build(AggCount, nil, nil)
+}
+
+// Sum the values of the messages
+func (b *TypedAggregatorBuilder) Sum(value TypedValueFunc) *TypedAggregator {
+	return b.build(AggSum, value, nil)
+}
+
+// Track the smallest value of the messages
+func (b *TypedAggregatorBuilder) Min(value TypedValueFunc) *TypedAggregator {
+	return b.build(AggMin, value, nil)
+}
+
+// Track the largest value of the messages
+func (b *TypedAggregatorBuilder) Max(value TypedValueFunc) *TypedAggregator {
+	return b.build(AggMax, value, nil)
+}
+
+// Average the values of the messages
+func (b *TypedAggregatorBuilder) Average(value TypedValueFunc) *TypedAggregator {
+	return b.build(AggAverage, value, nil)
+}
+
+// Track the (population) standard deviation of the values of the messages
+func (b *TypedAggregatorBuilder) Stdev(value TypedValueFunc) *TypedAggregator {
+	return b.build(AggStdev, value, nil)
+}
+
+// Count the distinct values of the given property
+func (b *TypedAggregatorBuilder) Unique(key TypedPropertyFunc) *TypedAggregator {
+	return b.build(AggUnique, nil, key)
+}
+
+func (b *TypedAggregatorBuilder) build(kind string, value TypedValueFunc, key TypedPropertyFunc) *TypedAggregator {
+	source := b.source
+	id := source.Id + "_aggregate_" + b.name
+	output := NewAggregateStream(b.name, id, source.storage.Sibling(id[len(source.Id):]))
+	checkpoint := output.storage.Sibling(checkpointSuffix)
+	data, _ := readBlob(checkpoint)
+	state := loadAggregation(kind, b.window, data)
+
+	ret := &TypedAggregator{
+		Name:       b.name,
+		Output:     output,
+		source:     source,
+		reader:     source.Reader(state.Source),
+		writer:     output.Writer(),
+		checkpoint: checkpoint,
+		group:      b.group,
+		value:      value,
+		key:        key,
+		state:      state,
+		isAlive:    true,
+		done:       make(chan struct{}),
+	}
+	go ret.aggregateLoop()
+	return ret
+}
+
+// Collapses a stream into a read-only set of values, one per
+// group, and publishes every change to its own output stream
+type TypedAggregator struct {
+	Name string
+	// Every change to the state, in order
+	Output *AggregateStream
+	// The stream being aggregated
+	source *TypedStream
+	reader *TypedStreamReader
+	writer *AggregateStreamWriter
+	// The last checkpointed state
+	checkpoint i.Storage
+	// Extract the group, value and key of each message
+	group TypedPropertyFunc
+	value TypedValueFunc
+	key   TypedPropertyFunc
+	// Guards the state, which is read by callers
+	// while the aggregate loop updates it
+	lock    sync.Mutex
+	state   *aggregation
+	isAlive bool
+	// Closed when the aggregate loop exits
+	done chan struct{}
+}
+
+func (a *TypedAggregator) aggregateLoop() {
+	defer close(a.done)
+	folded := 0
+	for {
+		message, ok := a.reader.ReadMessage()
+		if !ok {
+			return
+		}
+		group, value, key := "", 0.0, ""
+		if a.group != nil {
+			group = a.group(&message.Data)
+		}
+		if a.value != nil {
+			value = a.value(&message.Data)
+		}
+		if a.key != nil {
+			key = a.key(&message.Data)
+		}
+		source := message.Offset + a.source.typeSize
+
+		a.lock.Lock()
+		updates := a.state.fold(source, group, value, key, message.Envelope.Timestamp)
+		a.lock.Unlock()
+		for _, update := range updates {
+			env := i.Envelope{Timestamp: message.Envelope.Timestamp}
+			if update.End != 0 {
+				// Window results are stamped with the end of the window
+				env.Timestamp = update.End
+			}
+			a.writer.WriteMessage(&update, env)
+		}
+		a.Output.header().Source = source
+
+		folded++
+		if folded%checkpointInterval == 0 {
+			a.saveCheckpoint()
+		}
+	}
+}
+
+func (a *TypedAggregator) saveCheckpoint() {
+	a.lock.Lock()
+	data, _ := json.Marshal(a.state)
+	a.lock.Unlock()
+	writeBlob(a.checkpoint, data)
+}
+
+// The current state of the given group. Use ""
+// when the aggregator isn't grouped.
+func (a *TypedAggregator) Get(group string) Aggregate {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state.aggregate(group)
+}
+
+// The current value when the aggregator isn't grouped
+func (a *TypedAggregator) Value() float64 {
+	return a.Get("").Value
+}
+
+// The groups seen so far, in sorted order
+func (a *TypedAggregator) Groups() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	groups := make([]string, 0, len(a.state.Groups))
+	for group := range a.state.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// How many messages arrived too late for any window
+func (a *TypedAggregator) Dropped() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state.Dropped
+}
+
+// The offset in the source stream that the state reflects
+func (a *TypedAggregator) Source() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state.Source
+}
+
+// Stop aggregating, checkpoint the state and close the output
+func (a *TypedAggregator) Close() {
+	if !a.isAlive {
+		return
+	}
+	a.isAlive = false
+	a.reader.Close()
+	<-a.done
+	a.saveCheckpoint()
+	a.writer.Close()
+	a.checkpoint.Close()
+	a.Output.Close()
+}
+
+// The state of a stream at a point in time: the
+// latest message for each key
+type TypedSnapshot struct {
+	// One past the last message reflected
+	Offset uint64
+	// Timestamp of the last message reflected
+	Time   int64
+	Values map[string]Typed
+}
+
+// Materialize the latest message for each key as of the given
+// offset, starting from the newest snapshot stored under the given
+// name which isn't past it. New consumers can bootstrap from the
+// result and then read the tail with Reader(snapshot.Offset).
+func (s *TypedStream) Materialize(name string, key TypedPropertyFunc, offset uint64) *TypedSnapshot {
+	return s.materialize(name, key, offset, math.MaxInt64)
+}
+
+// Materialize the latest message for each key as of the given
+// time. Timestamps are assumed to increase through the stream, so
+// replay stops at the first message written after t.
+func (s *TypedStream) MaterializeAsOf(name string, key TypedPropertyFunc, t time.Time) *TypedSnapshot {
+	return s.materialize(name, key, math.MaxUint64, t.UnixNano())
+}
+
+func (s *TypedStream) materialize(name string, key TypedPropertyFunc, offset uint64, t int64) *TypedSnapshot {
+	store := openSnapshotStore(s.storage, name)
+	defer store.close()
+	snapshot := s.decodeSnapshot(store.latest(offset, t))
+
+	storage := s.storage.Clone()
+	defer storage.Close()
+	envelopes := s.envelopes.Clone()
+	defer envelopes.Close()
+	size := s.typeSize
+	last := atomic.LoadUint64(&storage.Header().LastMessage)
+	if offset < last {
+		last = offset
+	}
+	for snapshot.Offset+size <= last {
+		env := readEnvelope(envelopes, snapshot.Offset/size)
+		if env.Timestamp > t {
+			break
+		}
+		slice := storage.GetBytes(snapshot.Offset, snapshot.Offset+size)
+		value := *(*Typed)(unsafe.Pointer(&slice[0]))
+		snapshot.Values[key(&value)] = value
+		snapshot.Offset += size
+		snapshot.Time = env.Timestamp
+	}
+	return snapshot
+}
+
+func (s *TypedStream) decodeSnapshot(file *snapshotFile) *TypedSnapshot {
+	ret := &TypedSnapshot{
+		Offset: file.Offset,
+		Time:   file.Time,
+		Values: make(map[string]Typed, len(file.Values)),
+	}
+	for k, data := range file.Values {
+		if uint64(len(data)) == s.typeSize {
+			ret.Values[k] = *(*Typed)(unsafe.Pointer(&data[0]))
+		}
+	}
+	return ret
+}
+
+func (s *TypedStream) encodeSnapshot(snapshot *TypedSnapshot) *snapshotFile {
+	ret := &snapshotFile{
+		Offset: snapshot.Offset,
+		Time:   snapshot.Time,
+		Values: make(map[string][]byte, len(snapshot.Values)),
+	}
+	for k, value := range snapshot.Values {
+		data := (*[1 << 30]byte)(unsafe.Pointer(&value))[:s.typeSize:s.typeSize]
+		ret.Values[k] = append([]byte{}, data...)
+	}
+	return ret
+}
+
+// Keep the latest message for each key, and persist a snapshot
+// of them under the aggregator's name every so many messages
+func (b *TypedAggregatorBuilder) Snapshot(key TypedPropertyFunc, every uint64) *TypedSnapshotter {
+	source := b.source
+	id := source.Id + "_aggregate_" + b.name
+	output := NewAggregateStream(b.name, id, source.storage.Sibling(id[len(source.Id):]))
+	store := openSnapshotStore(source.storage, b.name)
+	snapshot := source.decodeSnapshot(store.latest(math.MaxUint64, math.MaxInt64))
+
+	ret := &TypedSnapshotter{
+		Name:     b.name,
+		Output:   output,
+		source:   source,
+		key:      key,
+		every:    every,
+		store:    store,
+		reader:   source.Reader(snapshot.Offset),
+		writer:   output.Writer(),
+		snapshot: snapshot,
+		written:  snapshot.Offset,
+		isAlive:  true,
+		done:     make(chan struct{}),
+	}
+	go ret.snapshotLoop()
+	return ret
+}
+
+// Materializes a stream and periodically persists snapshots
+// of it. Every snapshot written is announced on the output
+// stream with the number of keys it holds.
+type TypedSnapshotter struct {
+	Name   string
+	Output *AggregateStream
+	// The stream being snapshotted
+	source *TypedStream
+	key    TypedPropertyFunc
+	// How many messages to fold in between snapshots
+	every  uint64
+	store  *snapshotStore
+	reader *TypedStreamReader
+	writer *AggregateStreamWriter
+	// Guards the live snapshot, which is read by callers
+	// while the snapshot loop updates it
+	lock     sync.Mutex
+	snapshot *TypedSnapshot
+	// Offset of the last snapshot persisted
+	written uint64
+	isAlive bool
+	// Closed when the snapshot loop exits
+	done chan struct{}
+}
+
+func (s *TypedSnapshotter) snapshotLoop() {
+	defer close(s.done)
+	size := s.source.typeSize
+	for {
+		message, ok := s.reader.ReadMessage()
+		if !ok {
+			return
+		}
+		s.lock.Lock()
+		s.snapshot.Values[s.key(&message.Data)] = message.Data
+		s.snapshot.Offset = message.Offset + size
+		s.snapshot.Time = message.Envelope.Timestamp
+		s.lock.Unlock()
+		s.Output.header().Source = message.Offset + size
+
+		if s.snapshot.Offset-s.written >= s.every*size {
+			s.persist()
+		}
+	}
+}
+
+// Write out the live snapshot as a new version
+func (s *TypedSnapshotter) persist() {
+	s.lock.Lock()
+	file := s.source.encodeSnapshot(s.snapshot)
+	s.lock.Unlock()
+	s.store.write(file)
+	s.written = file.Offset
+	update := Aggregate{Source: file.Offset, Count: uint64(len(file.Values)), Value: float64(len(file.Values))}
+	s.writer.WriteMessage(&update, i.Envelope{Timestamp: file.Time})
+}
+
+// A copy of the live snapshot
+func (s *TypedSnapshotter) Snapshot() *TypedSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := &TypedSnapshot{
+		Offset: s.snapshot.Offset,
+		Time:   s.snapshot.Time,
+		Values: make(map[string]Typed, len(s.snapshot.Values)),
+	}
+	for k, v := range s.snapshot.Values {
+		ret.Values[k] = v
+	}
+	return ret
+}
+
+// Stop snapshotting, persisting whatever has
+// changed since the last snapshot
+func (s *TypedSnapshotter) Close() {
+	if !s.isAlive {
+		return
+	}
+	s.isAlive = false
+	s.reader.Close()
+	<-s.done
+	if s.snapshot.Offset > s.written {
+		s.persist()
+	}
+	s.writer.Close()
+	s.store.close()
+	s.Output.Close()
+}
+
+// Keep a sample of size messages of the stream, ranked by a seeded
+// hash of their offsets. The seed is kept with the checkpoint, so the
+// sample only changes with the stream until the checkpoint is lost.
+// Every change to the sample is announced on the output stream
+// with the number of messages seen and the size of the sample.
+func (b *TypedAggregatorBuilder) Reservoir(size uint64) *TypedReservoir {
+	source := b.source
+	id := source.Id + "_aggregate_" + b.name
+	output := NewAggregateStream(b.name, id, source.storage.Sibling(id[len(source.Id):]))
+	checkpoint := output.storage.Sibling(checkpointSuffix)
+	data, _ := readBlob(checkpoint)
+	state := loadReservoir(size, data)
+
+	ret := &TypedReservoir{
+		Name:       b.name,
+		Output:     output,
+		source:     source,
+		reader:     source.Reader(state.Source),
+		writer:     output.Writer(),
+		checkpoint: checkpoint,
+		state:      state,
+		isAlive:    true,
+		done:       make(chan struct{}),
+	}
+	go ret.reservoirLoop()
+	return ret
+}
+
+// Maintains a sample of a fixed number of messages
+type TypedReservoir struct {
+	Name   string
+	Output *AggregateStream
+	// The stream being sampled
+	source *TypedStream
+	reader *TypedStreamReader
+	writer *AggregateStreamWriter
+	// The last checkpointed sample
+	checkpoint i.Storage
+	// Guards the sample, which is read by callers
+	// while the reservoir loop updates it
+	lock    sync.Mutex
+	state   *reservoir
+	isAlive bool
+	// Closed when the reservoir loop exits
+	done chan struct{}
+}
+
+func (r *TypedReservoir) reservoirLoop() {
+	defer close(r.done)
+	for {
+		message, ok := r.reader.ReadMessage()
+		if !ok {
+			return
+		}
+		source := message.Offset + r.source.typeSize
+
+		r.lock.Lock()
+		changed := r.state.add(message.Offset)
+		r.state.Source = source
+		update := Aggregate{Source: source, Count: r.state.Seen, Value: float64(len(r.state.Entries))}
+		r.lock.Unlock()
+		if changed {
+			r.writer.WriteMessage(&update, i.Envelope{Timestamp: message.Envelope.Timestamp})
+		}
+		r.Output.header().Source = source
+
+		if update.Count%checkpointInterval == 0 {
+			r.saveCheckpoint()
+		}
+	}
+}
+
+func (r *TypedReservoir) saveCheckpoint() {
+	r.lock.Lock()
+	data, _ := json.Marshal(r.state)
+	r.lock.Unlock()
+	writeBlob(r.checkpoint, data)
+}
+
+// The messages in the sample, in stream order
+func (r *TypedReservoir) Sample() []Typed {
+	offsets := r.Offsets()
+	ret := make([]Typed, len(offsets))
+	for n, offset := range offsets {
+		ret[n] = r.source.at(offset)
+	}
+	return ret
+}
+
+// The offsets of the messages in the sample, in stream order
+func (r *TypedReservoir) Offsets() []uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state.offsets()
+}
+
+// How many messages the sample was drawn from
+func (r *TypedReservoir) Seen() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state.Seen
+}
+
+// The offset in the source stream that the sample reflects
+func (r *TypedReservoir) Source() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state.Source
+}
+
+// Stop sampling, checkpoint the sample and close the output
+func (r *TypedReservoir) Close() {
+	if !r.isAlive {
+		return
+	}
+	r.isAlive = false
+	r.reader.Close()
+	<-r.done
+	r.saveCheckpoint()
+	r.writer.Close()
+	r.checkpoint.Close()
+	r.Output.Close()
+}
@@ -0,0 +1,267 @@
+package runnel
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestAggregators(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	value := func(data *int) float64 { return float64(*data) }
+	count := stream.Aggregate("count").Count()
+	defer count.Close()
+	sum := stream.Aggregate("sum").Sum(value)
+	defer sum.Close()
+	min := stream.Aggregate("min").Min(value)
+	defer min.Close()
+	max := stream.Aggregate("max").Max(value)
+	defer max.Close()
+	average := stream.Aggregate("average").Average(value)
+	defer average.Close()
+	stdev := stream.Aggregate("stdev").Stdev(value)
+	defer stdev.Close()
+	unique := stream.Aggregate("unique").Unique(func(data *int) string { return strconv.Itoa(*data % 7) })
+	defer unique.Close()
+
+	for _, a := range []*IntAggregator{count, sum, min, max, average, stdev, unique} {
+		waitForAggregator(a, stream, t)
+	}
+	checkFloat(100, count.Value(), t)
+	checkFloat(4950, sum.Value(), t)
+	checkFloat(0, min.Value(), t)
+	checkFloat(99, max.Value(), t)
+	checkFloat(49.5, average.Value(), t)
+	checkFloat(math.Sqrt((100*100-1)/12.0), stdev.Value(), t)
+	checkFloat(7, unique.Value(), t)
+}
+
+func TestAggregatorGroups(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	sum := stream.Aggregate("sum").Group(parity).Sum(func(data *int) float64 { return float64(*data) })
+	defer sum.Close()
+	waitForAggregator(sum, stream, t)
+
+	groups := sum.Groups()
+	testutils.CheckInt(2, len(groups), t)
+	testutils.CheckString("even", groups[0], t)
+	checkFloat(2450, sum.Get("even").Value, t)
+	checkFloat(2500, sum.Get("odd").Value, t)
+	testutils.CheckUint64(50, sum.Get("odd").Count, t)
+	testutils.CheckUint64(GroupHash("odd"), sum.Get("odd").Group, t)
+}
+
+func TestAggregatorOutputStream(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 10)
+
+	count := stream.Aggregate("count").Count()
+	defer count.Close()
+
+	reader := count.Output.Reader(0)
+	defer reader.Close()
+	for n := 1; n <= 10; n++ {
+		update := reader.Read()
+		testutils.CheckUint64(uint64(n), update.Count, t)
+		testutils.CheckUint64(uint64(n*8), update.Source, t)
+		checkFloat(float64(n), update.Value, t)
+	}
+}
+
+func TestAggregatorResumesFromCheckpoint(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	sum := stream.Aggregate("sum").Sum(func(data *int) float64 { return float64(*data) })
+	waitForAggregator(sum, stream, t)
+	sum.Close()
+
+	writeInts(stream, 100)
+
+	sum = stream.Aggregate("sum").Sum(func(data *int) float64 { return float64(*data) })
+	defer sum.Close()
+	// Resumed from the checkpoint rather than from zero
+	testutils.ExpectTrue(sum.Source() >= 100*8, "Expected to resume from the checkpoint", t)
+	waitForAggregator(sum, stream, t)
+	checkFloat(2*4950, sum.Value(), t)
+	testutils.CheckUint64(200, sum.Output.Size(), t)
+}
+
+func TestReservoir(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 500)
+
+	r := stream.Aggregate("sample").Reservoir(10)
+	waitForReservoir(r, stream, t)
+	testutils.CheckUint64(500, r.Seen(), t)
+	checkReservoir(r, 500, t)
+	seed := r.state.Seed
+	r.Close()
+
+	// Each reservoir draws its own seed
+	other := stream.Aggregate("other").Reservoir(10)
+	testutils.ExpectTrue(other.state.Seed != seed, "Expected reservoirs to be seeded independently", t)
+	other.Close()
+
+	// Resumes from the checkpointed sample and seed
+	writeInts(stream, 500)
+	r = stream.Aggregate("sample").Reservoir(10)
+	defer r.Close()
+	testutils.ExpectTrue(r.Source() >= 500*8, "Expected to resume from the checkpoint", t)
+	testutils.CheckUint64(seed, r.state.Seed, t)
+	waitForReservoir(r, stream, t)
+	testutils.CheckUint64(1000, r.Seen(), t)
+	checkReservoir(r, 1000, t)
+}
+
+// Check that the sample holds the 10 lowest ranked of n messages
+func checkReservoir(r *IntReservoir, n int, t *testing.T) {
+	expected := make([]uint64, n)
+	for m := range expected {
+		expected[m] = uint64(m * 8)
+	}
+	r.lock.Lock()
+	seed := r.state.Seed
+	r.lock.Unlock()
+	sort.Sort(byPriority{expected, seed})
+	expected = expected[:10]
+	sort.Sort(offsetList(expected))
+
+	offsets := r.Offsets()
+	sample := r.Sample()
+	testutils.CheckInt(10, len(offsets), t)
+	for m := range offsets {
+		testutils.CheckUint64(expected[m], offsets[m], t)
+		testutils.CheckInt(int(offsets[m]/8)%500, sample[m], t)
+	}
+}
+
+type byPriority struct {
+	offsets []uint64
+	seed    uint64
+}
+
+func (a byPriority) Len() int { return len(a.offsets) }
+func (a byPriority) Less(x, y int) bool {
+	return seededPriority(a.seed, a.offsets[x]) < seededPriority(a.seed, a.offsets[y])
+}
+func (a byPriority) Swap(x, y int) { a.offsets[x], a.offsets[y] = a.offsets[y], a.offsets[x] }
+
+func waitForReservoir(r *IntReservoir, stream *IntStream, t *testing.T) {
+	timeout := time.After(time.Second)
+	for r.Source() < stream.header().LastMessage {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the reservoir to catch up")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Wait for the aggregator to have folded in every message in the stream
+func waitForAggregator(a *IntAggregator, stream *IntStream, t *testing.T) {
+	timeout := time.After(time.Second)
+	for a.Source() < stream.header().LastMessage {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the aggregator to catch up")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func checkFloat(expected, actual float64, t *testing.T) {
+	if math.Abs(expected-actual) > 1e-9 {
+		t.Errorf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	snapshot := stream.Materialize("parity", parity, stream.header().LastMessage)
+	testutils.CheckUint64(100*8, snapshot.Offset, t)
+	testutils.CheckInt(98, snapshot.Values["even"], t)
+	testutils.CheckInt(99, snapshot.Values["odd"], t)
+
+	snapshot = stream.Materialize("parity", parity, 10*8)
+	testutils.CheckUint64(10*8, snapshot.Offset, t)
+	testutils.CheckInt(8, snapshot.Values["even"], t)
+	testutils.CheckInt(9, snapshot.Values["odd"], t)
+}
+
+func TestMaterializeAsOf(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	writer := stream.Writer()
+	defer writer.Close()
+	base := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	for n := 0; n < 60; n++ {
+		writer.WriteMessage(&n, i.Envelope{Timestamp: base.Add(time.Duration(n) * time.Minute).UnixNano()})
+	}
+
+	snapshot := stream.MaterializeAsOf("parity", parity, base.Add(30*time.Minute))
+	testutils.CheckUint64(31*8, snapshot.Offset, t)
+	testutils.CheckInt(30, snapshot.Values["even"], t)
+	testutils.CheckInt(29, snapshot.Values["odd"], t)
+}
+
+func TestSnapshotter(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	snapshotter := stream.Aggregate("parity").Snapshot(parity, 10)
+	reader := snapshotter.Output.Reader(0)
+	for n := 1; n <= 10; n++ {
+		update := reader.Read()
+		testutils.CheckUint64(uint64(n*10*8), update.Source, t)
+		testutils.CheckUint64(2, update.Count, t)
+	}
+	reader.Close()
+	testutils.CheckInt(99, snapshotter.Snapshot().Values["odd"], t)
+	snapshotter.Close()
+
+	store := openSnapshotStore(stream.storage, "parity")
+	testutils.CheckUint64(10, store.versions.Header().EntryCount, t)
+	testutils.CheckUint64(50*8, store.latest(55*8, math.MaxInt64).Offset, t)
+	store.close()
+
+	// Materializing starts from the stored snapshot
+	snapshot := stream.Materialize("parity", parity, 55*8)
+	testutils.CheckInt(54, snapshot.Values["even"], t)
+	testutils.CheckInt(53, snapshot.Values["odd"], t)
+
+	// Restarting resumes from the latest snapshot
+	writeInts(stream, 5)
+	snapshotter = stream.Aggregate("parity").Snapshot(parity, 10)
+	defer snapshotter.Close()
+	testutils.ExpectTrue(snapshotter.Snapshot().Offset >= 100*8, "Expected to resume from the latest snapshot", t)
+}
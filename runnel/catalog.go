@@ -0,0 +1,222 @@
+package runnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+	"github.com/pborman/uuid"
+)
+
+// Each stream in a catalog is described by <name>.json in its root,
+// and stored under an id of its own so that it can be renamed
+const catalogSuffix = ".json"
+
+// The codec streams use unless created with another
+const DefaultCodec = "json"
+
+var validStreamName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// The streams stored under a directory, along with what they hold
+type Catalog struct {
+	Root string
+	// Guards everything below
+	lock   sync.Mutex
+	codecs map[string]i.Codec
+}
+
+// What a catalog knows about one of its streams
+type StreamInfo struct {
+	Name string
+	Id   string
+	// Name of the codec the stream's messages are converted with
+	Codec string
+	// Go type of the stream's records, and their size
+	RecordType string
+	RecordSize uint64
+	// How long the stream's messages should be kept,
+	// 0 to keep them forever
+	Retention time.Duration
+	Created   time.Time
+}
+
+// Settings for a new stream
+type StreamOptions struct {
+	// Name of a codec registered with the catalog. Defaults to
+	// DefaultCodec, which encodes messages as JSON.
+	Codec     string
+	Retention time.Duration
+}
+
+// Open the catalog rooted at the given directory, creating it if need be
+func OpenCatalog(root string) (*Catalog, error) {
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return nil, err
+	}
+	return &Catalog{Root: root, codecs: make(map[string]i.Codec)}, nil
+}
+
+// Make a codec available to streams created with its name
+func (c *Catalog) RegisterCodec(name string, codec i.Codec) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.codecs[name] = codec
+}
+
+// Every stream in the catalog, ordered by name
+func (c *Catalog) List() ([]StreamInfo, error) {
+	files, err := filepath.Glob(filepath.Join(c.Root, "*"+catalogSuffix))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]StreamInfo, 0, len(files))
+	for _, file := range files {
+		info, err := c.Describe(strings.TrimSuffix(filepath.Base(file), catalogSuffix))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, info)
+	}
+	sort.Sort(streamInfoList(ret))
+	return ret, nil
+}
+
+// What the catalog knows about the named stream
+func (c *Catalog) Describe(name string) (StreamInfo, error) {
+	var info StreamInfo
+	data, err := ioutil.ReadFile(c.infoPath(name))
+	if os.IsNotExist(err) {
+		return info, fmt.Errorf("stream %s is not in catalog %s", name, c.Root)
+	}
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("stream %s has a corrupt description: %v", name, err)
+	}
+	return info, nil
+}
+
+// Give a stream a new name. Handles opened under the old name keep working.
+func (c *Catalog) Rename(name, newName string) error {
+	if !validStreamName.MatchString(newName) {
+		return fmt.Errorf("invalid stream name %q", newName)
+	}
+	info, err := c.Describe(name)
+	if err != nil {
+		return err
+	}
+	info.Name = newName
+	if err := c.writeInfo(info); err != nil {
+		return err
+	}
+	return os.Remove(c.infoPath(name))
+}
+
+// Remove a stream and everything stored alongside it. The stream
+// shouldn't be open, though open handles can still be read.
+func (c *Catalog) Delete(name string) error {
+	info, err := c.Describe(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(c.infoPath(name)); err != nil {
+		return err
+	}
+	files, _ := filepath.Glob(filepath.Join(c.Root, info.Id+"*"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return nil
+}
+
+// Record a new stream holding records of the given type
+func (c *Catalog) create(name, recordType string, recordSize uint64, options StreamOptions) (StreamInfo, error) {
+	if !validStreamName.MatchString(name) {
+		return StreamInfo{}, fmt.Errorf("invalid stream name %q", name)
+	}
+	if options.Codec == "" {
+		options.Codec = DefaultCodec
+	}
+	if _, err := c.codec(options.Codec); err != nil {
+		return StreamInfo{}, err
+	}
+	info := StreamInfo{
+		Name:       name,
+		Id:         uuid.New(),
+		Codec:      options.Codec,
+		RecordType: recordType,
+		RecordSize: recordSize,
+		Retention:  options.Retention,
+		Created:    time.Now(),
+	}
+	return info, c.writeInfo(info)
+}
+
+// Describe the named stream, checking that it holds records
+// of the given type. Returns the stream's codec, or nil for the
+// default one.
+func (c *Catalog) open(name, recordType string, recordSize uint64) (StreamInfo, i.Codec, error) {
+	info, err := c.Describe(name)
+	if err != nil {
+		return info, nil, err
+	}
+	if info.RecordType != recordType || info.RecordSize != recordSize {
+		return info, nil, fmt.Errorf("stream %s holds %s records, not %s", name, info.RecordType, recordType)
+	}
+	codec, err := c.codec(info.Codec)
+	return info, codec, err
+}
+
+func (c *Catalog) codec(name string) (i.Codec, error) {
+	if name == DefaultCodec {
+		return nil, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	codec, ok := c.codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("codec %q has not been registered", name)
+	}
+	return codec, nil
+}
+
+func (c *Catalog) infoPath(name string) string {
+	return filepath.Join(c.Root, name+catalogSuffix)
+}
+
+// Write the stream's description under its name, failing if
+// another stream has the name. Written aside and then linked into
+// place so that other processes never see a partial description.
+func (c *Catalog) writeInfo(info StreamInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.Root, info.Id+"_description")
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, c.infoPath(info.Name)); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("stream %s already exists in catalog %s", info.Name, c.Root)
+		}
+		return err
+	}
+	return nil
+}
+
+type streamInfoList []StreamInfo
+
+func (a streamInfoList) Len() int           { return len(a) }
+func (a streamInfoList) Less(x, y int) bool { return a[x].Name < a[y].Name }
+func (a streamInfoList) Swap(x, y int)      { a[x], a[y] = a[y], a[x] }
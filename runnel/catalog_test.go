@@ -0,0 +1,131 @@
+package runnel
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestCatalogCreateAndOpen(t *testing.T) {
+	catalog := openCatalog(t)
+	defer os.RemoveAll(catalog.Root)
+
+	stream, err := catalog.CreateInt("clicks", StreamOptions{Retention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeInts(stream, 10)
+	stream.Close()
+
+	_, err = catalog.CreateInt("clicks", StreamOptions{})
+	testutils.ExpectTrue(err != nil && strings.Contains(err.Error(), "already exists"), "Expected a duplicate name error", t)
+
+	stream, err = catalog.OpenInt("clicks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	testutils.CheckUint64(10, stream.Size(), t)
+
+	info, err := catalog.Describe("clicks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckString("clicks", info.Name, t)
+	testutils.CheckString(DefaultCodec, info.Codec, t)
+	testutils.CheckString("int", info.RecordType, t)
+	testutils.CheckUint64(8, info.RecordSize, t)
+	testutils.ExpectTrue(info.Retention == time.Hour, "Expected the retention to be kept", t)
+	testutils.ExpectTrue(time.Since(info.Created) < time.Minute, "Expected a creation time", t)
+
+	// Stored in the catalog's directory, not the temp dir
+	_, err = os.Stat(catalog.Root + "/" + info.Id)
+	testutils.ExpectTrue(err == nil, "Expected the stream in the catalog's directory", t)
+}
+
+func TestCatalogTypeMismatch(t *testing.T) {
+	catalog := openCatalog(t)
+	defer os.RemoveAll(catalog.Root)
+	stream, err := catalog.CreateInt("counts", StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	_, err = catalog.OpenAggregate("counts")
+	testutils.ExpectTrue(err != nil && strings.Contains(err.Error(), "holds int records"), "Expected a type mismatch error", t)
+	_, err = catalog.CreateInt("gauges", StreamOptions{Codec: "msgpack"})
+	testutils.ExpectTrue(err != nil, "Expected an unregistered codec error", t)
+
+	catalog.RegisterCodec("ints", IntJSONCodec{})
+	stream, err = catalog.CreateInt("gauges", StreamOptions{Codec: "ints"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+func TestCatalogListRenameDelete(t *testing.T) {
+	catalog := openCatalog(t)
+	defer os.RemoveAll(catalog.Root)
+	for _, name := range []string{"b", "c", "a"} {
+		stream, err := catalog.CreateInt(name, StreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeInts(stream, 3)
+		stream.Close()
+	}
+	checkNames(catalog, "a,b,c", t)
+
+	if err := catalog.Rename("a", "d"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(catalog, "b,c,d", t)
+	stream, err := catalog.OpenInt("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckUint64(3, stream.Size(), t)
+	stream.Close()
+	testutils.ExpectTrue(catalog.Rename("b", "c") != nil, "Expected renaming onto a stream to fail", t)
+	testutils.ExpectTrue(catalog.Rename("b", "../b") != nil, "Expected an invalid name to fail", t)
+
+	info, _ := catalog.Describe("c")
+	if err := catalog.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(catalog, "b,d", t)
+	_, err = os.Stat(catalog.Root + "/" + info.Id)
+	testutils.ExpectTrue(os.IsNotExist(err), "Expected the stream's files to be removed", t)
+	_, err = catalog.OpenInt("c")
+	testutils.ExpectTrue(err != nil, "Expected a deleted stream not to open", t)
+}
+
+func openCatalog(t *testing.T) *Catalog {
+	root, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := OpenCatalog(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func checkNames(catalog *Catalog, expected string, t *testing.T) {
+	streams, err := catalog.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(streams))
+	for n, info := range streams {
+		names[n] = info.Name
+	}
+	testutils.CheckString(expected, strings.Join(names, ","), t)
+}
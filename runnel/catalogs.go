@@ -0,0 +1,34 @@
+package runnel
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/s"
+)
+
+// Create a stream in the catalog and open it. Fails if the
+// catalog already has a stream with the name.
+func (c *Catalog) CreateTyped(name string, options StreamOptions) (*TypedStream, error) {
+	var zero Typed
+	info, err := c.create(name, fmt.Sprintf("%T", zero), uint64(unsafe.Sizeof(zero)), options)
+	if err != nil {
+		return nil, err
+	}
+	return c.OpenTyped(info.Name)
+}
+
+// Open a stream in the catalog. Fails if the stream
+// holds records of another type.
+func (c *Catalog) OpenTyped(name string) (*TypedStream, error) {
+	var zero Typed
+	info, codec, err := c.open(name, fmt.Sprintf("%T", zero), uint64(unsafe.Sizeof(zero)))
+	if err != nil {
+		return nil, err
+	}
+	stream := NewTypedStream(info.Name, info.Id, s.NewFileStorage(c.Root).Init(info.Id))
+	if codec != nil {
+		stream.Codec = codec
+	}
+	return stream, nil
+}
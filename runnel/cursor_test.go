@@ -0,0 +1,106 @@
+package runnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestCursor(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 10)
+
+	cursor := stream.Cursor(5*8 + 3)
+	testutils.CheckUint64(5*8, cursor.Offset(), t)
+	for n := 5; n < 10; n++ {
+		message, ok := cursor.Next()
+		testutils.ExpectTrue(ok, "Expected a message", t)
+		testutils.CheckInt(n, message.Data, t)
+	}
+	_, ok := cursor.Next()
+	testutils.ExpectTrue(!ok, "Expected the end of the stream", t)
+	for n := 9; n >= 0; n-- {
+		message, ok := cursor.Prev()
+		testutils.ExpectTrue(ok, "Expected a message", t)
+		testutils.CheckInt(n, message.Data, t)
+		testutils.CheckUint64(uint64(n*8), message.Offset, t)
+	}
+	_, ok = cursor.Prev()
+	testutils.ExpectTrue(!ok, "Expected the head of the stream", t)
+}
+
+func TestAroundOffset(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	messages := stream.AroundOffset(50*8, 3)
+	testutils.CheckInt(7, len(messages), t)
+	for n, message := range messages {
+		testutils.CheckInt(47+n, message.Data, t)
+	}
+
+	// Clipped at either end of the stream
+	testutils.CheckInt(4, len(stream.AroundOffset(0, 3)), t)
+	testutils.CheckInt(3, len(stream.AroundOffset(99*8, 2)), t)
+}
+
+func TestAroundTime(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	seconds := make([]int, 100)
+	for n := range seconds {
+		seconds[n] = 2 * n
+	}
+	writeTimed(stream, seconds...)
+
+	// Within 5s of 101s is 96s to 106s
+	messages := stream.AroundTime(windowBase.Add(101*time.Second), 5*time.Second)
+	testutils.CheckInt(6, len(messages), t)
+	for n, message := range messages {
+		testutils.CheckInt(48+n, message.Data, t)
+	}
+
+	testutils.CheckInt(0, len(stream.AroundTime(windowBase.Add(time.Hour), time.Second)), t)
+	testutils.CheckInt(100, len(stream.AroundTime(windowBase, time.Hour)), t)
+}
+
+func TestReverseReader(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 10)
+
+	reader := stream.ReverseReader()
+	for n := 9; n >= 0; n-- {
+		value, ok := reader.Read()
+		testutils.ExpectTrue(ok, "Expected a value", t)
+		testutils.CheckInt(n, value, t)
+	}
+	_, ok := reader.Read()
+	testutils.ExpectTrue(!ok, "Expected the head of the stream", t)
+
+	reader = stream.ReverseReaderFrom(3 * 8)
+	message, _ := reader.ReadMessage()
+	testutils.CheckInt(2, message.Data, t)
+	testutils.CheckUint64(2*8, message.Offset, t)
+}
+
+func TestLatest(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 500)
+
+	latest := stream.Latest(100)
+	testutils.CheckInt(100, len(latest), t)
+	for n, message := range latest {
+		testutils.CheckInt(499-n, message.Data, t)
+	}
+	testutils.CheckInt(500, len(stream.Latest(1000)), t)
+}
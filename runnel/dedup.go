@@ -0,0 +1,167 @@
+package runnel
+
+import (
+	"hash/fnv"
+	"math"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Bounded dedup filters keep their seen-set in a side file of
+// the view's index, so that it survives restarts
+const dedupSuffix = "_dedup"
+
+// Sizing of the Bloom filters backing a seen-set. Each
+// generation holds the limit of a count bounded dedup, or
+// dedupCapacity keys for one bounded only by time.
+const (
+	dedupCapacity      = 1 << 16
+	dedupFalsePositive = 0.01
+)
+
+// The fixed part of a seen-set file, followed by the bits of
+// both generations
+type seenHeader struct {
+	// Generation new keys are added to
+	Current uint64
+	// Bits in each generation
+	Bits   uint64
+	Hashes uint64
+	// Timestamp of the first key in each generation
+	Start [2]int64
+	// Keys added to each generation
+	Count [2]uint64
+}
+
+const seenHeaderSize = uint64(unsafe.Sizeof(seenHeader{}))
+
+// Remembers the keys seen within a time horizon or within the
+// last limit keys, using a pair of Bloom filters. Keys are added
+// to the current filter and checked against both. Once the current
+// filter covers the horizon or holds limit keys, the older one is
+// cleared and takes over as the current one, so keys are forgotten
+// between one and two horizons (or limits) after they were seen.
+//
+// Like any Bloom filter this may mistake a new key for one it has
+// seen, with a probability of about dedupFalsePositive.
+type seenSet struct {
+	storage i.Storage
+	header  seenHeader
+	horizon int64
+	limit   uint64
+}
+
+func openSeenSet(storage i.Storage, horizon int64, limit uint64) *seenSet {
+	capacity := uint64(dedupCapacity)
+	if limit > 0 {
+		capacity = limit
+	}
+	// Standard Bloom filter sizing for the target false positive rate
+	bits := uint64(math.Ceil(-float64(capacity) * math.Log(dedupFalsePositive) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) / 64 * 64
+	hashes := uint64(math.Ceil(float64(bits) / float64(capacity) * math.Ln2))
+
+	set := &seenSet{storage: storage, horizon: horizon, limit: limit}
+	if storage.Header().LastMessage >= seenHeaderSize {
+		slice := storage.GetBytes(0, seenHeaderSize)
+		set.header = *(*seenHeader)(unsafe.Pointer(&slice[0]))
+	}
+	if set.header.Bits != bits || set.header.Hashes != hashes {
+		// Missing, or sized for a different bound
+		set.header = seenHeader{Bits: bits, Hashes: hashes}
+		writeAt(storage, 0, make([]byte, seenHeaderSize+2*bits/8))
+		set.saveHeader()
+	}
+	return set
+}
+
+// Whether the key has been seen as of time t. The generations are
+// rotated first if the current one is full or covers the horizon.
+func (set *seenSet) seen(key string, t int64) bool {
+	h := &set.header
+	cur := h.Current
+	if (set.limit > 0 && h.Count[cur] >= set.limit) ||
+		(set.horizon > 0 && h.Count[cur] > 0 && t-h.Start[cur] >= set.horizon) {
+		set.rotate(t)
+		cur = h.Current
+	}
+	positions := set.positions(key)
+	return set.contains(cur, positions) || set.contains(1-cur, positions)
+}
+
+// Record the key as seen at time t. Kept apart from seen so that a
+// view only records a key once the message's outcome is in its index.
+func (set *seenSet) add(key string, t int64) {
+	h := &set.header
+	cur := h.Current
+	positions := set.positions(key)
+	for _, bit := range positions {
+		b := set.bits(cur, bit)
+		b[0] |= 1 << (bit % 8)
+	}
+	if h.Count[cur] == 0 {
+		h.Start[cur] = t
+	}
+	h.Count[cur]++
+	set.saveHeader()
+}
+
+// Clear the older generation and make it the current one
+func (set *seenSet) rotate(t int64) {
+	h := &set.header
+	old := h.Current
+	h.Current = 1 - old
+	set.clear(h.Current)
+	if set.horizon > 0 && t-h.Start[old] >= 2*set.horizon {
+		// Everything in the old generation is past the horizon too
+		set.clear(old)
+	}
+	set.saveHeader()
+}
+
+func (set *seenSet) clear(generation uint64) {
+	start := seenHeaderSize + generation*set.header.Bits/8
+	bytes := set.storage.GetBytes(start, start+set.header.Bits/8)
+	for n := range bytes {
+		bytes[n] = 0
+	}
+	set.header.Start[generation] = 0
+	set.header.Count[generation] = 0
+}
+
+func (set *seenSet) contains(generation uint64, positions []uint64) bool {
+	if set.header.Count[generation] == 0 {
+		return false
+	}
+	for _, bit := range positions {
+		if set.bits(generation, bit)[0]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The byte holding the given bit of a generation
+func (set *seenSet) bits(generation, bit uint64) []byte {
+	offset := seenHeaderSize + generation*set.header.Bits/8 + bit/8
+	return set.storage.GetBytes(offset, offset+1)
+}
+
+// The bits for a key, by double hashing
+func (set *seenSet) positions(key string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum>>32, sum&0xffffffff|1
+	ret := make([]uint64, set.header.Hashes)
+	for n := range ret {
+		ret[n] = (h1 + uint64(n)*h2) % set.header.Bits
+	}
+	return ret
+}
+
+func (set *seenSet) saveHeader() {
+	header := set.header
+	writeAt(set.storage, 0, (*[seenHeaderSize]byte)(unsafe.Pointer(&header))[:])
+}
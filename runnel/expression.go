@@ -0,0 +1,131 @@
+package runnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format the predicates as a filter expression, e.g.
+//
+//	from(16).property(user="42").sample(0.5)
+//
+// Expressions can be parsed back with ParsePredicates.
+func FormatPredicates(predicates []Predicate) string {
+	steps := make([]string, len(predicates))
+	for n, p := range predicates {
+		steps[n] = p.String()
+	}
+	return strings.Join(steps, ".")
+}
+
+// Parse a filter expression as produced by FormatPredicates
+func ParsePredicates(expr string) ([]Predicate, error) {
+	var predicates []Predicate
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		open := strings.IndexByte(rest, '(')
+		if open < 0 {
+			return nil, fmt.Errorf("expected ( after %q", rest)
+		}
+		closing, err := findClosingParen(rest, open)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parsePredicate(strings.TrimSpace(rest[:open]), rest[open+1:closing])
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, p)
+		rest = strings.TrimSpace(rest[closing+1:])
+		if rest != "" {
+			if rest[0] != '.' {
+				return nil, fmt.Errorf("expected . before %q", rest)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return predicates, nil
+}
+
+// Find the paren closing the one at open, skipping quoted strings
+func findClosingParen(expr string, open int) (int, error) {
+	quoted := false
+	for n := open + 1; n < len(expr); n++ {
+		switch {
+		case quoted && expr[n] == '\\':
+			n++
+		case expr[n] == '"':
+			quoted = !quoted
+		case !quoted && expr[n] == ')':
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("unclosed ( in %q", expr)
+}
+
+func parsePredicate(op, args string) (Predicate, error) {
+	p := Predicate{Op: op}
+	args = strings.TrimSpace(args)
+	var err error
+	switch op {
+	case OpFrom, OpUntil:
+		p.Offset, err = strconv.ParseUint(args, 10, 64)
+	case OpBefore, OpAfter:
+		p.Time, err = parseTime(args)
+	case OpAround:
+		parts := strings.SplitN(args, ",", 2)
+		if len(parts) != 2 {
+			return p, fmt.Errorf("%s needs a time and a window", op)
+		}
+		if p.Time, err = parseTime(parts[0]); err == nil {
+			var window time.Duration
+			window, err = time.ParseDuration(strings.TrimSpace(parts[1]))
+			p.Window = int64(window)
+		}
+	case OpProperty:
+		parts := strings.SplitN(args, "=", 2)
+		if len(parts) != 2 {
+			return p, fmt.Errorf("%s needs name=\"value\"", op)
+		}
+		p.Name = strings.TrimSpace(parts[0])
+		p.Value, err = strconv.Unquote(strings.TrimSpace(parts[1]))
+	case OpAuthorType:
+		var authorType uint64
+		authorType, err = strconv.ParseUint(args, 10, 32)
+		p.AuthorType = uint32(authorType)
+	case OpSample:
+		rate := args
+		if parts := strings.SplitN(args, ",", 2); len(parts) == 2 {
+			p.Name = strings.TrimSpace(parts[0])
+			rate = strings.TrimSpace(parts[1])
+		}
+		p.Rate, err = strconv.ParseFloat(rate, 64)
+	case OpDedup:
+		parts := strings.Split(args, ",")
+		p.Name = strings.TrimSpace(parts[0])
+		for _, bound := range parts[1:] {
+			bound = strings.TrimSpace(bound)
+			if horizon, durationErr := time.ParseDuration(bound); durationErr == nil {
+				p.Horizon = int64(horizon)
+			} else if p.Limit, err = strconv.ParseUint(bound, 10, 64); err != nil {
+				break
+			}
+		}
+	default:
+		return p, fmt.Errorf("unknown filter %q", op)
+	}
+	if err != nil {
+		return p, fmt.Errorf("%s(%s): %v", op, args, err)
+	}
+	return p, nil
+}
+
+func parseTime(s string) (int64, error) {
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
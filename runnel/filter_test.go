@@ -0,0 +1,579 @@
+package runnel
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestFilterFromUntil(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 100)
+
+	view, err := stream.Filter().From(10 * 8).Until(20 * 8).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+
+	reader := view.Reader(0)
+	defer reader.Close()
+	for i := 10; i < 20; i++ {
+		testutils.CheckInt(i, reader.Read(), t)
+	}
+}
+
+func TestFilterProperty(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+	writeInts(stream, 100)
+
+	view, err := stream.Filter().Property("parity", "odd").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+
+	reader := view.Reader(0)
+	defer reader.Close()
+	for i := 1; i < 100; i += 2 {
+		testutils.CheckInt(i, reader.Read(), t)
+	}
+}
+
+func TestFilterUndeclaredProperty(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	_, err := stream.Filter().Property("parity", "odd").Build()
+	testutils.ExpectTrue(err != nil, "Expected an error for an undeclared property", t)
+}
+
+func TestFilterFollowsLiveData(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+
+	view, err := stream.Filter().Property("parity", "even").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	reader := view.Reader(0)
+	defer reader.Close()
+
+	writeInts(stream, 513)
+	for i := 0; i < 513; i += 2 {
+		testutils.CheckInt(i, reader.Read(), t)
+	}
+}
+
+func TestFilterTimeAndAuthor(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	writer := stream.Writer()
+	defer writer.Close()
+	base := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	for n := 0; n < 60; n++ {
+		env := i.Envelope{
+			Timestamp:  base.Add(time.Duration(n) * time.Minute).UnixNano(),
+			Author:     uint64(n%3 + 1),
+			AuthorType: uint32(n % 3),
+		}
+		writer.WriteMessage(&n, env)
+	}
+
+	view, err := stream.Filter().
+		After(base.Add(10 * time.Minute)).
+		Before(base.Add(40 * time.Minute)).
+		AuthorType(2).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	reader := view.Reader(0)
+	defer reader.Close()
+	for n := 11; n < 40; n++ {
+		if n%3 == 2 {
+			testutils.CheckInt(n, reader.Read(), t)
+		}
+	}
+
+	around, err := stream.Filter().Around(base.Add(30*time.Minute), 2*time.Minute).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer around.Close()
+	aroundReader := around.Reader(0)
+	defer aroundReader.Close()
+	for n := 28; n <= 32; n++ {
+		testutils.CheckInt(n, aroundReader.Read(), t)
+	}
+}
+
+func TestFilterSampleAndDedup(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := 0; n < 1000; n++ {
+		value := n % 10
+		writer.Write(&value)
+	}
+
+	all, err := stream.Filter().Sample(1).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	none, err := stream.Filter().Sample(0).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer none.Close()
+	half, err := stream.Filter().Sample(0.5).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer half.Close()
+
+	deduped, err := stream.Filter().Dedup("").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deduped.Close()
+	reader := deduped.Reader(0)
+	defer reader.Close()
+	for n := 0; n < 10; n++ {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+
+	waitForSource(all, stream, t)
+	waitForSource(none, stream, t)
+	waitForSource(half, stream, t)
+	waitForSource(deduped, stream, t)
+	testutils.CheckUint64(1000, all.Size(), t)
+	testutils.CheckUint64(0, none.Size(), t)
+	testutils.ExpectTrue(half.Size() > 400 && half.Size() < 600, "Expected about half the messages", t)
+	testutils.CheckUint64(10, deduped.Size(), t)
+}
+
+func TestFilterSampleBy(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("value", func(value *int) string { return strconv.Itoa(*value) })
+	writer := stream.Writer()
+	for n := 0; n < 1000; n++ {
+		value := n % 10
+		writer.Write(&value)
+	}
+	writer.Close()
+
+	view, err := stream.Filter().SampleBy("value", 0.5).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	waitForSource(view, stream, t)
+
+	// Every message for a sampled value is kept
+	kept := 0
+	for value := 0; value < 10; value++ {
+		if sampledKey(strconv.Itoa(value), 0.5) {
+			kept++
+		}
+	}
+	testutils.CheckUint64(uint64(kept*100), view.Size(), t)
+}
+
+func TestFilterReopenDoesNotRescan(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+	writeInts(stream, 100)
+
+	view, err := stream.Filter().Property("parity", "even").Dedup("parity").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSource(view, stream, t)
+	testutils.CheckUint64(1, view.Size(), t)
+	id := view.Id
+	view.Close()
+
+	writeInts(stream, 100)
+
+	view, err = stream.Filter().Property("parity", "even").Dedup("parity").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	testutils.CheckString(id, view.Id, t)
+	waitForSource(view, stream, t)
+	// The seen set was restored from the index, so nothing new matches
+	testutils.CheckUint64(1, view.Size(), t)
+}
+
+func TestFilterSharedIndex(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+
+	// Built with the same filters, so both views share an index
+	first, err := stream.Filter().Property("parity", "even").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := stream.Filter().Property("parity", "even").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	writeInts(stream, 100)
+	waitForSource(first, stream, t)
+	testutils.CheckUint64(50, second.Size(), t)
+
+	// The other view takes over once the writer closes
+	first.Close()
+	writeInts(stream, 100)
+	waitForSource(second, stream, t)
+	testutils.CheckUint64(100, second.Size(), t)
+	reader := second.Reader(0)
+	defer reader.Close()
+	for n := 0; n < 100; n += 2 {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+}
+
+func TestFilterDedupLast(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeValues(stream, 0, 1, 2, 0, 3, 4, 0)
+
+	view, err := stream.Filter().DedupLast("", 2).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	waitForSource(view, stream, t)
+	// The second 0 is remembered, the third is seen after 0 has
+	// been rotated out
+	testutils.CheckUint64(6, view.Size(), t)
+}
+
+func TestFilterDedupWithin(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("mod3", func(value *int) string { return strconv.Itoa(*value % 3) })
+	writeTimed(stream, 0, 1, 2, 3, 4, 5, 30, 31, 32)
+
+	view, err := stream.Filter().DedupWithin("mod3", 10*time.Second).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	waitForSource(view, stream, t)
+	// Each key once in the first few seconds, and again once
+	// the horizon has passed
+	testutils.CheckUint64(6, view.Size(), t)
+}
+
+func TestFilterDedupAcrossRestart(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	stream.DeclareProperty("parity", parity)
+	writeInts(stream, 10)
+
+	view, err := stream.Filter().DedupLast("parity", 1000).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSource(view, stream, t)
+	testutils.CheckUint64(2, view.Size(), t)
+	view.Close()
+	stream.Close()
+
+	// Reopen everything from disk, as a new process would
+	stream = NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+	writeInts(stream, 10)
+
+	view, err = stream.Filter().DedupLast("parity", 1000).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	waitForSource(view, stream, t)
+	testutils.CheckUint64(2, view.Size(), t)
+	testutils.ExpectTrue(len(view.state) == 1, "Expected the seen-set to be kept on disk", t)
+}
+
+func TestFilterDedupAfterCrash(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+	writeValues(stream, 1)
+	view, err := stream.Filter().DedupLast("parity", 1000).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSource(view, stream, t)
+	view.Close()
+
+	// The view stopped after indexing the next message, but
+	// before recording its key as seen and moving past it
+	writeValues(stream, 2, 4)
+	index := stream.storage.Sibling(view.Id[len(stream.Id):])
+	appendOffset(index, 8)
+	index.Close()
+
+	view, err = stream.Filter().DedupLast("parity", 1000).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	waitForSource(view, stream, t)
+	testutils.CheckUint64(2, view.Size(), t)
+	reader := view.Reader(0)
+	defer reader.Close()
+	testutils.CheckInt(1, reader.Read(), t)
+	testutils.CheckInt(2, reader.Read(), t)
+}
+
+func TestFilterUsesIndex(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareIndex("mod10", mod10)
+	writeInts(stream, 1000)
+
+	view, err := stream.Filter().Property("mod10", "3").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	testutils.CheckString("mod10", view.Index, t)
+	reader := view.Reader(0)
+	defer reader.Close()
+	for n := 3; n < 1000; n += 10 {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+
+	// Follows new messages as they're indexed
+	writeInts(stream, 100)
+	waitForSource(view, stream, t)
+	testutils.CheckUint64(110, view.Size(), t)
+
+	// Dedup has to see every message, so can't use the index
+	deduped, err := stream.Filter().Dedup("").Property("mod10", "3").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deduped.Close()
+	testutils.CheckString("", deduped.Index, t)
+}
+
+func TestIndexPersists(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	stream.DeclareIndex("mod10", mod10)
+	writeInts(stream, 100)
+	idx := stream.indexes["mod10"]
+	waitForIndex(idx, stream, t)
+	stream.Close()
+
+	stream = NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareIndex("mod10", mod10)
+	idx = stream.indexes["mod10"]
+	// Picks up where it left off rather than reindexing
+	testutils.CheckUint64(100*8, idx.source(), t)
+	writeInts(stream, 100)
+	waitForIndex(idx, stream, t)
+
+	offsets := idx.lookup("7", 50*8, 150*8)
+	testutils.CheckInt(10, len(offsets), t)
+	testutils.CheckUint64(57*8, offsets[0], t)
+	testutils.CheckUint64(147*8, offsets[9], t)
+}
+
+func TestIndexSingleMaintainer(t *testing.T) {
+	cleanupFiles()
+	var handles []*IntStream
+	for n := 0; n < 2; n++ {
+		stream := NewIntStream("test", "id", nil)
+		defer stream.Close()
+		stream.DeclareIndex("mod10", mod10)
+		handles = append(handles, stream)
+	}
+	writeInts(handles[0], 100)
+	for _, stream := range handles {
+		waitForIndex(stream.indexes["mod10"], stream, t)
+	}
+	// One of the handles holds the index for itself
+	other := handles[0].storage.Sibling(indexSuffix + "mod10")
+	_, locked := other.Lock(true, false).(*i.LockedError)
+	other.Close()
+	testutils.ExpectTrue(locked, "Expected a single handle to maintain the index", t)
+
+	// Each message is indexed once
+	idx := handles[1].indexes["mod10"]
+	testutils.CheckUint64(100, idx.postings.Header().EntryCount, t)
+	testutils.CheckInt(10, len(idx.lookup("7", 0, 100*8)), t)
+
+	// The other handle takes over once the maintainer closes
+	handles[0].Close()
+	writeInts(handles[1], 100)
+	waitForIndex(idx, handles[1], t)
+	testutils.CheckUint64(200, idx.postings.Header().EntryCount, t)
+}
+
+func mod10(value *int) string {
+	return strconv.Itoa(*value % 10)
+}
+
+func waitForIndex(idx *propertyIndex, stream *IntStream, t *testing.T) {
+	timeout := time.After(time.Second)
+	for idx.source() < stream.header().LastMessage {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the index to catch up")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func writeValues(stream *IntStream, values ...int) {
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := range values {
+		writer.Write(&values[n])
+	}
+}
+
+func parity(value *int) string {
+	if *value%2 == 0 {
+		return "even"
+	}
+	return "odd"
+}
+
+func writeInts(stream *IntStream, count int) {
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := 0; n < count; n++ {
+		writer.Write(&n)
+	}
+}
+
+// Wait for the view to have evaluated every message in the stream
+func waitForSource(view *IntView, stream *IntStream, t *testing.T) {
+	timeout := time.After(time.Second)
+	for view.index.Header().Source < stream.header().LastMessage {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the view to catch up")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestFilterContradictions(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+	now := time.Now()
+
+	contradictions := []*IntFilter{
+		stream.Filter().Before(now).After(now.Add(time.Minute)),
+		stream.Filter().Before(now).After(now),
+		stream.Filter().Property("parity", "odd").Property("parity", "even"),
+		stream.Filter().From(80).Until(40),
+		stream.Filter().AuthorType(1).AuthorType(2),
+		stream.Filter().Around(now, time.Second).After(now.Add(time.Minute)),
+	}
+	for _, f := range contradictions {
+		_, err := f.Build()
+		if _, ok := err.(*ContradictionError); !ok {
+			t.Errorf("Expected a contradiction for %v, got %v", f.predicates, err)
+		}
+	}
+}
+
+func TestFilterSimplification(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	view, err := stream.Filter().Sample(0.5).From(8).Sample(0.5).From(16).Until(800).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	testutils.CheckInt(3, len(view.Predicates), t)
+	testutils.CheckString("sample(0.25)", view.Predicates[0].String(), t)
+	testutils.CheckString("from(16)", view.Predicates[1].String(), t)
+	testutils.CheckInt(2, len(view.Warnings), t)
+
+	// Equivalent filters share a view
+	same, err := stream.Filter().Sample(0.25).From(16).Until(800).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer same.Close()
+	testutils.CheckString(view.Id, same.Id, t)
+}
+
+func TestFilterSimplifiesKeyedSamples(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.DeclareProperty("parity", parity)
+
+	view, err := stream.Filter().SampleBy("parity", 0.5).Sample(0.5).SampleBy("parity", 0.25).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	// The same keys pass both keyed samples, so only the smaller counts
+	testutils.CheckInt(2, len(view.Predicates), t)
+	testutils.CheckString("sample(parity, 0.25)", view.Predicates[0].String(), t)
+	testutils.CheckString("sample(0.5)", view.Predicates[1].String(), t)
+}
+
+func TestFilterSimplificationRespectsDedup(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	view, err := stream.Filter().Sample(0.5).Dedup("").Sample(0.5).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	testutils.CheckInt(3, len(view.Predicates), t)
+	testutils.CheckInt(0, len(view.Warnings), t)
+}
@@ -0,0 +1,247 @@
+package runnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// How often background loops check shared headers for changes
+const pollInterval = 5 * time.Millisecond
+
+// How often watchers look for handles left open by processes which
+// exited without closing them
+const reapInterval = 100 * time.Millisecond
+
+// Opens and closes are recorded in a log alongside the stream, one
+// offset per event holding the handle and whether it was closed
+const handleEventsSuffix = "_events"
+
+const closedHandle = uint64(1)
+
+type EventType int
+
+const (
+	// A handle to the stream was opened
+	EventOpen EventType = iota
+	// A handle to the stream was closed
+	EventClose
+	// Messages were made available
+	EventInsert
+	// The header changed in any way
+	EventChange
+)
+
+// An event describes a change to a stream. Events are
+// observed through the shared header and the log of opens
+// and closes, so they are delivered for changes made by
+// any process that has the stream open.
+type Event struct {
+	Type EventType
+	// Id of the stream the event was observed on
+	Id string
+	// Byte range affected by an insert
+	Start uint64
+	End   uint64
+	// Snapshot of the header after the change
+	Header i.StreamHeader
+}
+
+type Hook func(Event)
+
+// The log of every handle opened and closed on a stream,
+// shared between processes
+type handleEvents struct {
+	lock    sync.Mutex
+	storage i.Storage
+}
+
+// Record that a handle was opened or closed. Held under the
+// log's flock, as every process appends to the same log.
+func (log *handleEvents) append(handle uint64, closed bool) {
+	entry := handle &^ closedHandle
+	if closed {
+		entry |= closedHandle
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if err := log.storage.Lock(true, true); err != nil {
+		return
+	}
+	defer log.storage.Unlock()
+	appendOffset(log.storage, entry)
+}
+
+// Number of events in the log
+func (log *handleEvents) size() uint64 {
+	return atomic.LoadUint64(&log.storage.Header().LastMessage) / offsetSize
+}
+
+func (log *handleEvents) read(position uint64) (handle uint64, closed bool) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	entry := readOffset(log.storage, position)
+	return entry &^ closedHandle, entry&closedHandle != 0
+}
+
+// Close the handles left open by processes which exited
+// without closing them
+func (log *handleEvents) reap(storage i.Storage) {
+	for _, handle := range storage.ReapHandles() {
+		decrementOpenCount(storage.Header())
+		log.append(handle, true)
+	}
+}
+
+func decrementOpenCount(header *i.StreamHeader) {
+	for {
+		count := atomic.LoadUint64(&header.OpenCount)
+		if count == 0 || atomic.CompareAndSwapUint64(&header.OpenCount, count, count-1) {
+			return
+		}
+	}
+}
+
+// The hookWatcher polls a stream header and the log of opens
+// and closes, and dispatches events to the registered hooks.
+// It is started lazily the first time a hook is registered.
+type hookWatcher struct {
+	id       string
+	storage  i.Storage
+	header   *i.StreamHeader
+	events   *handleEvents
+	lock     sync.Mutex
+	hooks    map[EventType][]Hook
+	anyHooks []Hook
+	last     i.StreamHeader
+	// Position in the log of opens and closes
+	seen     uint64
+	lastReap time.Time
+	running  bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newHookWatcher(id string, storage i.Storage, events *handleEvents) *hookWatcher {
+	return &hookWatcher{
+		id:      id,
+		storage: storage,
+		header:  storage.Header(),
+		events:  events,
+		hooks:   make(map[EventType][]Hook),
+	}
+}
+
+// Register a hook for the given type of event and
+// start watching if we aren't already
+func (w *hookWatcher) on(t EventType, hook Hook) {
+	w.lock.Lock()
+	w.hooks[t] = append(w.hooks[t], hook)
+	w.lock.Unlock()
+	w.start()
+}
+
+// Register a hook for every type of event
+func (w *hookWatcher) onAny(hook Hook) {
+	w.lock.Lock()
+	w.anyHooks = append(w.anyHooks, hook)
+	w.lock.Unlock()
+	w.start()
+}
+
+func (w *hookWatcher) start() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.running {
+		return
+	}
+	w.running = true
+	w.last = snapshotHeader(w.header)
+	w.seen = w.events.size()
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.watchLoop()
+}
+
+// Stop watching. Blocks until the watch loop has exited
+// so that the header can be safely released afterwards.
+func (w *hookWatcher) close() {
+	w.lock.Lock()
+	running := w.running
+	w.running = false
+	w.lock.Unlock()
+	if running {
+		close(w.stop)
+		<-w.done
+	}
+}
+
+func (w *hookWatcher) watchLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// Fire events for the handles opened and closed since the last
+// poll, then compare the current header against the last one we
+// saw and fire events for whatever changed
+func (w *hookWatcher) poll() {
+	if time.Since(w.lastReap) > reapInterval {
+		w.lastReap = time.Now()
+		w.events.reap(w.storage)
+	}
+	for end := w.events.size(); w.seen < end; w.seen++ {
+		e := Event{Type: EventOpen, Id: w.id, Header: snapshotHeader(w.header)}
+		if _, closed := w.events.read(w.seen); closed {
+			e.Type = EventClose
+		}
+		w.fire(e)
+	}
+
+	cur := snapshotHeader(w.header)
+	prev := w.last
+	if cur == prev {
+		return
+	}
+	w.last = cur
+
+	if cur.LastMessage > prev.LastMessage {
+		w.fire(Event{Type: EventInsert, Id: w.id, Start: prev.LastMessage, End: cur.LastMessage, Header: cur})
+	}
+	w.fire(Event{Type: EventChange, Id: w.id, Header: cur})
+}
+
+// Fire the given event locally, in addition to any hooks
+// registered for all events
+func (w *hookWatcher) fire(e Event) {
+	w.lock.Lock()
+	hooks := append([]Hook{}, w.hooks[e.Type]...)
+	hooks = append(hooks, w.anyHooks...)
+	w.lock.Unlock()
+	for _, hook := range hooks {
+		hook(e)
+	}
+}
+
+// Take a consistent-per-field copy of a header that
+// may be concurrently modified by other processes
+func snapshotHeader(h *i.StreamHeader) i.StreamHeader {
+	return i.StreamHeader{
+		FileSize:    atomic.LoadUint64(&h.FileSize),
+		EntryCount:  atomic.LoadUint64(&h.EntryCount),
+		Tail:        atomic.LoadUint64(&h.Tail),
+		LastMessage: atomic.LoadUint64(&h.LastMessage),
+		OpenCount:   atomic.LoadUint64(&h.OpenCount),
+		Source:      atomic.LoadUint64(&h.Source),
+	}
+}
@@ -0,0 +1,212 @@
+package runnel
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestInsertHook(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	events := make(chan Event, 100)
+	stream.OnInsert(func(e Event) { events <- e })
+
+	writer := stream.Writer()
+	defer writer.Close()
+	data := 5
+	writer.Write(&data)
+
+	e := expectEvent(events, t)
+	testutils.ExpectTrue(e.Type == EventInsert, "Expected an insert event", t)
+	testutils.CheckUint64(0, e.Start, t)
+	testutils.CheckUint64(8, e.End, t)
+	testutils.CheckUint64(1, e.Header.EntryCount, t)
+}
+
+func TestHooksSeeOtherHandles(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("watcher", "id", nil)
+	defer stream.Close()
+
+	opens := make(chan Event, 10)
+	closes := make(chan Event, 10)
+	inserts := make(chan Event, 100)
+	stream.OnOpen(func(e Event) { opens <- e })
+	stream.OnClose(func(e Event) { closes <- e })
+	stream.OnInsert(func(e Event) { inserts <- e })
+
+	// A second handle on the same id behaves like another process
+	other := NewIntStream("other", "id", nil)
+	expectEvent(opens, t)
+
+	writer := other.Writer()
+	for i := 0; i < 10; i++ {
+		writer.Write(&i)
+	}
+	writer.Close()
+
+	var end uint64
+	for end < 80 {
+		end = expectEvent(inserts, t).End
+	}
+
+	other.Close()
+	e := expectEvent(closes, t)
+	testutils.CheckUint64(1, e.Header.OpenCount, t)
+}
+
+func TestHooksSeeBriefHandles(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("watcher", "id", nil)
+	defer stream.Close()
+	events := make(chan Event, 10)
+	stream.OnOpen(func(e Event) { events <- e })
+	stream.OnClose(func(e Event) { events <- e })
+
+	// Opened and closed well within a single poll
+	NewIntStream("other", "id", nil).Close()
+	testutils.ExpectTrue(expectEvent(events, t).Type == EventOpen, "Expected an open event", t)
+	testutils.ExpectTrue(expectEvent(events, t).Type == EventClose, "Expected a close event", t)
+}
+
+func TestHooksSeeCrashedHandles(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("watcher", "id", nil)
+	defer stream.Close()
+	opens := make(chan Event, 10)
+	closes := make(chan Event, 10)
+	stream.OnOpen(func(e Event) { opens <- e })
+	stream.OnClose(func(e Event) { closes <- e })
+
+	child := startHelper("open", t)
+	expectEvent(opens, t)
+	testutils.CheckUint64(2, stream.header().OpenCount, t)
+
+	// Killed without a chance to close the stream
+	killHelper(child)
+	e := expectEvent(closes, t)
+	testutils.CheckUint64(1, e.Header.OpenCount, t)
+}
+
+func TestCloseHookFiresLocally(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+
+	closes := make(chan Event, 10)
+	stream.OnClose(func(e Event) { closes <- e })
+	stream.Close()
+
+	e := expectEvent(closes, t)
+	testutils.CheckString("id", e.Id, t)
+}
+
+func TestChangeHookOnResize(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	sizes := make(chan uint64, 1000)
+	stream.OnChange(func(e Event) { sizes <- e.Header.FileSize })
+
+	writer := stream.Writer()
+	defer writer.Close()
+	// 4096 / 8 = 512
+	for i := 0; i < 513; i++ {
+		writer.Write(&i)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case size := <-sizes:
+			if size > 4096 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Never saw the resize")
+		}
+	}
+}
+
+func TestAnyHook(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	events := make(chan Event, 100)
+	stream.OnAny(func(e Event) { events <- e })
+
+	writer := stream.Writer()
+	defer writer.Close()
+	data := 5
+	writer.Write(&data)
+
+	seen := map[EventType]bool{}
+	for !seen[EventInsert] || !seen[EventChange] {
+		seen[expectEvent(events, t).Type] = true
+	}
+}
+
+// Not a test, but run as a child process which opens the stream and
+// waits to be killed, as a process which crashes holding it would
+func TestHelperProcess(t *testing.T) {
+	var err error
+	switch os.Getenv("RUNNEL_HELPER") {
+	case "":
+		return
+	case "open":
+		NewIntStream("helper", "id", nil)
+	case "lock":
+		_, err = OpenIntStream("helper", "id", nil, LockExclusive)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("ready")
+	time.Sleep(time.Minute)
+	os.Exit(1)
+}
+
+// Start a child process running the given helper, returning once
+// it has the stream open
+func startHelper(helper string, t *testing.T) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "RUNNEL_HELPER="+helper)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if line != "ready\n" {
+		killHelper(cmd)
+		t.Fatalf("Helper failed to start: %q %v", line, err)
+	}
+	return cmd
+}
+
+func killHelper(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+func expectEvent(events chan Event, t *testing.T) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return Event{}
+}
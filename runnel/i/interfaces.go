@@ -1,5 +1,14 @@
 package i
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
 type StreamHeader struct {
 	FileSize   uint64
 	EntryCount uint64
@@ -7,6 +16,94 @@ type StreamHeader struct {
 	Tail uint64
 	// One past the end
 	LastMessage uint64
+	// Number of open handles across all processes
+	OpenCount uint64
+	// For streams derived from another stream, the offset in the
+	// source stream that has been processed so far
+	Source uint64
+}
+
+// Metadata kept alongside each message in a stream
+type Envelope struct {
+	// Time the message was written, in unix nanoseconds
+	Timestamp int64
+	// Identifies the author of the message
+	Author uint64
+	// Application defined class of author
+	AuthorType uint32
+	// Hashes of the tags on the message, 0 marks an empty slot
+	Tags [MaxTags]uint32
+}
+
+// The most tags a single message can carry
+const MaxTags = 8
+
+// Add the tag to the envelope. Returns false if there is no room.
+func (env *Envelope) AddTag(tag string) bool {
+	h := tagHash(tag)
+	free := -1
+	for n, t := range env.Tags {
+		if t == h {
+			return true
+		}
+		if t == 0 && free < 0 {
+			free = n
+		}
+	}
+	if free < 0 {
+		return false
+	}
+	env.Tags[free] = h
+	return true
+}
+
+// Remove the tag from the envelope, if present
+func (env *Envelope) RemoveTag(tag string) {
+	h := tagHash(tag)
+	for n, t := range env.Tags {
+		if t == h {
+			env.Tags[n] = 0
+		}
+	}
+}
+
+// Whether the envelope carries the tag
+func (env *Envelope) HasTag(tag string) bool {
+	h := tagHash(tag)
+	for _, t := range env.Tags {
+		if t == h {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the author with an HMAC-SHA256 of it keyed with the
+// salt, truncated to fit, or strip it entirely if no salt is
+// given. Without the salt the author can't be recovered.
+func (env *Envelope) Anonymize(salt string) {
+	if salt == "" {
+		env.Author = 0
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(strconv.FormatUint(env.Author, 10)))
+	env.Author = binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// Clear everything but the timestamp
+func (env *Envelope) ClearMetadata() {
+	*env = Envelope{Timestamp: env.Timestamp}
+}
+
+// Tags are stored as hashes so that envelopes have a fixed size
+func tagHash(tag string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+	if sum := h.Sum32(); sum != 0 {
+		return sum
+	}
+	return 1
 }
 
 type Storage interface {
@@ -33,10 +130,61 @@ type Storage interface {
 	// Refresh the in-memory version of the underlying medium
 	Refresh()
 	Clone() Storage
+	// Open a companion storage that lives alongside this one,
+	// identified by the given suffix. Used for side files such
+	// as envelopes and indexes
+	Sibling(suffix string) Storage
+	// Take an advisory lock on the storage, shared or exclusive,
+	// across every process. Unless asked to wait, returns a
+	// *LockedError if another handle holds a conflicting lock. Locks
+	// are released by Unlock or when the holding process exits.
+	Lock(exclusive, wait bool) error
+	Unlock()
+	// Replace the document kept alongside the storage, for side
+	// files which hold a single document such as a checkpoint. It
+	// is written aside, synced and renamed into place, so readers
+	// see the old document or the new one, never a mix of both.
+	WriteDocument(data []byte) error
+	// The document kept alongside the storage, nil if there is none
+	ReadDocument() ([]byte, error)
+	// Mark a handle to the storage as open in this process, until
+	// it is closed or the process exits. Returns an id for the handle.
+	OpenHandle() (uint64, error)
+	CloseHandle(handle uint64)
+	// Forget the handles left open by processes which have exited,
+	// returning their ids. Each is only ever returned once.
+	ReapHandles() []uint64
+	// Whether the handle is open, in this process or another. A handle
+	// left open by a process which has exited is not, whether or not
+	// it has been reaped. Handles are assumed open if it can't be told.
+	HandleOpen(handle uint64) bool
+}
+
+// Returned when a storage is locked by another handle
+type LockedError struct {
+	Id string
+	// The process holding the lock exclusively,
+	// 0 if it's held shared or unknown
+	Pid int
+}
+
+func (e *LockedError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("stream %s is locked by other writers", e.Id)
+	}
+	return fmt.Sprintf("stream %s is locked for writing by process %d", e.Id, e.Pid)
 }
 
 type Closable interface {
 	Close()
 }
 
-// TODO: Add network and serialization types
+// Converts records to and from a form which clients that don't
+// share the stream's memory layout can use. The external form
+// must be a JSON value so that it can be embedded in responses.
+type Codec interface {
+	// The external form of the record
+	Encode(record []byte) ([]byte, error)
+	// The record with the given external form
+	Decode(data []byte) ([]byte, error)
+}
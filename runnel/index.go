@@ -0,0 +1,138 @@
+package runnel
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Secondary indexes are kept in side files of the stream,
+// <id>_index_<name> for the postings and <id>_index_<name>_buckets
+// for the hash table pointing into them
+const (
+	indexSuffix   = "_index_"
+	bucketsSuffix = "_buckets"
+)
+
+// Number of slots in an index's hash table. Values which share
+// a slot share a chain of postings, so lookups skip over the
+// postings of the other values.
+const indexBuckets = 1 << 16
+
+// An entry in an index, recording that the message at Offset
+// has a value with the given hash
+type posting struct {
+	Hash   uint64
+	Offset uint64
+	// Position of the previous posting in the same bucket,
+	// plus one so that 0 ends the chain
+	Prev uint64
+}
+
+const postingSize = uint64(unsafe.Sizeof(posting{}))
+
+// A hashed index from the values of a property to the offsets of
+// the messages which have them. Postings are only ever appended, in
+// stream order, and each bucket points to its newest posting, so
+// walking a chain visits offsets from newest to oldest.
+type propertyIndex struct {
+	Name     string
+	postings i.Storage
+	buckets  i.Storage
+	// Guards the storage, which may be resized by add
+	// while lookup is reading it
+	lock    sync.Mutex
+	isAlive bool
+	// Closed when the index loop exits
+	done chan struct{}
+}
+
+func openPropertyIndex(stream i.Storage, name string) *propertyIndex {
+	idx := &propertyIndex{
+		Name:     name,
+		postings: stream.Sibling(indexSuffix + name),
+		buckets:  stream.Sibling(indexSuffix + name + bucketsSuffix),
+		isAlive:  true,
+		done:     make(chan struct{}),
+	}
+	if idx.buckets.Header().LastMessage < indexBuckets*offsetSize {
+		writeAt(idx.buckets, 0, make([]byte, indexBuckets*offsetSize))
+	}
+	return idx
+}
+
+// The offset in the stream indexed so far
+func (idx *propertyIndex) source() uint64 {
+	return atomic.LoadUint64(&idx.postings.Header().Source)
+}
+
+// Wait to become the only handle, in any process, adding to the
+// index, as postings added by two would be duplicated. The others
+// only look values up, and wait to take over in case the maintainer
+// closes or dies. Returns false if alive stops holding while waiting.
+func (idx *propertyIndex) maintain(alive func() bool) bool {
+	for alive() {
+		err := idx.postings.Lock(true, false)
+		if _, locked := err.(*i.LockedError); !locked {
+			// Without locking on this platform, every handle adds
+			return true
+		}
+		time.Sleep(pollInterval)
+	}
+	return false
+}
+
+// Record the value of the message at the given offset, which
+// must be the next one in the stream
+func (idx *propertyIndex) add(value string, offset, next uint64) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	hash := valueHash(value)
+	bucket := hash % indexBuckets
+	p := posting{Hash: hash, Offset: offset, Prev: readOffset(idx.buckets, bucket)}
+	position := idx.postings.Header().EntryCount
+	appendRecord(idx.postings, (*[postingSize]byte)(unsafe.Pointer(&p))[:])
+	writeOffset(idx.buckets, bucket, position+1)
+	atomic.StoreUint64(&idx.postings.Header().Source, next)
+}
+
+// The offsets in [from, to) of messages with the given value,
+// in stream order
+func (idx *propertyIndex) lookup(value string, from, to uint64) []uint64 {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	hash := valueHash(value)
+	var ret []uint64
+	for next := readOffset(idx.buckets, hash%indexBuckets); next != 0; {
+		start := (next - 1) * postingSize
+		slice := idx.postings.GetBytes(start, start+postingSize)
+		p := *(*posting)(unsafe.Pointer(&slice[0]))
+		if p.Offset < from {
+			break
+		}
+		if p.Hash == hash && p.Offset < to {
+			ret = append(ret, p.Offset)
+		}
+		next = p.Prev
+	}
+	// The chain runs newest first
+	for l, r := 0, len(ret)-1; l < r; l, r = l+1, r-1 {
+		ret[l], ret[r] = ret[r], ret[l]
+	}
+	return ret
+}
+
+func (idx *propertyIndex) close() {
+	idx.postings.Close()
+	idx.buckets.Close()
+}
+
+func valueHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
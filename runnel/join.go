@@ -0,0 +1,181 @@
+package runnel
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Kinds of join
+const (
+	// Only pairs which matched
+	JoinInner = "inner"
+	// As inner, plus messages of the left stream which never matched
+	JoinLeft = "left"
+	// As inner, plus messages of either stream which never matched
+	JoinOuter = "outer"
+)
+
+// A single result of a join. The messages themselves stay in
+// their source streams, and are fetched by offset from the join.
+type Joined struct {
+	LeftOffset  uint64
+	RightOffset uint64
+	// Whether each side is present. Both are for a matched pair,
+	// only one is for a message which expired without matching.
+	HasLeft  bool
+	HasRight bool
+}
+
+const (
+	joinLeft  = 0
+	joinRight = 1
+)
+
+// A message waiting for a match from the other stream
+type joinEntry struct {
+	Offset  uint64
+	Time    int64
+	Matched bool
+}
+
+// The state of a join, as checkpointed. Every message is buffered
+// until the other stream has moved past its time bound.
+type joinState struct {
+	Kind   string
+	Within int64
+	// Offsets processed in the left and right streams
+	Sources [2]uint64
+	// Latest timestamp seen in each stream
+	MaxTime [2]int64
+	// Buffered messages of each stream, by key
+	Buffers [2]map[string][]*joinEntry
+	// End of the output stream. Pairs published after the
+	// checkpoint are published again when resuming from it.
+	Output uint64
+}
+
+func newJoinState(kind string, within int64) *joinState {
+	return &joinState{
+		Kind:    kind,
+		Within:  within,
+		Buffers: [2]map[string][]*joinEntry{make(map[string][]*joinEntry), make(map[string][]*joinEntry)},
+	}
+}
+
+// Load the checkpointed state, if there is one for the same join
+func loadJoinState(kind string, within int64, data []byte) *joinState {
+	state := newJoinState(kind, within)
+	if data == nil || json.Unmarshal(data, state) != nil || state.Kind != kind || state.Within != within {
+		return newJoinState(kind, within)
+	}
+	for side := range state.Buffers {
+		if state.Buffers[side] == nil {
+			state.Buffers[side] = make(map[string][]*joinEntry)
+		}
+	}
+	return state
+}
+
+// The pairs published to the output stream from the given offset on,
+// which a join resuming from a checkpoint shouldn't publish again
+func publishedPairs(output *JoinedStream, from uint64) map[Joined]bool {
+	ret := make(map[Joined]bool)
+	end := output.header().LastMessage
+	for offset := from; offset+output.typeSize <= end; offset += output.typeSize {
+		ret[output.at(offset)] = true
+	}
+	return ret
+}
+
+// Match a message against the other stream's buffer, then buffer it.
+// Returns the pairs to publish, including any messages which expired
+// unmatched and should be published alone.
+func (state *joinState) add(side int, key string, entry *joinEntry) []Joined {
+	var ret []Joined
+	for _, other := range state.Buffers[1-side][key] {
+		if abs64(other.Time-entry.Time) > state.Within {
+			continue
+		}
+		entry.Matched = true
+		other.Matched = true
+		if side == joinLeft {
+			ret = append(ret, Joined{LeftOffset: entry.Offset, RightOffset: other.Offset, HasLeft: true, HasRight: true})
+		} else {
+			ret = append(ret, Joined{LeftOffset: other.Offset, RightOffset: entry.Offset, HasLeft: true, HasRight: true})
+		}
+	}
+	state.Buffers[side][key] = append(state.Buffers[side][key], entry)
+	if entry.Time > state.MaxTime[side] {
+		state.MaxTime[side] = entry.Time
+	}
+	return append(ret, state.expire()...)
+}
+
+// Drop the messages which can no longer match, since the other
+// stream has moved more than Within past them. Assumes that each
+// stream's timestamps are in order.
+func (state *joinState) expire() []Joined {
+	var expired []*joinEntry
+	var sides []int
+	for side, buffer := range state.Buffers {
+		horizon := state.MaxTime[1-side] - state.Within
+		for key, entries := range buffer {
+			keep := entries[:0]
+			for _, entry := range entries {
+				if entry.Time >= horizon {
+					keep = append(keep, entry)
+				} else if !entry.Matched && state.emitsUnmatched(side) {
+					expired = append(expired, entry)
+					sides = append(sides, side)
+				}
+			}
+			if len(keep) == 0 {
+				delete(buffer, key)
+			} else {
+				buffer[key] = keep
+			}
+		}
+	}
+	// Publish in time order, which doesn't depend on map order
+	sort.Sort(&byJoinTime{expired, sides})
+	ret := make([]Joined, len(expired))
+	for n, entry := range expired {
+		if sides[n] == joinLeft {
+			ret[n] = Joined{LeftOffset: entry.Offset, HasLeft: true}
+		} else {
+			ret[n] = Joined{RightOffset: entry.Offset, HasRight: true}
+		}
+	}
+	return ret
+}
+
+func (state *joinState) emitsUnmatched(side int) bool {
+	return state.Kind == JoinOuter || (state.Kind == JoinLeft && side == joinLeft)
+}
+
+type byJoinTime struct {
+	entries []*joinEntry
+	sides   []int
+}
+
+func (a *byJoinTime) Len() int { return len(a.entries) }
+func (a *byJoinTime) Swap(x, y int) {
+	a.entries[x], a.entries[y] = a.entries[y], a.entries[x]
+	a.sides[x], a.sides[y] = a.sides[y], a.sides[x]
+}
+func (a *byJoinTime) Less(x, y int) bool {
+	if a.entries[x].Time != a.entries[y].Time {
+		return a.entries[x].Time < a.entries[y].Time
+	}
+	if a.sides[x] != a.sides[y] {
+		return a.sides[x] < a.sides[y]
+	}
+	return a.entries[x].Offset < a.entries[y].Offset
+}
+
+func abs64(a int64) int64 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
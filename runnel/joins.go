@@ -0,0 +1,201 @@
+package runnel
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Builds a join of two streams
+type TypedJoinBuilder struct {
+	left     *TypedStream
+	right    *TypedStream
+	name     string
+	leftKey  TypedPropertyFunc
+	rightKey TypedPropertyFunc
+	within   time.Duration
+}
+
+// Start building a join of this stream with another. The name
+// identifies the join's output stream and checkpoint, so building
+// a join with the same name resumes where the last one left off.
+func (s *TypedStream) Join(name string, right *TypedStream) *TypedJoinBuilder {
+	return &TypedJoinBuilder{left: s, right: right, name: name}
+}
+
+// Match messages whose keys are equal
+func (b *TypedJoinBuilder) On(leftKey, rightKey TypedPropertyFunc) *TypedJoinBuilder {
+	b.leftKey = leftKey
+	b.rightKey = rightKey
+	return b
+}
+
+// Only match messages whose timestamps are within d of each other
+func (b *TypedJoinBuilder) Within(d time.Duration) *TypedJoinBuilder {
+	b.within = d
+	return b
+}
+
+// Publish only the pairs which matched
+func (b *TypedJoinBuilder) Inner() *TypedJoin {
+	return b.build(JoinInner)
+}
+
+// Also publish messages of the left stream which never matched
+func (b *TypedJoinBuilder) Left() *TypedJoin {
+	return b.build(JoinLeft)
+}
+
+// Also publish messages of either stream which never matched
+func (b *TypedJoinBuilder) Outer() *TypedJoin {
+	return b.build(JoinOuter)
+}
+
+func (b *TypedJoinBuilder) build(kind string) *TypedJoin {
+	left := b.left
+	id := left.Id + "_join_" + b.name
+	output := NewJoinedStream(b.name, id, left.storage.Sibling(id[len(left.Id):]))
+	checkpoint := output.storage.Sibling(checkpointSuffix)
+	data, _ := readBlob(checkpoint)
+	state := loadJoinState(kind, int64(b.within), data)
+
+	ret := &TypedJoin{
+		Name:       b.name,
+		Output:     output,
+		streams:    [2]*TypedStream{left, b.right},
+		keys:       [2]TypedPropertyFunc{b.leftKey, b.rightKey},
+		writer:     output.Writer(),
+		checkpoint: checkpoint,
+		state:      state,
+		published:  publishedPairs(output, state.Output),
+		isAlive:    true,
+	}
+	for side, stream := range ret.streams {
+		ret.readers[side] = stream.Reader(state.Sources[side])
+		ret.loops.Add(1)
+		go ret.joinLoop(side)
+	}
+	return ret
+}
+
+// Pairs up the messages of two streams which share a key and
+// are close in time, and publishes them to its output stream
+type TypedJoin struct {
+	Name string
+	// Every pair, and every unmatched message for
+	// left and outer joins, in order
+	Output *JoinedStream
+	// The left and right streams
+	streams [2]*TypedStream
+	readers [2]*TypedStreamReader
+	keys    [2]TypedPropertyFunc
+	writer  *JoinedStreamWriter
+	// The last checkpointed state
+	checkpoint i.Storage
+	// Guards the state, which both join loops update
+	lock  sync.Mutex
+	state *joinState
+	// Pairs already in the output, which were published
+	// after the checkpoint being resumed from
+	published map[Joined]bool
+	folded    int
+	isAlive   bool
+	loops     sync.WaitGroup
+}
+
+func (j *TypedJoin) joinLoop(side int) {
+	defer j.loops.Done()
+	stream := j.streams[side]
+	for {
+		message, ok := j.readers[side].ReadMessage()
+		if !ok {
+			return
+		}
+		key := ""
+		if j.keys[side] != nil {
+			key = j.keys[side](&message.Data)
+		}
+		entry := &joinEntry{Offset: message.Offset, Time: message.Envelope.Timestamp}
+
+		// Publish under the lock so that the output is
+		// in the same order as the state changes
+		j.lock.Lock()
+		for _, pair := range j.state.add(side, key, entry) {
+			if j.published[pair] {
+				delete(j.published, pair)
+				continue
+			}
+			j.writer.WriteMessage(&pair, i.Envelope{Timestamp: j.pairTime(pair)})
+		}
+		j.state.Sources[side] = message.Offset + stream.typeSize
+		j.folded++
+		if j.folded%checkpointInterval == 0 {
+			j.saveCheckpoint()
+		}
+		j.lock.Unlock()
+	}
+}
+
+// Must be called with the lock held
+func (j *TypedJoin) saveCheckpoint() {
+	j.state.Output = j.Output.header().LastMessage
+	data, _ := json.Marshal(j.state)
+	writeBlob(j.checkpoint, data)
+}
+
+// The later timestamp of the two sides of a pair
+func (j *TypedJoin) pairTime(pair Joined) int64 {
+	var t int64
+	if pair.HasLeft {
+		t = readEnvelope(j.streams[joinLeft].envelopes, pair.LeftOffset/j.streams[joinLeft].typeSize).Timestamp
+	}
+	if pair.HasRight {
+		t = maxInt64(t, readEnvelope(j.streams[joinRight].envelopes, pair.RightOffset/j.streams[joinRight].typeSize).Timestamp)
+	}
+	return t
+}
+
+// The left message of a pair, if there is one
+func (j *TypedJoin) Left(pair Joined) (Typed, bool) {
+	if !pair.HasLeft {
+		var zero Typed
+		return zero, false
+	}
+	return j.streams[joinLeft].at(pair.LeftOffset), true
+}
+
+// The right message of a pair, if there is one
+func (j *TypedJoin) Right(pair Joined) (Typed, bool) {
+	if !pair.HasRight {
+		var zero Typed
+		return zero, false
+	}
+	return j.streams[joinRight].at(pair.RightOffset), true
+}
+
+// The offsets in the left and right streams that the state reflects
+func (j *TypedJoin) Sources() (uint64, uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.state.Sources[joinLeft], j.state.Sources[joinRight]
+}
+
+// Stop joining, checkpoint the state and close the output
+func (j *TypedJoin) Close() {
+	if !j.isAlive {
+		return
+	}
+	j.isAlive = false
+	for _, reader := range j.readers {
+		reader.Close()
+	}
+	j.loops.Wait()
+	j.lock.Lock()
+	j.saveCheckpoint()
+	j.lock.Unlock()
+	j.writer.Close()
+	j.checkpoint.Close()
+	j.Output.Close()
+}
@@ -0,0 +1,164 @@
+package runnel
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestInnerJoin(t *testing.T) {
+	cleanupFiles()
+	requests := NewIntStream("requests", "id", nil)
+	defer requests.Close()
+	responses := NewIntStream("responses", "id_responses", nil)
+	defer responses.Close()
+	writeTimed(requests, 0, 1, 2)
+	writeTimed(responses, 1, 30)
+
+	join := requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Inner()
+	defer join.Close()
+	waitForJoin(join, requests, responses, t)
+
+	testutils.CheckUint64(1, join.Output.Size(), t)
+	reader := join.Output.Reader(0)
+	defer reader.Close()
+	pair := reader.Read()
+	left, ok := join.Left(pair)
+	testutils.ExpectTrue(ok, "Expected a left message", t)
+	testutils.CheckInt(0, left, t)
+	right, ok := join.Right(pair)
+	testutils.ExpectTrue(ok, "Expected a right message", t)
+	testutils.CheckInt(0, right, t)
+}
+
+func TestLeftJoin(t *testing.T) {
+	cleanupFiles()
+	requests := NewIntStream("requests", "id", nil)
+	defer requests.Close()
+	responses := NewIntStream("responses", "id_responses", nil)
+	defer responses.Close()
+	writeTimed(requests, 0, 1, 2)
+	writeTimed(responses, 1, 30)
+
+	join := requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Left()
+	defer join.Close()
+	waitForJoin(join, requests, responses, t)
+
+	// 1 and 2 never got a response
+	pairs, lefts, rights := countJoined(join, 3)
+	testutils.CheckInt(1, pairs, t)
+	testutils.CheckInt(2, lefts, t)
+	testutils.CheckInt(0, rights, t)
+}
+
+func TestOuterJoin(t *testing.T) {
+	cleanupFiles()
+	requests := NewIntStream("requests", "id", nil)
+	defer requests.Close()
+	responses := NewIntStream("responses", "id_responses", nil)
+	defer responses.Close()
+	// The request at 40 moves the left stream past the response at 30
+	writeTimed(requests, 0, 1, 2, 40)
+	writeTimed(responses, 1, 30)
+
+	join := requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Outer()
+	defer join.Close()
+	waitForJoin(join, requests, responses, t)
+
+	pairs, lefts, rights := countJoined(join, 4)
+	testutils.CheckInt(1, pairs, t)
+	testutils.CheckInt(2, lefts, t)
+	testutils.CheckInt(1, rights, t)
+}
+
+func TestJoinResumesFromCheckpoint(t *testing.T) {
+	cleanupFiles()
+	requests := NewIntStream("requests", "id", nil)
+	defer requests.Close()
+	responses := NewIntStream("responses", "id_responses", nil)
+	defer responses.Close()
+	writeTimed(requests, 0, 1)
+
+	join := requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Inner()
+	waitForJoin(join, requests, responses, t)
+	join.Close()
+
+	// The buffered requests survive the restart
+	writeTimed(responses, 3, 4)
+	join = requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Inner()
+	defer join.Close()
+	waitForJoin(join, requests, responses, t)
+	testutils.CheckUint64(2, join.Output.Size(), t)
+}
+
+func TestJoinDoesNotRepublishAfterCrash(t *testing.T) {
+	cleanupFiles()
+	requests := NewIntStream("requests", "id", nil)
+	defer requests.Close()
+	responses := NewIntStream("responses", "id_responses", nil)
+	defer responses.Close()
+	writeTimed(requests, 0, 1, 2)
+	writeTimed(responses, 0)
+
+	join := requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Inner()
+	waitForJoin(join, requests, responses, t)
+	join.Close()
+	checkpoint := requests.storage.Sibling("_join_matched" + checkpointSuffix)
+	defer checkpoint.Close()
+	stale, _ := readBlob(checkpoint)
+
+	writeTimed(responses, 1, 2)
+	join = requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Inner()
+	waitForJoin(join, requests, responses, t)
+	testutils.CheckUint64(3, join.Output.Size(), t)
+	join.Close()
+
+	// As if the join had crashed before checkpointing the new pairs
+	writeBlob(checkpoint, stale)
+	join = requests.Join("matched", responses).On(itoa, itoa).Within(5 * time.Second).Inner()
+	defer join.Close()
+	waitForJoin(join, requests, responses, t)
+	testutils.CheckUint64(3, join.Output.Size(), t)
+}
+
+func itoa(data *int) string {
+	return strconv.Itoa(*data)
+}
+
+// Read the first n results of the join, and count the
+// matched pairs and unmatched messages of each side
+func countJoined(join *IntJoin, n int) (pairs, lefts, rights int) {
+	reader := join.Output.Reader(0)
+	defer reader.Close()
+	for ; n > 0; n-- {
+		pair := reader.Read()
+		switch {
+		case pair.HasLeft && pair.HasRight:
+			pairs++
+		case pair.HasLeft:
+			lefts++
+		case pair.HasRight:
+			rights++
+		}
+	}
+	return
+}
+
+// Wait for the join to have processed every message in both streams
+func waitForJoin(join *IntJoin, left, right *IntStream, t *testing.T) {
+	timeout := time.After(time.Second)
+	for {
+		l, r := join.Sources()
+		if l >= left.header().LastMessage && r >= right.header().LastMessage {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the join to catch up")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
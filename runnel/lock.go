@@ -0,0 +1,294 @@
+package runnel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// How a stream handle coordinates with other handles
+// writing to the same stream, in any process
+type LockMode int
+
+const (
+	// No coordination, as with streams opened by NewTypedStream
+	LockNone LockMode = iota
+	// The only handle which may write to the stream
+	LockExclusive
+	// One of several handles writing to the stream. Each write
+	// reserves its slot atomically, and writes are published in
+	// the order their slots were reserved.
+	LockShared
+	// A handle which only reads, and so never conflicts with writers
+	LockReadOnly
+)
+
+func (mode LockMode) String() string {
+	switch mode {
+	case LockNone:
+		return "none"
+	case LockExclusive:
+		return "exclusive"
+	case LockShared:
+		return "shared"
+	case LockReadOnly:
+		return "read-only"
+	}
+	return "unknown"
+}
+
+// How long a shared writer waits for the writes reserved before its own
+// to be published before checking on their writers. A writer which died
+// after reserving a slot never fills it, so its slot is skipped as stale.
+const reservationTimeout = time.Second
+
+// Shared writers mark each slot in <id>_commits, one mark per slot. A
+// slot is claimed by marking it with the handle of the stream it's
+// written through, and marked again once it's filled, so that no slot
+// is published unfilled and a stale slot can be traced to its writer.
+const commitsSuffix = "_commits"
+
+const (
+	// Not yet reserved
+	slotFree uint64 = iota
+	// Filled by its writer, and so ready to publish
+	slotCommitted
+	// Given up on after its writer died without filling it
+	slotSkipped
+	// Reserved through a handle which couldn't be marked open, and
+	// so is never skipped. Any other mark is the reserving handle.
+	slotUnowned
+)
+
+// Take the lock the mode calls for on the stream's storage
+func lockStorage(storage i.Storage, mode LockMode) error {
+	switch mode {
+	case LockExclusive:
+		return storage.Lock(true, false)
+	case LockShared:
+		return storage.Lock(false, false)
+	}
+	return nil
+}
+
+// Coordinates the writers of a stream handle, typed and raw alike
+type slotPublisher struct {
+	// Taken by writers while they fill a slot, unless
+	// slots are reserved atomically in shared mode
+	lock sync.Mutex
+	// Closed whenever a writer on this handle publishes slots, to wake
+	// the shared writers waiting on them. Publishes by other processes
+	// are only noticed by polling.
+	signalLock sync.Mutex
+	published  chan struct{}
+}
+
+// Every handle of a stream in this process writes through the same
+// slotPublisher, so that writers take turns even across handles which
+// don't lock the stream. Writers in other processes only take turns
+// with these in shared mode.
+var publishers = struct {
+	sync.Mutex
+	byId    map[string]*slotPublisher
+	handles map[string]int
+}{byId: make(map[string]*slotPublisher), handles: make(map[string]int)}
+
+func acquirePublisher(id string) *slotPublisher {
+	publishers.Lock()
+	defer publishers.Unlock()
+	slots := publishers.byId[id]
+	if slots == nil {
+		slots = &slotPublisher{}
+		publishers.byId[id] = slots
+	}
+	publishers.handles[id]++
+	return slots
+}
+
+func releasePublisher(id string) {
+	publishers.Lock()
+	defer publishers.Unlock()
+	if publishers.handles[id]--; publishers.handles[id] <= 0 {
+		delete(publishers.byId, id)
+		delete(publishers.handles, id)
+	}
+}
+
+// Reserve a slot of the given size, write the envelope for it and fill
+// it, then publish it, returning its offset. Writers take turns unless
+// the stream is shared, in which case commits holds the slots' marks
+// and the slot is claimed for the given handle.
+func (slots *slotPublisher) write(storage, envelopes, commits i.Storage, handle, size uint64, env *i.Envelope, fill func(slot []byte)) (uint64, error) {
+	shared := commits != nil
+	if !shared {
+		// The tail isn't bumped atomically, so writers take turns
+		// to reserve, fill and publish their slots
+		slots.lock.Lock()
+		defer slots.lock.Unlock()
+	}
+	header := storage.Header()
+	// Check to see if we need to resize
+	if storage.Utilization() > 75 {
+		// TODO: Work out how to handle multiple writers here, maybe through buffer swap
+		storage.Resize(uint64(2 * storage.Capacity()))
+	}
+
+	var offset uint64
+	owner := slotOwner(handle)
+	if shared {
+		// Reserve a slot, so that writers never share one
+		offset = reserveSlot(header, commits, owner, size)
+		for offset+size > storage.Capacity() {
+			storage.Resize(uint64(2 * storage.Capacity()))
+		}
+	} else {
+		// Get old tail
+		offset = header.Tail
+		// Bump tail
+		header.Tail += size
+	}
+
+	// Check before we write
+	if offset+size > storage.Capacity() {
+		panic(fmt.Sprintf("No Room! Header: %+v", header))
+	}
+
+	writeEnvelope(envelopes, offset/size, env)
+	fill(storage.GetBytes(offset, offset+size))
+
+	// Declare data available
+	if shared {
+		if err := slots.publishInOrder(header, storage, commits, owner, offset, size); err != nil {
+			return offset, err
+		}
+	} else {
+		if header.LastMessage < offset+size {
+			header.LastMessage = offset + size
+		}
+		header.EntryCount += 1
+	}
+	storage.Flush()
+	return offset, nil
+}
+
+// The mark claiming a slot for the given handle
+func slotOwner(handle uint64) uint64 {
+	if handle <= slotUnowned {
+		return slotUnowned
+	}
+	return handle
+}
+
+// Claim the slot at the tail for owner, then move the tail past it,
+// returning its offset. The slot is claimed before the tail moves, so
+// that a writer which dies in between still leaves its mark, and any
+// writer finding the tail slot claimed moves the tail on its behalf.
+func reserveSlot(header *i.StreamHeader, commits i.Storage, owner, size uint64) uint64 {
+	for {
+		tail := atomic.LoadUint64(&header.Tail)
+		claimed := atomic.CompareAndSwapUint64(commitFlag(commits, tail/size), slotFree, owner)
+		atomic.CompareAndSwapUint64(&header.Tail, tail, tail+size)
+		if claimed {
+			return tail
+		}
+	}
+}
+
+// Mark the filled slot at offset as committed, and wait until it's
+// published. Whichever writer fills the first unpublished slot publishes
+// it along with every committed slot after it, so no slot is ever
+// published before those reserved ahead of it. A slot which has held
+// things up for reservationTimeout is skipped if its handle is no longer
+// open, as its writer died without filling it. Slow writers are waited
+// on. Returns an error if the slot at offset was itself skipped.
+func (slots *slotPublisher) publishInOrder(header *i.StreamHeader, storage, commits i.Storage, owner, offset, size uint64) error {
+	if !atomic.CompareAndSwapUint64(commitFlag(commits, offset/size), owner, slotCommitted) {
+		return fmt.Errorf("the slot at offset %d was skipped before it was filled", offset)
+	}
+	stale := time.NewTimer(reservationTimeout)
+	defer stale.Stop()
+	for {
+		published := slots.signal()
+		if publishCommitted(header, commits, size) {
+			slots.notify()
+		}
+		if atomic.LoadUint64(&header.LastMessage) > offset {
+			return nil
+		}
+		select {
+		case <-published:
+		case <-time.After(pollInterval):
+		case <-stale.C:
+			skipDead(header, storage, commits, size)
+			stale.Reset(reservationTimeout)
+		}
+	}
+}
+
+// Skip the first unpublished slot if the handle which reserved it is
+// no longer open
+func skipDead(header *i.StreamHeader, storage, commits i.Storage, size uint64) {
+	first := atomic.LoadUint64(&header.LastMessage)
+	if first+size > atomic.LoadUint64(&header.Tail) {
+		return
+	}
+	flag := commitFlag(commits, first/size)
+	owner := atomic.LoadUint64(flag)
+	if owner <= slotUnowned || storage.HandleOpen(owner) {
+		return
+	}
+	atomic.CompareAndSwapUint64(flag, owner, slotSkipped)
+}
+
+// A channel closed the next time a writer on this handle publishes
+func (slots *slotPublisher) signal() <-chan struct{} {
+	slots.signalLock.Lock()
+	defer slots.signalLock.Unlock()
+	if slots.published == nil {
+		slots.published = make(chan struct{})
+	}
+	return slots.published
+}
+
+func (slots *slotPublisher) notify() {
+	slots.signalLock.Lock()
+	defer slots.signalLock.Unlock()
+	if slots.published != nil {
+		close(slots.published)
+		slots.published = nil
+	}
+}
+
+// Publish the slots following the published records for as long as they
+// are committed or skipped, returning whether any were published
+func publishCommitted(header *i.StreamHeader, commits i.Storage, size uint64) bool {
+	published := false
+	for {
+		last := atomic.LoadUint64(&header.LastMessage)
+		if last+size > atomic.LoadUint64(&header.Tail) {
+			return published
+		}
+		if mark := atomic.LoadUint64(commitFlag(commits, last/size)); mark != slotCommitted && mark != slotSkipped {
+			return published
+		}
+		if atomic.CompareAndSwapUint64(&header.LastMessage, last, last+size) {
+			atomic.AddUint64(&header.EntryCount, 1)
+			published = true
+		}
+	}
+}
+
+// The mark of the slot at the given index, growing the storage to hold it
+func commitFlag(commits i.Storage, index uint64) *uint64 {
+	end := (index + 1) * offsetSize
+	atomicMax(&commits.Header().Tail, end)
+	for commits.Utilization() > 75 {
+		commits.Resize(2 * commits.Capacity())
+	}
+	slice := commits.GetBytes(end-offsetSize, end)
+	return (*uint64)(unsafe.Pointer(&slice[0]))
+}
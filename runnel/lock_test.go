@@ -0,0 +1,285 @@
+package runnel
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestExclusiveWriter(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenIntStream("test", "id", nil, LockExclusive)
+	locked, ok := err.(*i.LockedError)
+	testutils.ExpectTrue(ok, "Expected a locked error", t)
+	testutils.CheckInt(os.Getpid(), locked.Pid, t)
+	testutils.ExpectTrue(strings.Contains(err.Error(), "locked for writing by process"), "Expected a clear error", t)
+	_, err = OpenIntStream("test", "id", nil, LockShared)
+	testutils.ExpectTrue(err != nil, "Expected a shared writer to be locked out", t)
+
+	// Readers don't conflict with writers
+	reader, err := OpenIntStream("test", "id", nil, LockReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeInts(stream, 5)
+	testutils.CheckUint64(5, reader.Size(), t)
+	reader.Close()
+
+	// Released on close
+	stream.Close()
+	stream, err = OpenIntStream("test", "id", nil, LockExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+func TestStaleLock(t *testing.T) {
+	cleanupFiles()
+	helper := startHelper("lock", t)
+	_, err := OpenIntStream("test", "id", nil, LockExclusive)
+	locked, ok := err.(*i.LockedError)
+	testutils.ExpectTrue(ok, "Expected the helper to hold the lock", t)
+	testutils.CheckInt(helper.Process.Pid, locked.Pid, t)
+
+	// The lock dies with the process holding it, leaving its pid behind
+	killHelper(helper)
+	stream, err := OpenIntStream("test", "id", nil, LockExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	_, err = OpenIntStream("test", "id", nil, LockExclusive)
+	testutils.CheckInt(os.Getpid(), err.(*i.LockedError).Pid, t)
+}
+
+func TestSharedWriters(t *testing.T) {
+	cleanupFiles()
+	var handles []*IntStream
+	for n := 0; n < 2; n++ {
+		stream, err := OpenIntStream("test", "id", nil, LockShared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		handles = append(handles, stream)
+	}
+
+	// Several writers on each handle, as there would be across processes
+	var writers sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		writers.Add(1)
+		go func(n int) {
+			defer writers.Done()
+			writer := handles[n%2].Writer()
+			defer writer.Close()
+			for m := 0; m < 1000; m++ {
+				v := n*1000 + m
+				writer.Write(&v)
+			}
+		}(n)
+	}
+	writers.Wait()
+
+	// No slot is shared or skipped
+	testutils.CheckUint64(4000, handles[0].Size(), t)
+	reader := handles[0].Reader(0)
+	defer reader.Close()
+	seen := make(map[int]bool)
+	for n := 0; n < 4000; n++ {
+		seen[reader.Read()] = true
+	}
+	testutils.CheckInt(4000, len(seen), t)
+}
+
+func TestSharedWriterWaitsForEarlierSlots(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	header := stream.storage.Header()
+	// Reserved by a writer which hasn't filled it yet
+	commits := stream.storage.Sibling(commitsSuffix)
+	defer commits.Close()
+	reserveSlot(header, commits, slotOwner(stream.handle), 8)
+
+	written := make(chan bool)
+	go func() {
+		writer := stream.Writer()
+		defer writer.Close()
+		v := 7
+		writer.Write(&v)
+		close(written)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	testutils.CheckUint64(0, atomic.LoadUint64(&header.LastMessage), t)
+
+	// Filling the earlier slot publishes both
+	atomic.StoreUint64(commitFlag(commits, 0), slotCommitted)
+	select {
+	case <-written:
+	case <-time.After(reservationTimeout / 2):
+		t.Fatal("Expected the write to be published once the earlier slot was filled")
+	}
+	testutils.CheckUint64(16, atomic.LoadUint64(&header.LastMessage), t)
+	testutils.CheckUint64(2, atomic.LoadUint64(&header.EntryCount), t)
+}
+
+func TestSharedWriterWaitsForSlowWriter(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	// Another handle, as if in another process, which is slow to fill its slot
+	slow, err := OpenIntStream("slow", "id", nil, LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	header := stream.storage.Header()
+	commits := stream.storage.Sibling(commitsSuffix)
+	defer commits.Close()
+	reserveSlot(header, commits, slotOwner(slow.handle), 8)
+
+	appended := make(chan error)
+	go func() {
+		raw := stream.Raw()
+		defer raw.Close()
+		_, err := raw.Append(intRecord(7), i.Envelope{})
+		appended <- err
+	}()
+	select {
+	case <-appended:
+		t.Fatal("Expected the append to wait for the slow writer")
+	case <-time.After(reservationTimeout * 3 / 2):
+	}
+	testutils.CheckUint64(0, atomic.LoadUint64(&header.LastMessage), t)
+
+	// The slow writer's slot is kept, and published along with the append
+	atomic.StoreUint64(commitFlag(commits, 0), slotCommitted)
+	if err := <-appended; err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckUint64(16, atomic.LoadUint64(&header.LastMessage), t)
+}
+
+func TestSharedWriterSkipsStaleSlot(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	header := stream.storage.Header()
+	// Reserved through a handle whose process died before filling it
+	commits := stream.storage.Sibling(commitsSuffix)
+	defer commits.Close()
+	reserveSlot(header, commits, 0xdead, 8)
+
+	start := time.Now()
+	raw := stream.Raw()
+	defer raw.Close()
+	offset, err := raw.Append(intRecord(7), i.Envelope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckUint64(8, offset, t)
+	testutils.ExpectTrue(time.Since(start) >= reservationTimeout, "Expected the stale slot to hold up the append", t)
+	testutils.CheckUint64(16, atomic.LoadUint64(&header.LastMessage), t)
+	testutils.CheckUint64(slotSkipped, atomic.LoadUint64(commitFlag(commits, 0)), t)
+}
+
+func TestSharedWriterSlotSkipped(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	header := stream.storage.Header()
+	commits := stream.storage.Sibling(commitsSuffix)
+	defer commits.Close()
+	owner := slotOwner(stream.handle)
+	offset := reserveSlot(header, commits, owner, 8)
+
+	// Given up on by another writer before it was committed
+	atomic.StoreUint64(commitFlag(commits, 0), slotSkipped)
+	err = stream.slots.publishInOrder(header, stream.storage, commits, owner, offset, 8)
+	testutils.ExpectTrue(err != nil, "Expected committing a skipped slot to fail", t)
+}
+
+func TestSharedRawAppends(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	// Raw appends and writes reserve slots alike
+	var writers sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		writers.Add(1)
+		go func(n int) {
+			defer writers.Done()
+			if n%2 == 0 {
+				writer := stream.Writer()
+				defer writer.Close()
+				for m := 0; m < 500; m++ {
+					v := n*500 + m
+					writer.Write(&v)
+				}
+				return
+			}
+			raw := stream.Raw()
+			defer raw.Close()
+			for m := 0; m < 500; m++ {
+				if _, err := raw.Append(intRecord(n*500+m), i.Envelope{}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(n)
+	}
+	writers.Wait()
+
+	testutils.CheckUint64(2000, stream.Size(), t)
+	reader := stream.Reader(0)
+	defer reader.Close()
+	seen := make(map[int]bool)
+	for n := 0; n < 2000; n++ {
+		seen[reader.Read()] = true
+	}
+	testutils.CheckInt(2000, len(seen), t)
+}
+
+func TestReadOnly(t *testing.T) {
+	cleanupFiles()
+	stream, err := OpenIntStream("test", "id", nil, LockReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	defer func() {
+		testutils.ExpectTrue(recover() != nil, "Expected writing to a read-only stream to panic", t)
+	}()
+	raw := stream.Raw()
+	_, err = raw.Append(intRecord(1), i.Envelope{})
+	raw.Close()
+	testutils.ExpectTrue(err != nil, "Expected appending to a read-only stream to fail", t)
+	stream.Writer()
+}
@@ -0,0 +1,174 @@
+package runnel
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Edits a message in flight. Modifiers may change
+// both the message and its envelope.
+type TypedModifier interface {
+	Modify(data *Typed, env *i.Envelope)
+}
+
+// Adapts a function to a TypedModifier
+type TypedModifierFunc func(data *Typed, env *i.Envelope)
+
+func (f TypedModifierFunc) Modify(data *Typed, env *i.Envelope) {
+	f(data, env)
+}
+
+// A chain of modifiers, applied in order. Chains are
+// modifiers themselves so that they can be composed.
+type TypedModifierChain struct {
+	parent    *TypedStream
+	modifiers []TypedModifier
+}
+
+// Start building a chain of modifiers to apply to this stream
+func (s *TypedStream) Modify() *TypedModifierChain {
+	return &TypedModifierChain{parent: s}
+}
+
+// Add a modifier to the end of the chain
+func (c *TypedModifierChain) Then(m TypedModifier) *TypedModifierChain {
+	c.modifiers = append(c.modifiers, m)
+	return c
+}
+
+// Tag each message. Messages which already carry
+// i.MaxTags tags are left as they are.
+func (c *TypedModifierChain) AddTag(tag string) *TypedModifierChain {
+	return c.Then(TypedModifierFunc(func(data *Typed, env *i.Envelope) {
+		env.AddTag(tag)
+	}))
+}
+
+// Remove the tag from each message
+func (c *TypedModifierChain) RemoveTag(tag string) *TypedModifierChain {
+	return c.Then(TypedModifierFunc(func(data *Typed, env *i.Envelope) {
+		env.RemoveTag(tag)
+	}))
+}
+
+// Replace the author of each message with a salted hash,
+// or strip it if salt is empty
+func (c *TypedModifierChain) Anonymize(salt string) *TypedModifierChain {
+	return c.Then(TypedModifierFunc(func(data *Typed, env *i.Envelope) {
+		env.Anonymize(salt)
+	}))
+}
+
+// Clear everything but the timestamp from each envelope
+func (c *TypedModifierChain) ClearMetadata() *TypedModifierChain {
+	return c.Then(TypedModifierFunc(func(data *Typed, env *i.Envelope) {
+		env.ClearMetadata()
+	}))
+}
+
+// Replace each message with the zero value
+func (c *TypedModifierChain) ClearPayload() *TypedModifierChain {
+	return c.Then(TypedModifierFunc(func(data *Typed, env *i.Envelope) {
+		var zero Typed
+		*data = zero
+	}))
+}
+
+// Edit each message with the given function
+func (c *TypedModifierChain) EditPayload(edit func(*Typed)) *TypedModifierChain {
+	return c.Then(TypedModifierFunc(func(data *Typed, env *i.Envelope) {
+		edit(data)
+	}))
+}
+
+func (c *TypedModifierChain) Modify(data *Typed, env *i.Envelope) {
+	for _, m := range c.modifiers {
+		m.Modify(data, env)
+	}
+}
+
+// Build a derived stream by applying the chain to every message
+// in this stream, first through the history and then as new
+// messages arrive. Progress is kept in the derived stream, so
+// building the same chain into the same id resumes where the
+// last pipeline left off.
+func (c *TypedModifierChain) Build(name, id string, store i.Storage) *TypedPipeline {
+	modifier := &TypedModifierChain{parent: c.parent, modifiers: append([]TypedModifier{}, c.modifiers...)}
+	output := NewTypedStream(name, id, store)
+	ret := &TypedPipeline{
+		Output:    output,
+		source:    c.parent,
+		modifier:  modifier,
+		storage:   c.parent.storage.Clone(),
+		envelopes: c.parent.envelopes.Clone(),
+		writer:    output.Writer(),
+		sources:   output.storage.Sibling(sourcesSuffix),
+		isAlive:   true,
+		done:      make(chan struct{}),
+	}
+	go ret.runLoop()
+	return ret
+}
+
+// Feeds every message of a source stream through a
+// modifier into a derived stream
+type TypedPipeline struct {
+	// The derived stream
+	Output *TypedStream
+	// The stream being modified
+	source   *TypedStream
+	modifier TypedModifier
+	// The storage to read messages and envelopes from
+	storage   i.Storage
+	envelopes i.Storage
+	writer    *TypedStreamWriter
+	// The source offset of each message in the output
+	sources i.Storage
+	isAlive bool
+	// Closed when the run loop exits
+	done chan struct{}
+}
+
+func (p *TypedPipeline) runLoop() {
+	defer close(p.done)
+	header := p.Output.header()
+	size := p.source.typeSize
+	for p.isAlive && p.source.IsAlive {
+		offset := header.Source
+		if offset+size > atomic.LoadUint64(&p.storage.Header().LastMessage) {
+			time.Sleep(pollInterval)
+			continue
+		}
+		slice := p.storage.GetBytes(offset, offset+size)
+		data := *(*Typed)(unsafe.Pointer(&slice[0]))
+		env := readEnvelope(p.envelopes, offset/size)
+		p.modifier.Modify(&data, &env)
+
+		writeOffset(p.sources, header.Tail/size, offset)
+		p.writer.WriteMessage(&data, env)
+		header.Source = offset + size
+	}
+}
+
+// The offset in the source stream of the message
+// at the given offset in the output
+func (p *TypedPipeline) SourceOffset(offset uint64) uint64 {
+	return readOffset(p.sources, offset/p.source.typeSize)
+}
+
+// Stop the pipeline and close the derived stream
+func (p *TypedPipeline) Close() {
+	if !p.isAlive {
+		return
+	}
+	p.isAlive = false
+	<-p.done
+	p.writer.Close()
+	p.sources.Close()
+	p.storage.Close()
+	p.envelopes.Close()
+	p.Output.Close()
+}
@@ -0,0 +1,126 @@
+package runnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestModifierChain(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	writer := stream.Writer()
+	writer.SetAuthor(42, 7)
+	for n := 0; n < 10; n++ {
+		writer.Write(&n)
+	}
+	writer.Close()
+
+	pipeline := stream.Modify().
+		AddTag("seen").
+		AddTag("temporary").
+		RemoveTag("temporary").
+		Anonymize("salt").
+		EditPayload(func(data *int) { *data *= 10 }).
+		Build("modified", "id_out", nil)
+	defer pipeline.Close()
+
+	reader := pipeline.Output.Reader(0)
+	defer reader.Close()
+	for n := 0; n < 10; n++ {
+		testutils.CheckInt(n*10, reader.Read(), t)
+	}
+
+	env := readEnvelope(pipeline.Output.envelopes, 3)
+	testutils.ExpectTrue(env.HasTag("seen"), "Expected the added tag", t)
+	testutils.ExpectTrue(!env.HasTag("temporary"), "Expected the tag to be removed", t)
+	testutils.ExpectTrue(env.Author != 42 && env.Author != 0, "Expected a hashed author", t)
+	testutils.CheckInt(7, int(env.AuthorType), t)
+
+	// The same salt always gives the same author
+	other := i.Envelope{Author: 42}
+	other.Anonymize("salt")
+	testutils.CheckUint64(other.Author, env.Author, t)
+	other = i.Envelope{Author: 42}
+	other.Anonymize("pepper")
+	testutils.ExpectTrue(other.Author != env.Author, "Expected another salt to give another author", t)
+
+	testutils.CheckUint64(3*8, pipeline.SourceOffset(3*8), t)
+}
+
+func TestModifierClearing(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	writer := stream.Writer()
+	writer.SetAuthor(42, 7)
+	when := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	data := 5
+	writer.WriteMessage(&data, i.Envelope{Timestamp: when})
+	writer.Close()
+
+	pipeline := stream.Modify().AddTag("seen").ClearMetadata().ClearPayload().Build("cleared", "id_out", nil)
+	defer pipeline.Close()
+
+	reader := pipeline.Output.Reader(0)
+	defer reader.Close()
+	testutils.CheckInt(0, reader.Read(), t)
+
+	env := readEnvelope(pipeline.Output.envelopes, 0)
+	testutils.ExpectTrue(env == i.Envelope{Timestamp: when}, "Expected only the timestamp to be kept", t)
+}
+
+func TestModifierChainsCompose(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 10)
+
+	double := stream.Modify().EditPayload(func(data *int) { *data *= 2 })
+	increment := stream.Modify().EditPayload(func(data *int) { *data += 1 })
+	pipeline := stream.Modify().Then(double).Then(increment).Build("composed", "id_out", nil)
+	defer pipeline.Close()
+
+	reader := pipeline.Output.Reader(0)
+	defer reader.Close()
+	for n := 0; n < 10; n++ {
+		testutils.CheckInt(n*2+1, reader.Read(), t)
+	}
+}
+
+func TestPipelineResumes(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeInts(stream, 10)
+
+	pipeline := stream.Modify().AddTag("seen").Build("modified", "id_out", nil)
+	waitForPipeline(pipeline, stream, t)
+	pipeline.Close()
+
+	writeInts(stream, 10)
+
+	pipeline = stream.Modify().AddTag("seen").Build("modified", "id_out", nil)
+	defer pipeline.Close()
+	waitForPipeline(pipeline, stream, t)
+	testutils.CheckUint64(20, pipeline.Output.Size(), t)
+	testutils.CheckUint64(15*8, pipeline.SourceOffset(15*8), t)
+}
+
+// Wait for the pipeline to have processed every message in the stream
+func waitForPipeline(pipeline *IntPipeline, stream *IntStream, t *testing.T) {
+	timeout := time.After(time.Second)
+	for pipeline.Output.header().Source < stream.header().LastMessage {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the pipeline to catch up")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
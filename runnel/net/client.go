@@ -0,0 +1,200 @@
+package net
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	stdnet "net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bounds on the wait between attempts to reconnect
+const (
+	minBackoff = 10 * time.Millisecond
+	maxBackoff = time.Second
+)
+
+// Most records a writer sends before waiting for acks
+const maxInFlight = 1024
+
+// Records a reader asks for at a time
+const fetchCount = 256
+
+// How long a reader's fetch waits for new records
+const longPollWait = time.Second
+
+// How long a reader waits after a failed fetch
+const retryWait = 100 * time.Millisecond
+
+var errClientClosed = errors.New("client closed")
+
+// A connection to a server, shared by any number of remote writers
+// and readers. If the connection drops, the client reconnects and
+// sends again every request which hadn't been answered.
+type Client struct {
+	addr string
+	// Guards everything below
+	lock    sync.Mutex
+	conn    stdnet.Conn
+	writer  *bufio.Writer
+	pending map[uint64]*call
+	nextId  uint64
+	isAlive bool
+}
+
+// A request waiting for its response
+type call struct {
+	request *frame
+	reply   chan *frame
+}
+
+// Connect to the server at the given address
+func Dial(addr string) (*Client, error) {
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		addr:    addr,
+		pending: make(map[uint64]*call),
+		isAlive: true,
+	}
+	c.attach(conn)
+	return c, nil
+}
+
+// Use the connection for requests from now on.
+// Must be called with the lock held, or before the client is shared.
+func (c *Client) attach(conn stdnet.Conn) {
+	c.conn = conn
+	c.writer = bufio.NewWriter(conn)
+	go c.readLoop(conn)
+}
+
+// Send the request and return a channel which will receive its
+// response, or a response carrying an error if the client is closed
+// or the request can't be encoded
+func (c *Client) send(request *frame) chan *frame {
+	reply := make(chan *frame, 1)
+	if err := checkStrings(request); err != nil {
+		reply <- &frame{Type: request.Type, Error: err.Error()}
+		return reply
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.isAlive {
+		reply <- &frame{Type: request.Type, Error: errClientClosed.Error()}
+		return reply
+	}
+	c.nextId++
+	request.Id = c.nextId
+	c.pending[request.Id] = &call{request: request, reply: reply}
+	c.write(request)
+	return reply
+}
+
+// Must be called with the lock held. A failed write closes the
+// connection, so the read loop will notice and reconnect.
+func (c *Client) write(request *frame) {
+	if writeFrame(c.writer, request) != nil || c.writer.Flush() != nil {
+		c.conn.Close()
+	}
+}
+
+// Deliver responses until the connection fails, then reconnect
+func (c *Client) readLoop(conn stdnet.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		response, err := readFrame(reader)
+		if err != nil {
+			break
+		}
+		c.lock.Lock()
+		if call, ok := c.pending[response.Id]; ok {
+			delete(c.pending, response.Id)
+			call.reply <- response
+		}
+		c.lock.Unlock()
+	}
+	conn.Close()
+	c.reconnect()
+}
+
+// Dial until connected or closed, then send again everything
+// still pending, in the order it was first sent
+func (c *Client) reconnect() {
+	backoff := minBackoff
+	for c.alive() {
+		conn, err := stdnet.Dial("tcp", c.addr)
+		if err != nil {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if !c.isAlive {
+			conn.Close()
+			return
+		}
+		c.attach(conn)
+		ids := make(idList, 0, len(c.pending))
+		for id := range c.pending {
+			ids = append(ids, id)
+		}
+		sort.Sort(ids)
+		for _, id := range ids {
+			c.write(c.pending[id].request)
+		}
+		return
+	}
+}
+
+func (c *Client) alive() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.isAlive
+}
+
+// Close the connection. Pending requests fail.
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.isAlive {
+		return
+	}
+	c.isAlive = false
+	c.conn.Close()
+	for id, call := range c.pending {
+		delete(c.pending, id)
+		call.reply <- &frame{Type: call.request.Type, Id: id, Error: errClientClosed.Error()}
+	}
+}
+
+// The size of the records in the named stream
+func (c *Client) open(stream string) (uint64, error) {
+	response := <-c.send(&frame{Type: opOpen, Stream: stream})
+	if response.Error != "" {
+		return 0, errors.New(response.Error)
+	}
+	return response.RecordSize, nil
+}
+
+// A random id for a producer, so that the server can tell
+// the records of different writers apart
+func newProducerId() uint64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+type idList []uint64
+
+func (l idList) Len() int           { return len(l) }
+func (l idList) Less(a, b int) bool { return l[a] < l[b] }
+func (l idList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
@@ -0,0 +1,362 @@
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Messages returned by a fetch unless the request sets a limit
+const defaultFetchLimit = 100
+
+// Largest body an append accepts unless the gateway sets another
+const DefaultMaxBodySize = 1 << 20
+
+// Serves streams over HTTP for clients which don't speak the binary
+// protocol. Messages are JSON objects whose data is in the external
+// form given by the stream's codec.
+//
+//	GET  /streams                            the streams and their header stats
+//	POST /streams/<name>                     append a message, or an array of them
+//	GET  /streams/<name>?offset=&limit=      fetch messages from an offset
+//	GET  /streams/<name>/tail?offset=        follow the stream as server-sent events
+//	GET  /subscribe                          follow any of the streams over a websocket
+//
+// Batches aren't atomic. A batch whose messages don't all decode is
+// refused whole, but if appending fails partway the messages before
+// stay written, and the 500 response lists their offsets.
+type Gateway struct {
+	// Appends with a larger body are refused with 413
+	MaxBodySize int64
+	// Origins of the pages on other sites which may subscribe
+	// over a websocket, such as "https://example.com", or "*"
+	// for any site. Pages on the gateway's own host always can.
+	AllowedOrigins []string
+	lock           sync.Mutex
+	streams        map[string]*runnel.RawStream
+	// Closed to end the tails and subscriptions in progress
+	done    chan struct{}
+	isAlive bool
+}
+
+// A message as seen by gateway clients. Tags may be given
+// when appending, but only their hashes are stored.
+type jsonMessage struct {
+	Offset     uint64          `json:"offset"`
+	Timestamp  int64           `json:"timestamp,omitempty"`
+	Author     uint64          `json:"author,omitempty"`
+	AuthorType uint32          `json:"authorType,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type jsonStream struct {
+	Name       string         `json:"name"`
+	RecordSize uint64         `json:"recordSize"`
+	Header     i.StreamHeader `json:"header"`
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{
+		MaxBodySize: DefaultMaxBodySize,
+		streams:     make(map[string]*runnel.RawStream),
+		done:        make(chan struct{}),
+		isAlive:     true,
+	}
+}
+
+// Make the stream available to clients under the given name.
+// The gateway doesn't close the streams exposed to it.
+func (g *Gateway) Expose(name string, stream *runnel.RawStream) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.streams[name] = stream
+}
+
+// End any tails and subscriptions in progress
+func (g *Gateway) Close() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.isAlive {
+		return
+	}
+	g.isAlive = false
+	close(g.done)
+}
+
+func (g *Gateway) stream(name string) *runnel.RawStream {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.streams[name]
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "subscribe" {
+		g.subscribe(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if parts[0] != "streams" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		g.list(w)
+		return
+	}
+	stream := g.stream(parts[1])
+	if stream == nil {
+		http.Error(w, fmt.Sprintf("no stream named %q", parts[1]), http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 3 && parts[2] == "tail" && r.Method == "GET":
+		g.tail(w, r, stream)
+	case len(parts) == 3:
+		http.NotFound(w, r)
+	case r.Method == "GET":
+		g.fetch(w, r, stream)
+	case r.Method == "POST":
+		g.append(w, r, stream)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+func (g *Gateway) list(w http.ResponseWriter) {
+	g.lock.Lock()
+	ret := make([]jsonStream, 0, len(g.streams))
+	for name, stream := range g.streams {
+		ret = append(ret, jsonStream{Name: name, RecordSize: stream.RecordSize, Header: stream.Header()})
+	}
+	g.lock.Unlock()
+	sort.Sort(byStreamName(ret))
+	writeJSON(w, ret)
+}
+
+// The response to an append which failed partway through
+type appendError struct {
+	Error string `json:"error"`
+	// The messages appended before the failure
+	Offsets []uint64 `json:"offsets"`
+}
+
+// Append the message or array of messages in the body
+func (g *Gateway) append(w http.ResponseWriter, r *http.Request, stream *runnel.RawStream) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, g.MaxBodySize))
+	if err != nil && int64(len(body)) >= g.MaxBodySize {
+		http.Error(w, fmt.Sprintf("body is larger than %d bytes", g.MaxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+	var messages []jsonMessage
+	if batch {
+		err = json.Unmarshal(body, &messages)
+	} else {
+		messages = make([]jsonMessage, 1)
+		err = json.Unmarshal(body, &messages[0])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Decode everything before appending anything, so
+	// that a bad message fails the whole batch
+	records := make([][]byte, len(messages))
+	envelopes := make([]i.Envelope, len(messages))
+	for n, message := range messages {
+		if records[n], err = stream.Codec.Decode(message.Data); err != nil {
+			http.Error(w, fmt.Sprintf("message %d: %s", n, err), http.StatusBadRequest)
+			return
+		}
+		envelopes[n] = i.Envelope{
+			Timestamp:  message.Timestamp,
+			Author:     message.Author,
+			AuthorType: message.AuthorType,
+		}
+		for _, tag := range message.Tags {
+			if !envelopes[n].AddTag(tag) {
+				http.Error(w, fmt.Sprintf("message %d: more than %d tags", n, i.MaxTags), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	offsets := make([]uint64, len(records))
+	for n := range records {
+		if offsets[n], err = stream.Append(records[n], envelopes[n]); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(appendError{fmt.Sprintf("message %d: %s", n, err), offsets[:n]})
+			return
+		}
+	}
+	if batch {
+		writeJSON(w, map[string][]uint64{"offsets": offsets})
+	} else {
+		writeJSON(w, map[string]uint64{"offset": offsets[0]})
+	}
+}
+
+// Return up to limit messages from offset, along with the
+// offset to continue from
+func (g *Gateway) fetch(w http.ResponseWriter, r *http.Request, stream *runnel.RawStream) {
+	offset, err := queryUint(r, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryUint(r, "limit", defaultFetchLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > maxFetchCount {
+		limit = maxFetchCount
+	}
+	if offset%stream.RecordSize != 0 {
+		http.Error(w, fmt.Sprintf("offset %d is not a multiple of the record size %d", offset, stream.RecordSize), http.StatusBadRequest)
+		return
+	}
+	messages := []*jsonMessage{}
+	for ; uint64(len(messages)) < limit; offset += stream.RecordSize {
+		message, err := readJSON(stream, offset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if message == nil {
+			break
+		}
+		messages = append(messages, message)
+	}
+	writeJSON(w, struct {
+		Messages []*jsonMessage `json:"messages"`
+		Next     uint64         `json:"next"`
+	}{messages, offset})
+}
+
+// Stream messages from offset as server-sent events until the client
+// goes away. Each event's id is the offset of its message, so a client
+// which reconnects with Last-Event-ID resumes after the last one it saw.
+func (g *Gateway) tail(w http.ResponseWriter, r *http.Request, stream *runnel.RawStream) {
+	offset, err := queryUint(r, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		if offset, err = strconv.ParseUint(last, 10, 64); err != nil {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		offset += stream.RecordSize
+	}
+	if offset%stream.RecordSize != 0 {
+		http.Error(w, fmt.Sprintf("offset %d is not a multiple of the record size %d", offset, stream.RecordSize), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	gone := r.Context().Done()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		message, err := readJSON(stream, offset)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			flusher.Flush()
+			return
+		}
+		if message == nil {
+			select {
+			case <-time.After(pollInterval):
+				continue
+			case <-gone:
+				return
+			case <-g.done:
+				return
+			}
+		}
+		data, _ := json.Marshal(message)
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		offset += stream.RecordSize
+	}
+}
+
+// The message at the offset, or nil if there isn't one yet
+func readJSON(stream *runnel.RawStream, offset uint64) (*jsonMessage, error) {
+	record, env, ok := stream.Read(offset)
+	if !ok {
+		return nil, nil
+	}
+	return toJSON(stream, runnel.RawMessage{Offset: offset, Envelope: env, Data: record})
+}
+
+func toJSON(stream *runnel.RawStream, message runnel.RawMessage) (*jsonMessage, error) {
+	data, err := stream.Codec.Encode(message.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonMessage{
+		Offset:     message.Offset,
+		Timestamp:  message.Envelope.Timestamp,
+		Author:     message.Envelope.Author,
+		AuthorType: message.Envelope.AuthorType,
+		Data:       data,
+	}, nil
+}
+
+func queryUint(r *http.Request, name string, def uint64) (uint64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	ret, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q", name, value)
+	}
+	return ret, nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+type byStreamName []jsonStream
+
+func (l byStreamName) Len() int           { return len(l) }
+func (l byStreamName) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l byStreamName) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
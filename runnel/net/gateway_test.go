@@ -0,0 +1,151 @@
+package net
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel"
+)
+
+func TestGatewayAppendAndFetch(t *testing.T) {
+	stream, gateway, server := setupGateway(t)
+	defer teardownGateway(stream, gateway, server)
+
+	var single struct{ Offset uint64 }
+	post(server.URL+"/streams/ints", `{"data": 42, "author": 7, "tags": ["a"]}`, &single, t)
+	testutils.CheckUint64(0, single.Offset, t)
+	var batch struct{ Offsets []uint64 }
+	post(server.URL+"/streams/ints", `[{"data": 1}, {"data": 2}, {"data": 3}]`, &batch, t)
+	testutils.CheckInt(3, len(batch.Offsets), t)
+	testutils.CheckUint64(3*8, batch.Offsets[2], t)
+	testutils.CheckUint64(4, stream.Size(), t)
+
+	message, _ := stream.Cursor(0).Next()
+	testutils.CheckInt(42, message.Data, t)
+	testutils.CheckUint64(7, message.Envelope.Author, t)
+	testutils.ExpectTrue(message.Envelope.HasTag("a"), "Expected the tag to be stored", t)
+
+	var page struct {
+		Messages []struct {
+			Offset uint64
+			Data   int
+		}
+		Next uint64
+	}
+	get(server.URL+"/streams/ints?offset=8&limit=2", &page, t)
+	testutils.CheckInt(2, len(page.Messages), t)
+	testutils.CheckInt(1, page.Messages[0].Data, t)
+	testutils.CheckInt(2, page.Messages[1].Data, t)
+	testutils.CheckUint64(3*8, page.Next, t)
+
+	// A bad message fails the whole batch
+	response, _ := http.Post(server.URL+"/streams/ints", "application/json", strings.NewReader(`[{"data": 4}, {"data": "x"}]`))
+	testutils.CheckInt(http.StatusBadRequest, response.StatusCode, t)
+	testutils.CheckUint64(4, stream.Size(), t)
+
+	response, _ = http.Get(server.URL + "/streams/missing")
+	testutils.CheckInt(http.StatusNotFound, response.StatusCode, t)
+
+	gateway.MaxBodySize = 16
+	response, _ = http.Post(server.URL+"/streams/ints", "application/json", strings.NewReader(`{"data": 123456789}`))
+	testutils.CheckInt(http.StatusRequestEntityTooLarge, response.StatusCode, t)
+	testutils.CheckUint64(4, stream.Size(), t)
+
+	// A failed append reports the offsets written before it
+	gateway.MaxBodySize = DefaultMaxBodySize
+	gateway.stream("ints").Close()
+	response, _ = http.Post(server.URL+"/streams/ints", "application/json", strings.NewReader(`[{"data": 4}]`))
+	testutils.CheckInt(http.StatusInternalServerError, response.StatusCode, t)
+	var failed struct {
+		Error   string
+		Offsets []uint64
+	}
+	json.NewDecoder(response.Body).Decode(&failed)
+	response.Body.Close()
+	testutils.ExpectTrue(failed.Error != "", "Expected the error to be given", t)
+	testutils.CheckInt(0, len(failed.Offsets), t)
+}
+
+func TestGatewayList(t *testing.T) {
+	stream, gateway, server := setupGateway(t)
+	defer teardownGateway(stream, gateway, server)
+	writeInts(stream, 0, 10)
+
+	var streams []struct {
+		Name       string
+		RecordSize uint64
+		Header     struct{ EntryCount uint64 }
+	}
+	get(server.URL+"/streams", &streams, t)
+	testutils.CheckInt(1, len(streams), t)
+	testutils.CheckString("ints", streams[0].Name, t)
+	testutils.CheckUint64(8, streams[0].RecordSize, t)
+	testutils.CheckUint64(10, streams[0].Header.EntryCount, t)
+}
+
+func TestGatewayTail(t *testing.T) {
+	stream, gateway, server := setupGateway(t)
+	defer teardownGateway(stream, gateway, server)
+	writeInts(stream, 0, 5)
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/ints/tail?offset=16", nil)
+	// Resuming takes precedence over the offset
+	request.Header.Set("Last-Event-ID", "24")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	testutils.CheckString("text/event-stream", response.Header.Get("Content-Type"), t)
+
+	go writeInts(stream, 5, 10)
+	events := bufio.NewReader(response.Body)
+	for n := 4; n < 10; n++ {
+		id, _ := events.ReadString('\n')
+		data, _ := events.ReadString('\n')
+		events.ReadString('\n')
+		var message struct{ Data int }
+		json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &message)
+		testutils.CheckString("id: "+strconv.Itoa(n*8)+"\n", id, t)
+		testutils.CheckInt(n, message.Data, t)
+	}
+}
+
+func setupGateway(t *testing.T) (*runnel.IntStream, *Gateway, *httptest.Server) {
+	stream := openStream()
+	gateway, server := serveStream(stream)
+	return stream, gateway, server
+}
+
+func teardownGateway(stream *runnel.IntStream, gateway *Gateway, server *httptest.Server) {
+	gateway.Close()
+	server.Close()
+	gateway.stream("ints").Close()
+	stream.Close()
+}
+
+func post(url, body string, into interface{}, t *testing.T) {
+	response, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	testutils.CheckInt(http.StatusOK, response.StatusCode, t)
+	json.NewDecoder(response.Body).Decode(into)
+}
+
+func get(url string, into interface{}, t *testing.T) {
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	testutils.CheckInt(http.StatusOK, response.StatusCode, t)
+	json.NewDecoder(response.Body).Decode(into)
+}
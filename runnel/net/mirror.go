@@ -0,0 +1,325 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel"
+)
+
+// Size of the runnel.Translation records a mirror writes
+const translationSize = uint64(unsafe.Sizeof(runnel.Translation{}))
+
+// Which stream a mirror copies, and where to
+type MirrorRoute struct {
+	// The stream to copy on the source server
+	Source string
+	// The stream to copy into on the target server.
+	// Defaults to the source stream's name.
+	Target string
+	// Only messages passing the filter are copied, if one is
+	// given, e.g. the Matches of a runnel.RawFilter compiled
+	// on a local handle of the source stream
+	Filter func(runnel.RawMessage) bool
+	// A stream of runnel.Translation records on the target server.
+	// If given, the mirror records how far it has got in it, and
+	// resumes from there when restarted.
+	Translations string
+}
+
+// Copies streams from one server to another, e.g. in another
+// datacenter. Unlike a follower, a mirror copies into streams which
+// can be written to by others too, so offsets on the two differ and
+// consumers failing over use its translation records to resume.
+// Messages copied after the last translation record are copied
+// again when the mirror is restarted.
+type Mirror struct {
+	source *Client
+	target *Client
+	// Guards everything below
+	lock sync.Mutex
+	// Why copying stopped, if it stopped by itself
+	err error
+	// Closed to stop copying
+	stop chan struct{}
+	// Done once every route's copy loop exits
+	loops sync.WaitGroup
+}
+
+// The state of a route being copied
+type mirrorRoute struct {
+	MirrorRoute
+	recordSize uint64
+	// Produce to the target stream and to the translations
+	data         mirrorProducer
+	translations mirrorProducer
+	// The next offset to copy from in the source stream
+	next uint64
+}
+
+// A producer for a single stream. The server works out the offset of
+// a resent produce from how far its seq is behind the latest, so each
+// stream needs a run of seqs of its own.
+type mirrorProducer struct {
+	id  uint64
+	seq uint64
+}
+
+func newMirrorProducer() mirrorProducer {
+	return mirrorProducer{id: newProducerId()}
+}
+
+// A produce of the record with the producer's next seq
+func (p *mirrorProducer) produce(stream string, r record) *frame {
+	p.seq++
+	return &frame{
+		Type:     opProduce,
+		Stream:   stream,
+		Producer: p.id,
+		Seq:      p.seq,
+		Records:  []record{r},
+	}
+}
+
+// Start copying each route's stream from the source server to the
+// target server. Fails if a stream is missing or the streams of a
+// route hold records of different sizes.
+func NewMirror(source, target *Client, routes ...MirrorRoute) (*Mirror, error) {
+	states := make([]*mirrorRoute, 0, len(routes))
+	for _, route := range routes {
+		if route.Target == "" {
+			route.Target = route.Source
+		}
+		state, err := openRoute(source, target, route)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	m := &Mirror{
+		source: source,
+		target: target,
+		stop:   make(chan struct{}),
+	}
+	for _, state := range states {
+		m.loops.Add(1)
+		go m.copyLoop(state)
+	}
+	return m, nil
+}
+
+func openRoute(source, target *Client, route MirrorRoute) (*mirrorRoute, error) {
+	size, err := source.open(route.Source)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, err := target.open(route.Target)
+	if err != nil {
+		return nil, err
+	}
+	if size != targetSize {
+		return nil, fmt.Errorf("stream %s holds %d byte records, but %s holds %d byte records", route.Source, size, route.Target, targetSize)
+	}
+	state := &mirrorRoute{
+		MirrorRoute:  route,
+		recordSize:   size,
+		data:         newMirrorProducer(),
+		translations: newMirrorProducer(),
+	}
+	if route.Translations == "" {
+		return state, nil
+	}
+	last, err := lastTranslation(target, route.Translations)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		state.next = last.Source
+	}
+	return state, nil
+}
+
+func (m *Mirror) copyLoop(route *mirrorRoute) {
+	defer m.loops.Done()
+	for {
+		var response *frame
+		select {
+		case response = <-m.source.send(&frame{
+			Type:   opFetch,
+			Stream: route.Source,
+			Offset: route.next,
+			Count:  fetchCount,
+			Wait:   int64(longPollWait),
+		}):
+		case <-m.stop:
+			return
+		}
+		if response.Error != "" {
+			if !m.source.alive() {
+				m.fail(errClientClosed)
+				return
+			}
+			select {
+			case <-time.After(retryWait):
+			case <-m.stop:
+				return
+			}
+			continue
+		}
+		if len(response.Records) == 0 {
+			continue
+		}
+		target, err := m.copyRecords(route, response.Records)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		route.next = response.Offset
+		if route.Translations != "" && target != nil {
+			err = m.translate(route, runnel.Translation{Source: route.next, Target: *target})
+			if err != nil {
+				m.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// Copy the records passing the route's filter, and return one past
+// the offset of the last one copied, or nil if none were
+func (m *Mirror) copyRecords(route *mirrorRoute, records []record) (*uint64, error) {
+	replies := make([]chan *frame, 0, len(records))
+	for _, r := range records {
+		message := runnel.RawMessage{Offset: r.Offset, Envelope: r.Envelope, Data: r.Data}
+		if route.Filter != nil && !route.Filter(message) {
+			continue
+		}
+		replies = append(replies, m.target.send(route.data.produce(route.Target, record{Envelope: r.Envelope, Data: r.Data})))
+	}
+	var end *uint64
+	for _, reply := range replies {
+		ack := <-reply
+		if ack.Error != "" {
+			return nil, fmt.Errorf("copying %s to %s: %s", route.Source, route.Target, ack.Error)
+		}
+		next := ack.Offset + route.recordSize
+		end = &next
+	}
+	return end, nil
+}
+
+func (m *Mirror) translate(route *mirrorRoute, translation runnel.Translation) error {
+	data := make([]byte, translationSize)
+	copy(data, (*[1 << 30]byte)(unsafe.Pointer(&translation))[:translationSize:translationSize])
+	ack := <-m.target.send(route.translations.produce(route.Translations, record{Data: data}))
+	if ack.Error != "" {
+		return fmt.Errorf("recording translation in %s: %s", route.Translations, ack.Error)
+	}
+	return nil
+}
+
+func (m *Mirror) fail(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+// Why the mirror stopped copying a route by itself, e.g.
+// because the target server refused a record. Nil while copying.
+func (m *Mirror) Err() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+// Stop copying
+func (m *Mirror) Close() {
+	m.lock.Lock()
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	m.lock.Unlock()
+	m.loops.Wait()
+}
+
+// =================== TRANSLATION ==================
+
+// The offset in a mirror to resume from, given the offset to resume
+// from in the stream it mirrors and the mirror's translation stream.
+// Resumes at or before the equivalent position, so some messages
+// may be read again.
+func (c *Client) Translate(translations string, source uint64) (uint64, error) {
+	size, err := c.open(translations)
+	if err != nil {
+		return 0, err
+	}
+	if size != translationSize {
+		return 0, fmt.Errorf("stream %s holds %d byte records, not translations", translations, size)
+	}
+	end, err := c.streamEnd(translations)
+	if err != nil {
+		return 0, err
+	}
+	// Translations are in order, so find the last one at or
+	// before the source offset
+	var target uint64
+	low, high := uint64(0), end/translationSize
+	for low < high {
+		mid := (low + high) / 2
+		t, err := fetchTranslation(c, translations, mid*translationSize)
+		if err != nil {
+			return 0, err
+		}
+		if t.Source <= source {
+			target = t.Target
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return target, nil
+}
+
+// The most recent translation in the stream, or nil if there are none
+func lastTranslation(c *Client, translations string) (*runnel.Translation, error) {
+	size, err := c.open(translations)
+	if err != nil {
+		return nil, err
+	}
+	if size != translationSize {
+		return nil, fmt.Errorf("stream %s holds %d byte records, not translations", translations, size)
+	}
+	end, err := c.streamEnd(translations)
+	if err != nil || end == 0 {
+		return nil, err
+	}
+	return fetchTranslation(c, translations, end-translationSize)
+}
+
+func fetchTranslation(c *Client, translations string, offset uint64) (*runnel.Translation, error) {
+	response := <-c.send(&frame{Type: opFetch, Stream: translations, Offset: offset, Count: 1})
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	if len(response.Records) == 0 {
+		return nil, fmt.Errorf("no translation at %d in %s", offset, translations)
+	}
+	t := *(*runnel.Translation)(unsafe.Pointer(&response.Records[0].Data[0]))
+	return &t, nil
+}
+
+// One past the end of the stream
+func (c *Client) streamEnd(stream string) (uint64, error) {
+	response := <-c.send(&frame{Type: opFetch, Stream: stream, Count: 1})
+	if response.Error != "" {
+		return 0, errors.New(response.Error)
+	}
+	return response.Last, nil
+}
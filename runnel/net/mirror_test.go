@@ -0,0 +1,169 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel"
+)
+
+func TestMirror(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	mirror := runnel.NewIntStream("mirror", "net_mirror", nil)
+	defer mirror.Close()
+	translations := runnel.NewTranslationStream("translations", "net_translations", nil)
+	defer translations.Close()
+	target, targetClient := serveMirror(mirror, translations, t)
+	defer teardownMirror(target, targetClient)
+
+	// The mirror has messages of its own, so offsets differ
+	writeInts(mirror, 100, 105)
+	writeAuthored(stream, 0, 10)
+	raw := stream.Raw()
+	defer raw.Close()
+	filter, err := raw.Filter("authorType(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := MirrorRoute{Source: "ints", Target: "copy", Filter: filter.Matches, Translations: "translations"}
+	m, err := NewMirror(client, targetClient, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(func() bool { return mirror.Size() == 5+4 }, t)
+	writeAuthored(stream, 10, 20)
+	eventually(func() bool { return mirror.Size() == 5+7 }, t)
+	m.Close()
+	testutils.ExpectTrue(m.Err() == nil, "Expected no error", t)
+
+	// Only multiples of 3 are copied
+	reader := mirror.Reader(5 * 8)
+	for n := 0; n < 20; n += 3 {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+	reader.Close()
+
+	// Consumers resume at or before the equivalent position
+	for _, c := range []struct{ source, target uint64 }{{0, 0}, {40, 0}, {80, 9 * 8}, {160, 12 * 8}} {
+		offset, err := targetClient.Translate("translations", c.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.CheckUint64(c.target, offset, t)
+	}
+
+	// A restarted mirror carries on where it left off
+	writeAuthored(stream, 20, 30)
+	m, err = NewMirror(client, targetClient, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	eventually(func() bool { return mirror.Size() == 5+10 }, t)
+	reader = mirror.Reader(12 * 8)
+	defer reader.Close()
+	for _, n := range []int{21, 24, 27} {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+}
+
+func TestMirrorErrors(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	mirror := runnel.NewIntStream("mirror", "net_mirror", nil)
+	defer mirror.Close()
+	translations := runnel.NewTranslationStream("translations", "net_translations", nil)
+	defer translations.Close()
+	target, targetClient := serveMirror(mirror, translations, t)
+	defer teardownMirror(target, targetClient)
+
+	_, err := NewMirror(client, targetClient, MirrorRoute{Source: "missing", Target: "copy"})
+	testutils.ExpectTrue(err != nil, "Expected an error for a missing stream", t)
+	_, err = NewMirror(client, targetClient, MirrorRoute{Source: "ints", Target: "translations"})
+	testutils.ExpectTrue(err != nil, "Expected an error for mismatched record sizes", t)
+	_, err = NewMirror(client, targetClient, MirrorRoute{Source: "ints", Target: "copy", Translations: "copy"})
+	testutils.ExpectTrue(err != nil, "Expected an error for a stream which doesn't hold translations", t)
+}
+
+func TestMirrorResendsAfterDrop(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	mirror := runnel.NewIntStream("mirror", "net_mirror", nil)
+	defer mirror.Close()
+	translations := runnel.NewTranslationStream("translations", "net_translations", nil)
+	defer translations.Close()
+	target, targetClient := serveMirror(mirror, translations, t)
+	defer teardownMirror(target, targetClient)
+	writeInts(mirror, 100, 105)
+
+	m := &Mirror{source: client, target: targetClient, stop: make(chan struct{})}
+	route, err := openRoute(client, targetClient, MirrorRoute{Source: "ints", Target: "copy", Translations: "translations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyInts := func(from, to int) uint64 {
+		var records []record
+		for n := from; n < to; n++ {
+			records = append(records, record{Offset: uint64(n * 8), Data: intRecord(n)})
+		}
+		end, err := m.copyRecords(route, records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *end
+	}
+
+	end := copyInts(0, 3)
+	// The connection drops between the data and the translation
+	dropConnections(target)
+	if err := m.translate(route, runnel.Translation{Source: 3 * 8, Target: end}); err != nil {
+		t.Fatal(err)
+	}
+	copyInts(3, 5)
+
+	// A produce sent again after a reconnect is acked
+	// with the offset it was first written at
+	resent := route.data
+	resent.seq = 2
+	ack := <-targetClient.send(resent.produce("copy", record{Data: intRecord(2)}))
+	testutils.CheckString("", ack.Error, t)
+	testutils.CheckUint64(end-8, ack.Offset, t)
+	testutils.CheckUint64(5+5, mirror.Size(), t)
+
+	offset, err := targetClient.Translate("translations", 3*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckUint64(end, offset, t)
+}
+
+func intRecord(n int) []byte {
+	record := make([]byte, 8)
+	for b := range record {
+		record[b] = byte(uint64(n) >> uint(8*b))
+	}
+	return record
+}
+
+// Serve the mirror stream as "copy" and its translations as "translations"
+func serveMirror(mirror *runnel.IntStream, translations *runnel.TranslationStream, t *testing.T) (*Server, *Client) {
+	server := NewServer()
+	server.Expose("copy", mirror.Raw())
+	server.Expose("translations", translations.Raw())
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func teardownMirror(server *Server, client *Client) {
+	client.Close()
+	server.Close()
+	server.stream("copy").Close()
+	server.stream("translations").Close()
+}
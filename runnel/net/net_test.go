@@ -0,0 +1,188 @@
+package net
+
+//go:generate genny -in=remote.go -out=IntRemote.go gen "Typed=int"
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestRemoteWriter(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+
+	writer, err := client.IntWriter("ints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 1000; n++ {
+		v := n
+		writer.WriteMessage(&v, i.Envelope{Author: 7})
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	testutils.CheckUint64(1000, stream.Size(), t)
+
+	reader := stream.Reader(0)
+	defer reader.Close()
+	for n := 0; n < 1000; n++ {
+		message, _ := reader.ReadMessage()
+		testutils.CheckInt(n, message.Data, t)
+		testutils.CheckUint64(7, message.Envelope.Author, t)
+	}
+}
+
+func TestRemoteReader(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	writeInts(stream, 0, 10)
+
+	reader, err := client.IntReader("ints", 5*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for n := 5; n < 10; n++ {
+		message, _ := reader.ReadMessage()
+		testutils.CheckInt(n, message.Data, t)
+		testutils.CheckUint64(uint64(n*8), message.Offset, t)
+	}
+
+	// The reader's fetch is now waiting for more
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writeInts(stream, 10, 20)
+	}()
+	for n := 10; n < 20; n++ {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+
+	writer, err := client.IntWriter("ints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := client.IntReader("ints", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for n := 0; n < 2000; n++ {
+		v := n
+		writer.Write(&v)
+		if n%500 == 250 {
+			dropConnections(server)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	// Every record is appended once, in order, and read once
+	testutils.CheckUint64(2000, stream.Size(), t)
+	for n := 0; n < 2000; n++ {
+		if n == 1000 {
+			dropConnections(server)
+		}
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+
+	_, err := client.IntWriter("missing")
+	testutils.ExpectTrue(err != nil, "Expected an error for a missing stream", t)
+
+	other := runnel.NewAggregateStream("aggregates", "net_aggregates", nil)
+	defer other.Close()
+	raw := other.Raw()
+	defer raw.Close()
+	server.Expose("aggregates", raw)
+	_, err = client.IntReader("aggregates", 0)
+	testutils.ExpectTrue(err != nil, "Expected an error for a stream of another type", t)
+}
+
+func TestLongStreamName(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+
+	// Refused rather than sent with a truncated length
+	_, err := client.IntWriter(strings.Repeat("x", maxStringSize+1))
+	testutils.ExpectTrue(err != nil, "Expected an error for a stream name too long to encode", t)
+	var buf bytes.Buffer
+	err = writeFrame(bufio.NewWriter(&buf), &frame{Error: strings.Repeat("x", maxStringSize+1)})
+	testutils.ExpectTrue(err != nil, "Expected an error for an error too long to encode", t)
+
+	// The connection is still usable
+	writer, err := client.IntWriter("ints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+}
+
+// A fresh stream of ints
+func openStream() *runnel.IntStream {
+	files, _ := filepath.Glob(filepath.Join(os.TempDir(), "net_*"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return runnel.NewIntStream("ints", "net_ints", nil)
+}
+
+func setup(t *testing.T) (*runnel.IntStream, *Server, *Client) {
+	stream := openStream()
+	server := NewServer()
+	server.Expose("ints", stream.Raw())
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream, server, client
+}
+
+func teardown(stream *runnel.IntStream, server *Server, client *Client) {
+	client.Close()
+	server.Close()
+	server.stream("ints").Close()
+	stream.Close()
+}
+
+// Cut every connection to the server, as a network failure would
+func dropConnections(server *Server) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+}
+
+func writeInts(stream *runnel.IntStream, from, to int) {
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := from; n < to; n++ {
+		v := n
+		writer.Write(&v)
+	}
+}
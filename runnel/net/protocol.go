@@ -0,0 +1,210 @@
+// Package net serves runnel streams over TCP and provides remote
+// writers and readers with the same API as local ones.
+//
+// Every request and response is a frame: a 4 byte length followed by
+// that many bytes of fixed fields, two length-prefixed strings and a
+// list of records. All integers are little endian. Each response
+// carries the id of the request it answers, so clients may pipeline
+// any number of requests on one connection.
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Frame types
+const (
+	// Look up a stream's record size
+	opOpen uint8 = iota + 1
+	// Append a record, answered by an opAck
+	opProduce
+	// Read records from an offset, answered by an opRecords
+	opFetch
+	opAck
+	opRecords
+)
+
+// Largest frame either side will accept
+const maxFrameSize = 64 << 20
+
+const envelopeSize = int(unsafe.Sizeof(i.Envelope{}))
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// Strings in a frame are prefixed with a 16 bit length
+const maxStringSize = 1<<16 - 1
+
+// A request or response. Fields which don't apply to a
+// frame's type are left zero.
+type frame struct {
+	Type uint8
+	// Chosen by the client, echoed in the response
+	Id     uint64
+	Stream string
+	// Produce: the producer and its sequence number for the record,
+	// so that a record sent again after a reconnect is only appended once.
+	// Fetch: the follower making the request, 0 for readers.
+	Producer uint64
+	Seq      uint64
+	// Fetch: where to start. Ack: where the record went.
+	// Records: where the next fetch should start.
+	Offset uint64
+	// Fetch: the most records to return
+	Count uint32
+	// Fetch: how long to wait for records if there are none, in nanoseconds
+	Wait int64
+	// Open: the size of the stream's records
+	RecordSize uint64
+	// Records: one past the end of the stream
+	Last uint64
+	// Set on responses to requests which failed
+	Error   string
+	Records []record
+}
+
+type record struct {
+	Offset   uint64
+	Envelope i.Envelope
+	Data     []byte
+}
+
+// Size of the fixed fields of a frame, after the length
+const fixedSize = 1 + 8*7 + 4
+
+// Fails if a string in the frame is too long for its length prefix
+func checkStrings(f *frame) error {
+	for _, s := range []string{f.Stream, f.Error} {
+		if len(s) > maxStringSize {
+			return fmt.Errorf("string of %d bytes is longer than a frame holds, at most %d", len(s), maxStringSize)
+		}
+	}
+	return nil
+}
+
+// Fails without writing anything if the frame can't be encoded
+func writeFrame(w *bufio.Writer, f *frame) error {
+	if err := checkStrings(f); err != nil {
+		return err
+	}
+	size := fixedSize + 2 + len(f.Stream) + 2 + len(f.Error) + 4
+	for _, r := range f.Records {
+		size += 8 + envelopeSize + 4 + len(r.Data)
+	}
+	buf := make([]byte, 4+size)
+	le := binary.LittleEndian
+	le.PutUint32(buf, uint32(size))
+	pos := 4
+	buf[pos] = f.Type
+	pos++
+	for _, v := range []uint64{f.Id, f.Producer, f.Seq, f.Offset, uint64(f.Wait), f.RecordSize, f.Last} {
+		le.PutUint64(buf[pos:], v)
+		pos += 8
+	}
+	le.PutUint32(buf[pos:], f.Count)
+	pos += 4
+	for _, s := range []string{f.Stream, f.Error} {
+		le.PutUint16(buf[pos:], uint16(len(s)))
+		pos += 2
+		pos += copy(buf[pos:], s)
+	}
+	le.PutUint32(buf[pos:], uint32(len(f.Records)))
+	pos += 4
+	for _, r := range f.Records {
+		le.PutUint64(buf[pos:], r.Offset)
+		pos += 8
+		env := r.Envelope
+		pos += copy(buf[pos:], (*[envelopeSize]byte)(unsafe.Pointer(&env))[:])
+		le.PutUint32(buf[pos:], uint32(len(r.Data)))
+		pos += 4
+		pos += copy(buf[pos:], r.Data)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	le := binary.LittleEndian
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := le.Uint32(length[:])
+	if size > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	d := decoder{buf: buf}
+	f := &frame{Type: d.bytes(1)[0]}
+	f.Id = d.uint64()
+	f.Producer = d.uint64()
+	f.Seq = d.uint64()
+	f.Offset = d.uint64()
+	f.Wait = int64(d.uint64())
+	f.RecordSize = d.uint64()
+	f.Last = d.uint64()
+	f.Count = d.uint32()
+	f.Stream = d.string()
+	f.Error = d.string()
+	count := d.uint32()
+	for n := uint32(0); n < count && d.err == nil; n++ {
+		var rec record
+		rec.Offset = d.uint64()
+		if slice := d.bytes(envelopeSize); d.err == nil {
+			rec.Envelope = *(*i.Envelope)(unsafe.Pointer(&slice[0]))
+		}
+		if data := d.bytes(int(d.uint32())); d.err == nil {
+			rec.Data = data
+		}
+		f.Records = append(f.Records, rec)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return f, nil
+}
+
+var errShortFrame = errors.New("frame shorter than its contents")
+
+// Reads fields from a frame, remembering the first overrun
+type decoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil || n < 0 || d.pos+n > len(d.buf) {
+		d.err = errShortFrame
+		// Enough zeros for the integer readers
+		return make([]byte, 8)
+	}
+	ret := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return ret
+}
+
+func (d *decoder) string() string {
+	n := int(binary.LittleEndian.Uint16(d.bytes(2)))
+	if s := d.bytes(n); d.err == nil {
+		return string(s)
+	}
+	return ""
+}
+
+func (d *decoder) uint32() uint32 {
+	return binary.LittleEndian.Uint32(d.bytes(4))
+}
+
+func (d *decoder) uint64() uint64 {
+	return binary.LittleEndian.Uint64(d.bytes(8))
+}
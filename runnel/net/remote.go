@@ -0,0 +1,237 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel"
+	"github.com/asp2insp/runnel-go/runnel/i"
+	"github.com/cheekybits/genny/generic"
+)
+
+type Typed generic.Type
+
+// =================== WRITERS ==================
+
+// Writes to a stream on a server. Writes are pipelined: they return
+// as soon as the record is sent, and Flush waits for the acks.
+type TypedRemoteWriter struct {
+	client   *Client
+	stream   string
+	producer uint64
+	// Guards everything below
+	lock       sync.Mutex
+	seq        uint64
+	author     uint64
+	authorType uint32
+	// Holds a token for each record in flight
+	inFlight chan struct{}
+	acks     sync.WaitGroup
+	// The first error reported by the server, if any
+	err     error
+	isAlive bool
+}
+
+// Open a writer for the named stream on the server
+func (c *Client) TypedWriter(stream string) (*TypedRemoteWriter, error) {
+	if err := checkTypedSize(c, stream); err != nil {
+		return nil, err
+	}
+	return &TypedRemoteWriter{
+		client:   c,
+		stream:   stream,
+		producer: newProducerId(),
+		inFlight: make(chan struct{}, maxInFlight),
+		isAlive:  true,
+	}, nil
+}
+
+func checkTypedSize(c *Client, stream string) error {
+	size, err := c.open(stream)
+	if err != nil {
+		return err
+	}
+	var zero Typed
+	if size != uint64(unsafe.Sizeof(zero)) {
+		return fmt.Errorf("stream %s holds %d byte records, not %d", stream, size, unsafe.Sizeof(zero))
+	}
+	return nil
+}
+
+// Set the author stamped on messages written without one
+func (writer *TypedRemoteWriter) SetAuthor(author uint64, authorType uint32) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	writer.author = author
+	writer.authorType = authorType
+}
+
+// Write the given data into the stream
+func (writer *TypedRemoteWriter) Write(data *Typed) {
+	writer.WriteMessage(data, i.Envelope{})
+}
+
+// Write the given data into the stream with the given envelope.
+// A zero timestamp is replaced with the current time, and a
+// missing author with the writer's author.
+func (writer *TypedRemoteWriter) WriteMessage(data *Typed, env i.Envelope) {
+	if env.Timestamp == 0 {
+		env.Timestamp = time.Now().UnixNano()
+	}
+	size := unsafe.Sizeof(*data)
+	bytes := make([]byte, size)
+	copy(bytes, (*[1 << 30]byte)(unsafe.Pointer(data))[:size:size])
+
+	writer.inFlight <- struct{}{}
+	writer.lock.Lock()
+	if !writer.isAlive {
+		writer.lock.Unlock()
+		<-writer.inFlight
+		return
+	}
+	if env.Author == 0 && env.AuthorType == 0 {
+		env.Author, env.AuthorType = writer.author, writer.authorType
+	}
+	writer.seq++
+	writer.acks.Add(1)
+	// Sent under the lock so that records go out in sequence order
+	reply := writer.client.send(&frame{
+		Type:     opProduce,
+		Stream:   writer.stream,
+		Producer: writer.producer,
+		Seq:      writer.seq,
+		Records:  []record{{Envelope: env, Data: bytes}},
+	})
+	writer.lock.Unlock()
+	go writer.awaitAck(reply)
+}
+
+func (writer *TypedRemoteWriter) awaitAck(reply chan *frame) {
+	ack := <-reply
+	if ack.Error != "" {
+		writer.lock.Lock()
+		if writer.err == nil {
+			writer.err = errors.New(ack.Error)
+		}
+		writer.lock.Unlock()
+	}
+	<-writer.inFlight
+	writer.acks.Done()
+}
+
+// Wait for every record written so far to be acked. Returns
+// the first error reported by the server, if any.
+func (writer *TypedRemoteWriter) Flush() error {
+	writer.acks.Wait()
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.err
+}
+
+// Flush and close the writer
+func (writer *TypedRemoteWriter) Close() {
+	writer.Flush()
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	writer.isAlive = false
+}
+
+// =================== READERS ==================
+
+// Reads a stream on a server from a given offset. After a
+// reconnect, reading resumes where it left off.
+type TypedRemoteReader struct {
+	client *Client
+	stream string
+	// The offset of the next record to fetch
+	offset     uint64
+	outChannel chan runnel.TypedMessage
+	// Closed when the reader is closed, to release
+	// a pending send on the out channel
+	done    chan struct{}
+	isAlive bool
+}
+
+// Open a reader for the named stream on the server,
+// starting at the given offset
+func (c *Client) TypedReader(stream string, base uint64) (*TypedRemoteReader, error) {
+	if err := checkTypedSize(c, stream); err != nil {
+		return nil, err
+	}
+	ret := &TypedRemoteReader{
+		client:     c,
+		stream:     stream,
+		offset:     base,
+		outChannel: make(chan runnel.TypedMessage),
+		done:       make(chan struct{}),
+		isAlive:    true,
+	}
+	go ret.readLoop()
+	return ret, nil
+}
+
+// Long poll the server for records until closed
+func (reader *TypedRemoteReader) readLoop() {
+	defer close(reader.outChannel)
+	for {
+		var response *frame
+		select {
+		case response = <-reader.client.send(&frame{
+			Type:   opFetch,
+			Stream: reader.stream,
+			Offset: reader.offset,
+			Count:  fetchCount,
+			Wait:   int64(longPollWait),
+		}):
+		case <-reader.done:
+			return
+		}
+		if response.Error != "" {
+			if !reader.client.alive() {
+				return
+			}
+			select {
+			case <-time.After(retryWait):
+			case <-reader.done:
+				return
+			}
+			continue
+		}
+		for _, r := range response.Records {
+			message := runnel.TypedMessage{
+				Offset:   r.Offset,
+				Envelope: r.Envelope,
+				Data:     *(*Typed)(unsafe.Pointer(&r.Data[0])),
+			}
+			select {
+			case reader.outChannel <- message:
+			case <-reader.done:
+				return
+			}
+			reader.offset = r.Offset + uint64(len(r.Data))
+		}
+	}
+}
+
+// Read a single value from the stream (in a blocking fashion)
+func (reader *TypedRemoteReader) Read() Typed {
+	return (<-reader.outChannel).Data
+}
+
+// Read a single message from the stream (in a blocking fashion).
+// Returns false once the reader has been closed.
+func (reader *TypedRemoteReader) ReadMessage() (runnel.TypedMessage, bool) {
+	message, ok := <-reader.outChannel
+	return message, ok
+}
+
+func (reader *TypedRemoteReader) Close() {
+	if !reader.isAlive {
+		return
+	}
+	reader.isAlive = false
+	close(reader.done)
+}
@@ -0,0 +1,135 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel"
+)
+
+// Copies a stream on a leader into a local stream, record for record,
+// so that the local stream can take over if the leader is lost. The
+// local stream mustn't be written to until the follower is promoted.
+type Follower struct {
+	client *Client
+	remote string
+	local  *runnel.RawStream
+	id     uint64
+	// One past the end of the leader's stream, as of the last fetch
+	leaderLast uint64
+	// Guards everything below
+	lock sync.Mutex
+	// Why following stopped, if it stopped by itself
+	err error
+	// Closed to stop following
+	stop chan struct{}
+	// Closed when the follow loop exits
+	done chan struct{}
+}
+
+// Start copying the named stream on the client's server into the
+// local stream, resuming after the records the local stream has
+func Follow(client *Client, remote string, local *runnel.RawStream) (*Follower, error) {
+	size, err := client.open(remote)
+	if err != nil {
+		return nil, err
+	}
+	if size != local.RecordSize {
+		return nil, fmt.Errorf("stream %s holds %d byte records, not %d", remote, size, local.RecordSize)
+	}
+	f := &Follower{
+		client: client,
+		remote: remote,
+		local:  local,
+		id:     newProducerId(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go f.followLoop()
+	return f, nil
+}
+
+func (f *Follower) followLoop() {
+	defer close(f.done)
+	for {
+		var response *frame
+		select {
+		case response = <-f.client.send(&frame{
+			Type:     opFetch,
+			Stream:   f.remote,
+			Producer: f.id,
+			Offset:   f.local.LastMessage(),
+			Count:    fetchCount,
+			Wait:     int64(longPollWait),
+		}):
+		case <-f.stop:
+			return
+		}
+		if response.Error != "" {
+			if !f.client.alive() {
+				f.fail(errClientClosed)
+				return
+			}
+			select {
+			case <-time.After(retryWait):
+			case <-f.stop:
+				return
+			}
+			continue
+		}
+		atomic.StoreUint64(&f.leaderLast, response.Last)
+		for _, r := range response.Records {
+			err := f.local.Replicate(runnel.RawMessage{Offset: r.Offset, Envelope: r.Envelope, Data: r.Data})
+			if err != nil {
+				f.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (f *Follower) fail(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.err = err
+}
+
+// Number of records the local stream is behind the leader,
+// as of the last time the follower heard from it
+func (f *Follower) Lag() uint64 {
+	leader, local := atomic.LoadUint64(&f.leaderLast), f.local.LastMessage()
+	if leader <= local {
+		return 0
+	}
+	return (leader - local) / f.local.RecordSize
+}
+
+// Why the follower stopped following by itself, e.g. because the
+// local stream diverged from the leader's. Nil while following.
+func (f *Follower) Err() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.err
+}
+
+// Stop following so that the local stream can be written to, e.g.
+// once the leader has been lost. Records the leader acked but never
+// sent are lost, unless it acked them semi-synchronously.
+func (f *Follower) Promote() *runnel.RawStream {
+	f.Close()
+	return f.local
+}
+
+// Stop following
+func (f *Follower) Close() {
+	f.lock.Lock()
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	f.lock.Unlock()
+	<-f.done
+}
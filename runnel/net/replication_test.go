@@ -0,0 +1,125 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestFollower(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	replica := runnel.NewIntStream("replica", "net_replica", nil)
+	defer replica.Close()
+	local := replica.Raw()
+	defer local.Close()
+	writeAuthored(stream, 0, 500)
+
+	follower, err := Follow(client, "ints", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	eventually(func() bool { return local.LastMessage() == 500*8 }, t)
+	testutils.CheckUint64(0, follower.Lag(), t)
+
+	// Byte for byte, envelopes included
+	leader := server.stream("ints")
+	for offset := uint64(0); offset < 500*8; offset += 8 {
+		expected, expectedEnv, _ := leader.Read(offset)
+		actual, actualEnv, _ := local.Read(offset)
+		testutils.ExpectTrue(bytes.Equal(expected, actual), "Expected identical records", t)
+		testutils.ExpectTrue(expectedEnv == actualEnv, "Expected identical envelopes", t)
+	}
+
+	// Keeps following
+	writeAuthored(stream, 500, 600)
+	eventually(func() bool { return local.LastMessage() == 600*8 }, t)
+	testutils.ExpectTrue(follower.Err() == nil, "Expected no error", t)
+}
+
+func TestSemiSync(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	replica := runnel.NewIntStream("replica", "net_replica", nil)
+	defer replica.Close()
+	local := replica.Raw()
+	defer local.Close()
+
+	// With no followers, acks go out once the timeout passes
+	server.SemiSync(50 * time.Millisecond)
+	writer, _ := client.IntWriter("ints")
+	v := 1
+	start := time.Now()
+	writer.Write(&v)
+	writer.Flush()
+	testutils.ExpectTrue(time.Since(start) >= 50*time.Millisecond, "Expected the ack to wait", t)
+
+	follower, err := Follow(client, "ints", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	server.SemiSync(10 * time.Second)
+	for n := 0; n < 100; n++ {
+		v := n
+		writer.WriteMessage(&v, i.Envelope{})
+	}
+	writer.Flush()
+	// Everything acked is already on the follower
+	testutils.CheckUint64(101*8, local.LastMessage(), t)
+	writer.Close()
+}
+
+func TestPromote(t *testing.T) {
+	stream, server, client := setup(t)
+	defer teardown(stream, server, client)
+	replica := runnel.NewIntStream("replica", "net_replica", nil)
+	defer replica.Close()
+	writeAuthored(stream, 0, 10)
+
+	follower, err := Follow(client, "ints", replica.Raw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(func() bool { return replica.Size() == 10 }, t)
+
+	// The leader goes away, and the follower takes over
+	server.Close()
+	promoted := follower.Promote()
+	defer promoted.Close()
+	next := NewServer()
+	next.Expose("ints", promoted)
+	if err := next.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	nextClient, err := Dial(next.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nextClient.Close()
+	writer, _ := nextClient.IntWriter("ints")
+	v := 10
+	writer.Write(&v)
+	writer.Close()
+
+	reader := replica.Reader(0)
+	defer reader.Close()
+	for n := 0; n <= 10; n++ {
+		testutils.CheckInt(n, reader.Read(), t)
+	}
+}
+
+// Wait for the condition to hold, failing after a few seconds
+func eventually(condition func() bool, t *testing.T) {
+	for start := time.Now(); !condition(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Timed out waiting for condition")
+		}
+	}
+}
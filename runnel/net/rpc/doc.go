@@ -0,0 +1,8 @@
+// Package rpc serves streams over gRPC, as defined in runnel.proto.
+// The server is implemented over the same raw streams, codecs and
+// filters as the HTTP gateway in runnel/net. Unlike the rest of
+// runnel it needs the context package, and the grpc and protobuf
+// modules.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative runnel.proto
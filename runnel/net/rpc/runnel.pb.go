@@ -0,0 +1,795 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: runnel.proto
+
+// The streams of a runnel server, for services which would rather
+// use gRPC than the binary protocol of runnel/net. Message payloads
+// are in the external form given by each stream's codec, as with
+// the HTTP gateway.
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Metadata kept alongside each message
+type Envelope struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Unix nanoseconds, 0 to stamp with the time of the append
+	Timestamp  int64  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Author     uint64 `protobuf:"varint,2,opt,name=author,proto3" json:"author,omitempty"`
+	AuthorType uint32 `protobuf:"varint,3,opt,name=author_type,json=authorType,proto3" json:"author_type,omitempty"`
+	// Tags to add when appending. Only their hashes are stored,
+	// so messages which are read back carry tag_hashes instead.
+	Tags          []string `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty"`
+	TagHashes     []uint32 `protobuf:"varint,5,rep,packed,name=tag_hashes,json=tagHashes,proto3" json:"tag_hashes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Envelope) Reset() {
+	*x = Envelope{}
+	mi := &file_runnel_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Envelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Envelope) ProtoMessage() {}
+
+func (x *Envelope) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Envelope.ProtoReflect.Descriptor instead.
+func (*Envelope) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Envelope) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Envelope) GetAuthor() uint64 {
+	if x != nil {
+		return x.Author
+	}
+	return 0
+}
+
+func (x *Envelope) GetAuthorType() uint32 {
+	if x != nil {
+		return x.AuthorType
+	}
+	return 0
+}
+
+func (x *Envelope) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Envelope) GetTagHashes() []uint32 {
+	if x != nil {
+		return x.TagHashes
+	}
+	return nil
+}
+
+type Message struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Offset   uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Envelope *Envelope              `protobuf:"bytes,2,opt,name=envelope,proto3" json:"envelope,omitempty"`
+	// Encoded with the stream's codec
+	Data          []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_runnel_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Message) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *Message) GetEnvelope() *Envelope {
+	if x != nil {
+		return x.Envelope
+	}
+	return nil
+}
+
+func (x *Message) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type AppendRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Stream   string                 `protobuf:"bytes,1,opt,name=stream,proto3" json:"stream,omitempty"`
+	Envelope *Envelope              `protobuf:"bytes,2,opt,name=envelope,proto3" json:"envelope,omitempty"`
+	// Encoded with the stream's codec
+	Data          []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AppendRequest) Reset() {
+	*x = AppendRequest{}
+	mi := &file_runnel_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AppendRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendRequest) ProtoMessage() {}
+
+func (x *AppendRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendRequest.ProtoReflect.Descriptor instead.
+func (*AppendRequest) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *AppendRequest) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+func (x *AppendRequest) GetEnvelope() *Envelope {
+	if x != nil {
+		return x.Envelope
+	}
+	return nil
+}
+
+func (x *AppendRequest) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type AppendResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AppendResponse) Reset() {
+	*x = AppendResponse{}
+	mi := &file_runnel_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AppendResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendResponse) ProtoMessage() {}
+
+func (x *AppendResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendResponse.ProtoReflect.Descriptor instead.
+func (*AppendResponse) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AppendResponse) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+type AppendStreamResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Offsets       []uint64               `protobuf:"varint,1,rep,packed,name=offsets,proto3" json:"offsets,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AppendStreamResponse) Reset() {
+	*x = AppendStreamResponse{}
+	mi := &file_runnel_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AppendStreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendStreamResponse) ProtoMessage() {}
+
+func (x *AppendStreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendStreamResponse.ProtoReflect.Descriptor instead.
+func (*AppendStreamResponse) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AppendStreamResponse) GetOffsets() []uint64 {
+	if x != nil {
+		return x.Offsets
+	}
+	return nil
+}
+
+type ReadRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Stream string                 `protobuf:"bytes,1,opt,name=stream,proto3" json:"stream,omitempty"`
+	Offset uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	// Filter expression, e.g. authorType(2).property(user="42")
+	Filter string `protobuf:"bytes,3,opt,name=filter,proto3" json:"filter,omitempty"`
+	// Keep the call open and send messages as they're written
+	Follow bool `protobuf:"varint,4,opt,name=follow,proto3" json:"follow,omitempty"`
+	// The most messages to send, 0 for no limit
+	Limit         uint64 `protobuf:"varint,5,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReadRequest) Reset() {
+	*x = ReadRequest{}
+	mi := &file_runnel_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReadRequest) ProtoMessage() {}
+
+func (x *ReadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReadRequest.ProtoReflect.Descriptor instead.
+func (*ReadRequest) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ReadRequest) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+func (x *ReadRequest) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *ReadRequest) GetFilter() string {
+	if x != nil {
+		return x.Filter
+	}
+	return ""
+}
+
+func (x *ReadRequest) GetFollow() bool {
+	if x != nil {
+		return x.Follow
+	}
+	return false
+}
+
+func (x *ReadRequest) GetLimit() uint64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type ListStreamsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListStreamsRequest) Reset() {
+	*x = ListStreamsRequest{}
+	mi := &file_runnel_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListStreamsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListStreamsRequest) ProtoMessage() {}
+
+func (x *ListStreamsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListStreamsRequest.ProtoReflect.Descriptor instead.
+func (*ListStreamsRequest) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{6}
+}
+
+type ListStreamsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Streams       []*StreamInfo          `protobuf:"bytes,1,rep,name=streams,proto3" json:"streams,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListStreamsResponse) Reset() {
+	*x = ListStreamsResponse{}
+	mi := &file_runnel_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListStreamsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListStreamsResponse) ProtoMessage() {}
+
+func (x *ListStreamsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListStreamsResponse.ProtoReflect.Descriptor instead.
+func (*ListStreamsResponse) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListStreamsResponse) GetStreams() []*StreamInfo {
+	if x != nil {
+		return x.Streams
+	}
+	return nil
+}
+
+type StreamInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	RecordSize    uint64                 `protobuf:"varint,2,opt,name=record_size,json=recordSize,proto3" json:"record_size,omitempty"`
+	Header        *Header                `protobuf:"bytes,3,opt,name=header,proto3" json:"header,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamInfo) Reset() {
+	*x = StreamInfo{}
+	mi := &file_runnel_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamInfo) ProtoMessage() {}
+
+func (x *StreamInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamInfo.ProtoReflect.Descriptor instead.
+func (*StreamInfo) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *StreamInfo) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *StreamInfo) GetRecordSize() uint64 {
+	if x != nil {
+		return x.RecordSize
+	}
+	return 0
+}
+
+func (x *StreamInfo) GetHeader() *Header {
+	if x != nil {
+		return x.Header
+	}
+	return nil
+}
+
+type GetHeaderRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Stream        string                 `protobuf:"bytes,1,opt,name=stream,proto3" json:"stream,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetHeaderRequest) Reset() {
+	*x = GetHeaderRequest{}
+	mi := &file_runnel_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetHeaderRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetHeaderRequest) ProtoMessage() {}
+
+func (x *GetHeaderRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetHeaderRequest.ProtoReflect.Descriptor instead.
+func (*GetHeaderRequest) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetHeaderRequest) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+// Mirrors i.StreamHeader
+type Header struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileSize      uint64                 `protobuf:"varint,1,opt,name=file_size,json=fileSize,proto3" json:"file_size,omitempty"`
+	EntryCount    uint64                 `protobuf:"varint,2,opt,name=entry_count,json=entryCount,proto3" json:"entry_count,omitempty"`
+	Tail          uint64                 `protobuf:"varint,3,opt,name=tail,proto3" json:"tail,omitempty"`
+	LastMessage   uint64                 `protobuf:"varint,4,opt,name=last_message,json=lastMessage,proto3" json:"last_message,omitempty"`
+	OpenCount     uint64                 `protobuf:"varint,5,opt,name=open_count,json=openCount,proto3" json:"open_count,omitempty"`
+	Source        uint64                 `protobuf:"varint,6,opt,name=source,proto3" json:"source,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Header) Reset() {
+	*x = Header{}
+	mi := &file_runnel_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Header) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Header) ProtoMessage() {}
+
+func (x *Header) ProtoReflect() protoreflect.Message {
+	mi := &file_runnel_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Header.ProtoReflect.Descriptor instead.
+func (*Header) Descriptor() ([]byte, []int) {
+	return file_runnel_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Header) GetFileSize() uint64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *Header) GetEntryCount() uint64 {
+	if x != nil {
+		return x.EntryCount
+	}
+	return 0
+}
+
+func (x *Header) GetTail() uint64 {
+	if x != nil {
+		return x.Tail
+	}
+	return 0
+}
+
+func (x *Header) GetLastMessage() uint64 {
+	if x != nil {
+		return x.LastMessage
+	}
+	return 0
+}
+
+func (x *Header) GetOpenCount() uint64 {
+	if x != nil {
+		return x.OpenCount
+	}
+	return 0
+}
+
+func (x *Header) GetSource() uint64 {
+	if x != nil {
+		return x.Source
+	}
+	return 0
+}
+
+var File_runnel_proto protoreflect.FileDescriptor
+
+const file_runnel_proto_rawDesc = "" +
+	"\n" +
+	"\frunnel.proto\x12\x06runnel\"\x94\x01\n" +
+	"\bEnvelope\x12\x1c\n" +
+	"\ttimestamp\x18\x01 \x01(\x03R\ttimestamp\x12\x16\n" +
+	"\x06author\x18\x02 \x01(\x04R\x06author\x12\x1f\n" +
+	"\vauthor_type\x18\x03 \x01(\rR\n" +
+	"authorType\x12\x12\n" +
+	"\x04tags\x18\x04 \x03(\tR\x04tags\x12\x1d\n" +
+	"\n" +
+	"tag_hashes\x18\x05 \x03(\rR\ttagHashes\"c\n" +
+	"\aMessage\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12,\n" +
+	"\benvelope\x18\x02 \x01(\v2\x10.runnel.EnvelopeR\benvelope\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"i\n" +
+	"\rAppendRequest\x12\x16\n" +
+	"\x06stream\x18\x01 \x01(\tR\x06stream\x12,\n" +
+	"\benvelope\x18\x02 \x01(\v2\x10.runnel.EnvelopeR\benvelope\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"(\n" +
+	"\x0eAppendResponse\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\"0\n" +
+	"\x14AppendStreamResponse\x12\x18\n" +
+	"\aoffsets\x18\x01 \x03(\x04R\aoffsets\"\x83\x01\n" +
+	"\vReadRequest\x12\x16\n" +
+	"\x06stream\x18\x01 \x01(\tR\x06stream\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\x12\x16\n" +
+	"\x06filter\x18\x03 \x01(\tR\x06filter\x12\x16\n" +
+	"\x06follow\x18\x04 \x01(\bR\x06follow\x12\x14\n" +
+	"\x05limit\x18\x05 \x01(\x04R\x05limit\"\x14\n" +
+	"\x12ListStreamsRequest\"C\n" +
+	"\x13ListStreamsResponse\x12,\n" +
+	"\astreams\x18\x01 \x03(\v2\x12.runnel.StreamInfoR\astreams\"i\n" +
+	"\n" +
+	"StreamInfo\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1f\n" +
+	"\vrecord_size\x18\x02 \x01(\x04R\n" +
+	"recordSize\x12&\n" +
+	"\x06header\x18\x03 \x01(\v2\x0e.runnel.HeaderR\x06header\"*\n" +
+	"\x10GetHeaderRequest\x12\x16\n" +
+	"\x06stream\x18\x01 \x01(\tR\x06stream\"\xb4\x01\n" +
+	"\x06Header\x12\x1b\n" +
+	"\tfile_size\x18\x01 \x01(\x04R\bfileSize\x12\x1f\n" +
+	"\ventry_count\x18\x02 \x01(\x04R\n" +
+	"entryCount\x12\x12\n" +
+	"\x04tail\x18\x03 \x01(\x04R\x04tail\x12!\n" +
+	"\flast_message\x18\x04 \x01(\x04R\vlastMessage\x12\x1d\n" +
+	"\n" +
+	"open_count\x18\x05 \x01(\x04R\topenCount\x12\x16\n" +
+	"\x06source\x18\x06 \x01(\x04R\x06source2\xb8\x02\n" +
+	"\aStreams\x127\n" +
+	"\x06Append\x12\x15.runnel.AppendRequest\x1a\x16.runnel.AppendResponse\x12E\n" +
+	"\fAppendStream\x12\x15.runnel.AppendRequest\x1a\x1c.runnel.AppendStreamResponse(\x01\x12.\n" +
+	"\x04Read\x12\x13.runnel.ReadRequest\x1a\x0f.runnel.Message0\x01\x12F\n" +
+	"\vListStreams\x12\x1a.runnel.ListStreamsRequest\x1a\x1b.runnel.ListStreamsResponse\x125\n" +
+	"\tGetHeader\x12\x18.runnel.GetHeaderRequest\x1a\x0e.runnel.HeaderB2Z0github.com/asp2insp/runnel-go/runnel/net/rpc;rpcb\x06proto3"
+
+var (
+	file_runnel_proto_rawDescOnce sync.Once
+	file_runnel_proto_rawDescData []byte
+)
+
+func file_runnel_proto_rawDescGZIP() []byte {
+	file_runnel_proto_rawDescOnce.Do(func() {
+		file_runnel_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_runnel_proto_rawDesc), len(file_runnel_proto_rawDesc)))
+	})
+	return file_runnel_proto_rawDescData
+}
+
+var file_runnel_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_runnel_proto_goTypes = []any{
+	(*Envelope)(nil),             // 0: runnel.Envelope
+	(*Message)(nil),              // 1: runnel.Message
+	(*AppendRequest)(nil),        // 2: runnel.AppendRequest
+	(*AppendResponse)(nil),       // 3: runnel.AppendResponse
+	(*AppendStreamResponse)(nil), // 4: runnel.AppendStreamResponse
+	(*ReadRequest)(nil),          // 5: runnel.ReadRequest
+	(*ListStreamsRequest)(nil),   // 6: runnel.ListStreamsRequest
+	(*ListStreamsResponse)(nil),  // 7: runnel.ListStreamsResponse
+	(*StreamInfo)(nil),           // 8: runnel.StreamInfo
+	(*GetHeaderRequest)(nil),     // 9: runnel.GetHeaderRequest
+	(*Header)(nil),               // 10: runnel.Header
+}
+var file_runnel_proto_depIdxs = []int32{
+	0,  // 0: runnel.Message.envelope:type_name -> runnel.Envelope
+	0,  // 1: runnel.AppendRequest.envelope:type_name -> runnel.Envelope
+	8,  // 2: runnel.ListStreamsResponse.streams:type_name -> runnel.StreamInfo
+	10, // 3: runnel.StreamInfo.header:type_name -> runnel.Header
+	2,  // 4: runnel.Streams.Append:input_type -> runnel.AppendRequest
+	2,  // 5: runnel.Streams.AppendStream:input_type -> runnel.AppendRequest
+	5,  // 6: runnel.Streams.Read:input_type -> runnel.ReadRequest
+	6,  // 7: runnel.Streams.ListStreams:input_type -> runnel.ListStreamsRequest
+	9,  // 8: runnel.Streams.GetHeader:input_type -> runnel.GetHeaderRequest
+	3,  // 9: runnel.Streams.Append:output_type -> runnel.AppendResponse
+	4,  // 10: runnel.Streams.AppendStream:output_type -> runnel.AppendStreamResponse
+	1,  // 11: runnel.Streams.Read:output_type -> runnel.Message
+	7,  // 12: runnel.Streams.ListStreams:output_type -> runnel.ListStreamsResponse
+	10, // 13: runnel.Streams.GetHeader:output_type -> runnel.Header
+	9,  // [9:14] is the sub-list for method output_type
+	4,  // [4:9] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_runnel_proto_init() }
+func file_runnel_proto_init() {
+	if File_runnel_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_runnel_proto_rawDesc), len(file_runnel_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_runnel_proto_goTypes,
+		DependencyIndexes: file_runnel_proto_depIdxs,
+		MessageInfos:      file_runnel_proto_msgTypes,
+	}.Build()
+	File_runnel_proto = out.File
+	file_runnel_proto_goTypes = nil
+	file_runnel_proto_depIdxs = nil
+}
@@ -0,0 +1,283 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: runnel.proto
+
+// The streams of a runnel server, for services which would rather
+// use gRPC than the binary protocol of runnel/net. Message payloads
+// are in the external form given by each stream's codec, as with
+// the HTTP gateway.
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Streams_Append_FullMethodName       = "/runnel.Streams/Append"
+	Streams_AppendStream_FullMethodName = "/runnel.Streams/AppendStream"
+	Streams_Read_FullMethodName         = "/runnel.Streams/Read"
+	Streams_ListStreams_FullMethodName  = "/runnel.Streams/ListStreams"
+	Streams_GetHeader_FullMethodName    = "/runnel.Streams/GetHeader"
+)
+
+// StreamsClient is the client API for Streams service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StreamsClient interface {
+	// Append a message and return its offset
+	Append(ctx context.Context, in *AppendRequest, opts ...grpc.CallOption) (*AppendResponse, error)
+	// Append messages in order, returning their offsets once the
+	// client closes its side
+	AppendStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AppendRequest, AppendStreamResponse], error)
+	// Read messages from an offset, optionally following the stream
+	Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Message], error)
+	ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error)
+	GetHeader(ctx context.Context, in *GetHeaderRequest, opts ...grpc.CallOption) (*Header, error)
+}
+
+type streamsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStreamsClient(cc grpc.ClientConnInterface) StreamsClient {
+	return &streamsClient{cc}
+}
+
+func (c *streamsClient) Append(ctx context.Context, in *AppendRequest, opts ...grpc.CallOption) (*AppendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendResponse)
+	err := c.cc.Invoke(ctx, Streams_Append_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *streamsClient) AppendStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AppendRequest, AppendStreamResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Streams_ServiceDesc.Streams[0], Streams_AppendStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AppendRequest, AppendStreamResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Streams_AppendStreamClient = grpc.ClientStreamingClient[AppendRequest, AppendStreamResponse]
+
+func (c *streamsClient) Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Message], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Streams_ServiceDesc.Streams[1], Streams_Read_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadRequest, Message]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Streams_ReadClient = grpc.ServerStreamingClient[Message]
+
+func (c *streamsClient) ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListStreamsResponse)
+	err := c.cc.Invoke(ctx, Streams_ListStreams_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *streamsClient) GetHeader(ctx context.Context, in *GetHeaderRequest, opts ...grpc.CallOption) (*Header, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Header)
+	err := c.cc.Invoke(ctx, Streams_GetHeader_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StreamsServer is the server API for Streams service.
+// All implementations must embed UnimplementedStreamsServer
+// for forward compatibility.
+type StreamsServer interface {
+	// Append a message and return its offset
+	Append(context.Context, *AppendRequest) (*AppendResponse, error)
+	// Append messages in order, returning their offsets once the
+	// client closes its side
+	AppendStream(grpc.ClientStreamingServer[AppendRequest, AppendStreamResponse]) error
+	// Read messages from an offset, optionally following the stream
+	Read(*ReadRequest, grpc.ServerStreamingServer[Message]) error
+	ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error)
+	GetHeader(context.Context, *GetHeaderRequest) (*Header, error)
+	mustEmbedUnimplementedStreamsServer()
+}
+
+// UnimplementedStreamsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStreamsServer struct{}
+
+func (UnimplementedStreamsServer) Append(context.Context, *AppendRequest) (*AppendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Append not implemented")
+}
+func (UnimplementedStreamsServer) AppendStream(grpc.ClientStreamingServer[AppendRequest, AppendStreamResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method AppendStream not implemented")
+}
+func (UnimplementedStreamsServer) Read(*ReadRequest, grpc.ServerStreamingServer[Message]) error {
+	return status.Errorf(codes.Unimplemented, "method Read not implemented")
+}
+func (UnimplementedStreamsServer) ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListStreams not implemented")
+}
+func (UnimplementedStreamsServer) GetHeader(context.Context, *GetHeaderRequest) (*Header, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHeader not implemented")
+}
+func (UnimplementedStreamsServer) mustEmbedUnimplementedStreamsServer() {}
+func (UnimplementedStreamsServer) testEmbeddedByValue()                 {}
+
+// UnsafeStreamsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StreamsServer will
+// result in compilation errors.
+type UnsafeStreamsServer interface {
+	mustEmbedUnimplementedStreamsServer()
+}
+
+func RegisterStreamsServer(s grpc.ServiceRegistrar, srv StreamsServer) {
+	// If the following call pancis, it indicates UnimplementedStreamsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Streams_ServiceDesc, srv)
+}
+
+func _Streams_Append_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StreamsServer).Append(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Streams_Append_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StreamsServer).Append(ctx, req.(*AppendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Streams_AppendStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StreamsServer).AppendStream(&grpc.GenericServerStream[AppendRequest, AppendStreamResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Streams_AppendStreamServer = grpc.ClientStreamingServer[AppendRequest, AppendStreamResponse]
+
+func _Streams_Read_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StreamsServer).Read(m, &grpc.GenericServerStream[ReadRequest, Message]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Streams_ReadServer = grpc.ServerStreamingServer[Message]
+
+func _Streams_ListStreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListStreamsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StreamsServer).ListStreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Streams_ListStreams_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StreamsServer).ListStreams(ctx, req.(*ListStreamsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Streams_GetHeader_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetHeaderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StreamsServer).GetHeader(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Streams_GetHeader_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StreamsServer).GetHeader(ctx, req.(*GetHeaderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Streams_ServiceDesc is the grpc.ServiceDesc for Streams service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Streams_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "runnel.Streams",
+	HandlerType: (*StreamsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Append",
+			Handler:    _Streams_Append_Handler,
+		},
+		{
+			MethodName: "ListStreams",
+			Handler:    _Streams_ListStreams_Handler,
+		},
+		{
+			MethodName: "GetHeader",
+			Handler:    _Streams_GetHeader_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AppendStream",
+			Handler:       _Streams_AppendStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Read",
+			Handler:       _Streams_Read_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "runnel.proto",
+}
@@ -0,0 +1,218 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel"
+	"github.com/asp2insp/runnel-go/runnel/i"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How often a followed read checks for new messages
+// once it has caught up
+const pollInterval = 5 * time.Millisecond
+
+// Serves the streams exposed to it over gRPC. Register it with
+// a gRPC server to make the streams available:
+//
+//	server := rpc.NewServer()
+//	server.Expose("clicks", stream.Raw())
+//	rpc.RegisterStreamsServer(grpcServer, server)
+type Server struct {
+	UnimplementedStreamsServer
+	lock    sync.Mutex
+	streams map[string]*runnel.RawStream
+}
+
+func NewServer() *Server {
+	return &Server{streams: make(map[string]*runnel.RawStream)}
+}
+
+// Make the stream available to clients under the given name.
+// The server doesn't close the streams exposed to it.
+func (s *Server) Expose(name string, stream *runnel.RawStream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.streams[name] = stream
+}
+
+func (s *Server) stream(name string) (*runnel.RawStream, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stream, ok := s.streams[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no stream named %q", name)
+	}
+	return stream, nil
+}
+
+func (s *Server) Append(ctx context.Context, request *AppendRequest) (*AppendResponse, error) {
+	offset, err := s.append(request)
+	if err != nil {
+		return nil, err
+	}
+	return &AppendResponse{Offset: offset}, nil
+}
+
+// Append each message as it arrives, so that a bad message
+// fails the call after the messages before it are appended
+func (s *Server) AppendStream(calls Streams_AppendStreamServer) error {
+	var offsets []uint64
+	for {
+		request, err := calls.Recv()
+		if err == io.EOF {
+			return calls.SendAndClose(&AppendStreamResponse{Offsets: offsets})
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := s.append(request)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, offset)
+	}
+}
+
+func (s *Server) append(request *AppendRequest) (uint64, error) {
+	stream, err := s.stream(request.Stream)
+	if err != nil {
+		return 0, err
+	}
+	record, err := stream.Codec.Decode(request.Data)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	env, err := toEnvelope(request.Envelope)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := stream.Append(record, env)
+	if err != nil {
+		return 0, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return offset, nil
+}
+
+// Send the messages from the offset which pass the filter, until the
+// limit is reached or, unless following, the end of the stream
+func (s *Server) Read(request *ReadRequest, calls Streams_ReadServer) error {
+	stream, err := s.stream(request.Stream)
+	if err != nil {
+		return err
+	}
+	if request.Offset%stream.RecordSize != 0 {
+		return status.Errorf(codes.InvalidArgument, "offset %d is not a multiple of the record size %d", request.Offset, stream.RecordSize)
+	}
+	var filter *runnel.RawFilter
+	if request.Filter != "" {
+		if filter, err = stream.Filter(request.Filter); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	offset := request.Offset
+	for sent := uint64(0); request.Limit == 0 || sent < request.Limit; {
+		record, env, ok := stream.Read(offset)
+		if !ok {
+			if !request.Follow {
+				return nil
+			}
+			select {
+			case <-time.After(pollInterval):
+				continue
+			case <-calls.Context().Done():
+				return status.FromContextError(calls.Context().Err()).Err()
+			}
+		}
+		message := runnel.RawMessage{Offset: offset, Envelope: env, Data: record}
+		offset += stream.RecordSize
+		if filter != nil && !filter.Matches(message) {
+			continue
+		}
+		data, err := stream.Codec.Encode(record)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := calls.Send(&Message{Offset: message.Offset, Envelope: fromEnvelope(env), Data: data}); err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+func (s *Server) ListStreams(ctx context.Context, request *ListStreamsRequest) (*ListStreamsResponse, error) {
+	s.lock.Lock()
+	ret := make([]*StreamInfo, 0, len(s.streams))
+	for name, stream := range s.streams {
+		ret = append(ret, &StreamInfo{Name: name, RecordSize: stream.RecordSize, Header: fromHeader(stream.Header())})
+	}
+	s.lock.Unlock()
+	sort.Sort(byStreamName(ret))
+	return &ListStreamsResponse{Streams: ret}, nil
+}
+
+func (s *Server) GetHeader(ctx context.Context, request *GetHeaderRequest) (*Header, error) {
+	stream, err := s.stream(request.Stream)
+	if err != nil {
+		return nil, err
+	}
+	return fromHeader(stream.Header()), nil
+}
+
+// The envelope to append a message with. Tags are added by name,
+// and tag hashes, such as those of a message read back, as they are.
+func toEnvelope(env *Envelope) (i.Envelope, error) {
+	if env == nil {
+		return i.Envelope{}, nil
+	}
+	ret := i.Envelope{Timestamp: env.Timestamp, Author: env.Author, AuthorType: env.AuthorType}
+	free := 0
+	for _, h := range env.TagHashes {
+		for free < i.MaxTags && ret.Tags[free] != 0 {
+			free++
+		}
+		if free == i.MaxTags {
+			return ret, status.Errorf(codes.InvalidArgument, "more than %d tags", i.MaxTags)
+		}
+		ret.Tags[free] = h
+	}
+	for _, tag := range env.Tags {
+		if !ret.AddTag(tag) {
+			return ret, status.Errorf(codes.InvalidArgument, "more than %d tags", i.MaxTags)
+		}
+	}
+	return ret, nil
+}
+
+func fromEnvelope(env i.Envelope) *Envelope {
+	ret := &Envelope{Timestamp: env.Timestamp, Author: env.Author, AuthorType: env.AuthorType}
+	for _, h := range env.Tags {
+		if h != 0 {
+			ret.TagHashes = append(ret.TagHashes, h)
+		}
+	}
+	return ret
+}
+
+func fromHeader(header i.StreamHeader) *Header {
+	return &Header{
+		FileSize:    header.FileSize,
+		EntryCount:  header.EntryCount,
+		Tail:        header.Tail,
+		LastMessage: header.LastMessage,
+		OpenCount:   header.OpenCount,
+		Source:      header.Source,
+	}
+}
+
+type byStreamName []*StreamInfo
+
+func (l byStreamName) Len() int           { return len(l) }
+func (l byStreamName) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l byStreamName) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
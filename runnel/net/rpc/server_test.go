@@ -0,0 +1,154 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	stdnet "net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestRoundTrip(t *testing.T) {
+	stream, client, teardown := setup(t)
+	defer teardown()
+	ctx := context.Background()
+
+	appended, err := client.Append(ctx, &AppendRequest{
+		Stream:   "ints",
+		Envelope: &Envelope{Author: 7, AuthorType: 2, Tags: []string{"a"}},
+		Data:     []byte("42"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckUint64(0, appended.Offset, t)
+
+	calls, err := client.AppendStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"1", "2", "3"} {
+		if err := calls.Send(&AppendRequest{Stream: "ints", Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch, err := calls.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckInt(3, len(batch.Offsets), t)
+	testutils.CheckUint64(3*8, batch.Offsets[2], t)
+	testutils.CheckUint64(4, stream.Size(), t)
+
+	messages := read(client, &ReadRequest{Stream: "ints"}, t)
+	testutils.CheckInt(4, len(messages), t)
+	testutils.CheckString("42", string(messages[0].Data), t)
+	testutils.CheckUint64(7, messages[0].Envelope.Author, t)
+	testutils.CheckInt(1, len(messages[0].Envelope.TagHashes), t)
+	testutils.CheckString("3", string(messages[3].Data), t)
+
+	messages = read(client, &ReadRequest{Stream: "ints", Filter: "authorType(2)"}, t)
+	testutils.CheckInt(1, len(messages), t)
+	messages = read(client, &ReadRequest{Stream: "ints", Offset: 8, Limit: 2}, t)
+	testutils.CheckInt(2, len(messages), t)
+	testutils.CheckUint64(16, messages[1].Offset, t)
+
+	list, err := client.ListStreams(ctx, &ListStreamsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckInt(1, len(list.Streams), t)
+	testutils.CheckString("ints", list.Streams[0].Name, t)
+	testutils.CheckUint64(8, list.Streams[0].RecordSize, t)
+	header, err := client.GetHeader(ctx, &GetHeaderRequest{Stream: "ints"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckUint64(4, header.EntryCount, t)
+
+	_, err = client.GetHeader(ctx, &GetHeaderRequest{Stream: "missing"})
+	testutils.ExpectTrue(status.Code(err) == codes.NotFound, "Expected a missing stream not to be found", t)
+	_, err = client.Append(ctx, &AppendRequest{Stream: "ints", Data: []byte("x")})
+	testutils.ExpectTrue(status.Code(err) == codes.InvalidArgument, "Expected a bad message to be refused", t)
+}
+
+func TestFollow(t *testing.T) {
+	stream, client, teardown := setup(t)
+	defer teardown()
+
+	calls, err := client.Read(context.Background(), &ReadRequest{Stream: "ints", Follow: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := stream.Writer()
+	for n := 5; n < 7; n++ {
+		v := n
+		writer.Write(&v)
+	}
+	writer.Close()
+	for _, expected := range []string{"5", "6"} {
+		message, err := calls.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.CheckString(expected, string(message.Data), t)
+	}
+	_, err = calls.Recv()
+	testutils.ExpectTrue(err == io.EOF, "Expected the read to end at its limit", t)
+}
+
+// Serve a stream over gRPC and connect a client to it
+func setup(t *testing.T) (*runnel.IntStream, StreamsClient, func()) {
+	files, _ := filepath.Glob(filepath.Join(os.TempDir(), "rpc_*"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+	stream := runnel.NewIntStream("ints", "rpc_ints", nil)
+	raw := stream.Raw()
+	server := NewServer()
+	server.Expose("ints", raw)
+
+	listener, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	RegisterStreamsServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream, NewStreamsClient(conn), func() {
+		conn.Close()
+		grpcServer.Stop()
+		raw.Close()
+		stream.Close()
+	}
+}
+
+func read(client StreamsClient, request *ReadRequest, t *testing.T) []*Message {
+	calls, err := client.Read(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []*Message
+	for {
+		message, err := calls.Recv()
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, message)
+	}
+}
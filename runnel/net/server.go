@@ -0,0 +1,310 @@
+package net
+
+import (
+	"bufio"
+	"fmt"
+	stdnet "net"
+	"sync"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel"
+)
+
+// How often a long poll checks for new records
+const pollInterval = 5 * time.Millisecond
+
+// The most records returned by a single fetch
+const maxFetchCount = 1024
+
+// How many recent sequence numbers are remembered for each producer.
+// Writers keep fewer records than this in flight, so everything a
+// writer could send again after a reconnect is covered.
+const producerWindow = 2 * maxInFlight
+
+// Serves the streams exposed to it to any number of clients
+type Server struct {
+	lock     sync.Mutex
+	streams  map[string]*runnel.RawStream
+	listener stdnet.Listener
+	conns    map[stdnet.Conn]bool
+	// Offsets of the records recently appended by each producer
+	producers map[producerKey]*producerState
+	// How far each follower has replicated each stream
+	replicas map[producerKey]uint64
+	// How long acks wait for a follower to replicate the record,
+	// 0 for asynchronous replication
+	syncTimeout time.Duration
+	isAlive     bool
+}
+
+type producerKey struct {
+	Stream   string
+	Producer uint64
+}
+
+type producerState struct {
+	// A producer may briefly be on two connections as it reconnects
+	lock sync.Mutex
+	// The latest sequence number appended
+	Seq uint64
+	// Offsets of the records with sequence numbers up to
+	// and including Seq, oldest first
+	Offsets []uint64
+}
+
+func NewServer() *Server {
+	return &Server{
+		streams:   make(map[string]*runnel.RawStream),
+		conns:     make(map[stdnet.Conn]bool),
+		producers: make(map[producerKey]*producerState),
+		replicas:  make(map[producerKey]uint64),
+	}
+}
+
+// Hold the ack for each record until a follower has replicated it,
+// or the timeout passes, so that an acked record usually survives
+// the loss of this server. A timeout of 0, the default, acks as
+// soon as the record is appended.
+func (s *Server) SemiSync(timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.syncTimeout = timeout
+}
+
+// Make the stream available to clients under the given name.
+// The server doesn't close the streams exposed to it.
+func (s *Server) Expose(name string, stream *runnel.RawStream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.streams[name] = stream
+}
+
+// Start accepting connections on the given address
+func (s *Server) Listen(addr string) error {
+	listener, err := stdnet.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = listener
+	s.isAlive = true
+	s.lock.Unlock()
+	go s.acceptLoop(listener)
+	return nil
+}
+
+// The address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop listening and drop all connections
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.isAlive {
+		return
+	}
+	s.isAlive = false
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) alive() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.isAlive
+}
+
+func (s *Server) acceptLoop(listener stdnet.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if !s.isAlive {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// Responses may be written from several goroutines
+type serverConn struct {
+	lock   sync.Mutex
+	writer *bufio.Writer
+}
+
+func (sc *serverConn) reply(f *frame) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if err := writeFrame(sc.writer, f); err != nil {
+		// Tell the client why rather than leaving it waiting
+		writeFrame(sc.writer, &frame{Type: f.Type, Id: f.Id, Error: err.Error()})
+	}
+	sc.writer.Flush()
+}
+
+// Handle requests on the connection until it's closed. Produce
+// requests are handled in order, so the records of a pipelined
+// writer keep their order; fetches may wait, so each gets its
+// own goroutine.
+func (s *Server) serve(conn stdnet.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	sc := &serverConn{writer: bufio.NewWriter(conn)}
+	for {
+		request, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		stream := s.stream(request.Stream)
+		if stream == nil {
+			sc.reply(&frame{Type: request.Type, Id: request.Id, Error: fmt.Sprintf("no stream named %q", request.Stream)})
+			continue
+		}
+		switch request.Type {
+		case opOpen:
+			sc.reply(&frame{Type: opOpen, Id: request.Id, RecordSize: stream.RecordSize})
+		case opProduce:
+			ack := s.produce(stream, request)
+			if timeout := s.semiSync(); timeout > 0 && ack.Error == "" {
+				// Acks may go out of order, but appends can't
+				go func(name string, ack *frame) {
+					s.awaitReplica(name, ack.Offset+stream.RecordSize, timeout)
+					sc.reply(ack)
+				}(request.Stream, ack)
+			} else {
+				sc.reply(ack)
+			}
+		case opFetch:
+			go func(request *frame) {
+				sc.reply(s.fetch(stream, request))
+			}(request)
+		default:
+			sc.reply(&frame{Type: request.Type, Id: request.Id, Error: fmt.Sprintf("unknown request type %d", request.Type)})
+		}
+	}
+}
+
+func (s *Server) stream(name string) *runnel.RawStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[name]
+}
+
+// Append the record unless the producer has already appended it
+func (s *Server) produce(stream *runnel.RawStream, request *frame) *frame {
+	ack := &frame{Type: opAck, Id: request.Id}
+	if len(request.Records) != 1 {
+		ack.Error = fmt.Sprintf("expected 1 record, got %d", len(request.Records))
+		return ack
+	}
+	s.lock.Lock()
+	key := producerKey{request.Stream, request.Producer}
+	state := s.producers[key]
+	if state == nil {
+		state = &producerState{}
+		s.producers[key] = state
+	}
+	s.lock.Unlock()
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if request.Seq <= state.Seq {
+		back := state.Seq - request.Seq
+		if back >= uint64(len(state.Offsets)) {
+			ack.Error = fmt.Sprintf("sequence number %d is too old", request.Seq)
+		} else {
+			ack.Offset = state.Offsets[uint64(len(state.Offsets))-1-back]
+		}
+		return ack
+	}
+	offset, err := stream.Append(request.Records[0].Data, request.Records[0].Envelope)
+	if err != nil {
+		ack.Error = err.Error()
+		return ack
+	}
+	state.Seq = request.Seq
+	state.Offsets = append(state.Offsets, offset)
+	if len(state.Offsets) > producerWindow {
+		state.Offsets = append([]uint64{}, state.Offsets[len(state.Offsets)-producerWindow:]...)
+	}
+	ack.Offset = offset
+	return ack
+}
+
+// Collect the records from the requested offset, waiting up to
+// the requested time for the first of them to be written
+func (s *Server) fetch(stream *runnel.RawStream, request *frame) *frame {
+	response := &frame{Type: opRecords, Id: request.Id, Offset: request.Offset}
+	if request.Producer != 0 {
+		// A follower only asks for records after the ones it has
+		s.lock.Lock()
+		key := producerKey{request.Stream, request.Producer}
+		if request.Offset > s.replicas[key] {
+			s.replicas[key] = request.Offset
+		}
+		s.lock.Unlock()
+	}
+	if request.Offset%stream.RecordSize != 0 {
+		response.Error = fmt.Sprintf("offset %d is not a multiple of the record size %d", request.Offset, stream.RecordSize)
+		return response
+	}
+	deadline := time.Now().Add(time.Duration(request.Wait))
+	for stream.LastMessage() <= request.Offset && time.Now().Before(deadline) && s.alive() {
+		time.Sleep(pollInterval)
+	}
+	count := request.Count
+	if count == 0 || count > maxFetchCount {
+		count = maxFetchCount
+	}
+	for n := uint32(0); n < count; n++ {
+		data, env, ok := stream.Read(response.Offset)
+		if !ok {
+			break
+		}
+		response.Records = append(response.Records, record{Offset: response.Offset, Envelope: env, Data: data})
+		response.Offset += stream.RecordSize
+	}
+	response.Last = stream.LastMessage()
+	return response
+}
+
+func (s *Server) semiSync() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.syncTimeout
+}
+
+// Wait until a follower of the stream has replicated up to the
+// given offset, the timeout passes or the server is closed
+func (s *Server) awaitReplica(stream string, offset uint64, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.lock.Lock()
+		replicated := !s.isAlive
+		for key, position := range s.replicas {
+			if key.Stream == stream && position >= offset {
+				replicated = true
+				break
+			}
+		}
+		s.lock.Unlock()
+		if replicated {
+			return
+		}
+		time.Sleep(pollInterval)
+	}
+}
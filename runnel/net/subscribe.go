@@ -0,0 +1,201 @@
+package net
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/asp2insp/runnel-go/runnel"
+)
+
+// Requests from websocket subscribers
+const (
+	// Start following a stream, replacing any subscription to it
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	// Commit the subscription's consumer as having processed
+	// everything up to and including the offset
+	wsAck = "ack"
+)
+
+// Events sent to websocket subscribers
+const (
+	wsSubscribed = "subscribed"
+	wsMessage    = "message"
+	wsError      = "error"
+)
+
+type wsRequest struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+	// Filter expression, e.g. authorType(2).property(user="42")
+	Filter string `json:"filter,omitempty"`
+	// Where to start. When missing, a subscription with a consumer
+	// resumes after its last ack, and others start at the end.
+	Offset *uint64 `json:"offset,omitempty"`
+	// Name under which acks are committed
+	Consumer string `json:"consumer,omitempty"`
+}
+
+type wsEvent struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream,omitempty"`
+	// Where a subscription starts
+	Offset  uint64       `json:"offset,omitempty"`
+	Message *jsonMessage `json:"message,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// A stream followed by a websocket subscriber
+type subscription struct {
+	stream   *runnel.RawStream
+	reader   *runnel.RawReader
+	filter   *runnel.RawFilter
+	consumer string
+	// Closed when the subscription stops forwarding
+	done chan struct{}
+}
+
+// Serve subscriptions over a websocket until the client goes away.
+// Clients send JSON requests and receive JSON events, one per
+// websocket message.
+func (g *Gateway) subscribe(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebsocket(w, r, g.AllowedOrigins)
+	if err != nil {
+		return
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-g.done:
+			ws.Close()
+		case <-finished:
+		}
+	}()
+	subs := make(map[string]*subscription)
+	defer func() {
+		for _, sub := range subs {
+			sub.close()
+		}
+		ws.Close()
+	}()
+	for {
+		data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request wsRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			sendEvent(ws, &wsEvent{Type: wsError, Error: err.Error()})
+			continue
+		}
+		stream := g.stream(request.Stream)
+		if stream == nil {
+			sendEvent(ws, &wsEvent{Type: wsError, Stream: request.Stream, Error: fmt.Sprintf("no stream named %q", request.Stream)})
+			continue
+		}
+		sub := subs[request.Stream]
+		switch request.Type {
+		case wsSubscribe:
+			next, start, err := newSubscription(stream, &request)
+			if err != nil {
+				sendEvent(ws, &wsEvent{Type: wsError, Stream: request.Stream, Error: err.Error()})
+				break
+			}
+			if sub != nil {
+				sub.close()
+			}
+			sendEvent(ws, &wsEvent{Type: wsSubscribed, Stream: request.Stream, Offset: start})
+			next.start(ws, request.Stream, start)
+			subs[request.Stream] = next
+		case wsUnsubscribe:
+			if sub != nil {
+				sub.close()
+				delete(subs, request.Stream)
+			}
+		case wsAck:
+			switch {
+			case sub == nil || sub.consumer == "":
+				sendEvent(ws, &wsEvent{Type: wsError, Stream: request.Stream, Error: "acks need a subscription with a consumer"})
+			case request.Offset == nil:
+				sendEvent(ws, &wsEvent{Type: wsError, Stream: request.Stream, Error: "ack without an offset"})
+			default:
+				stream.Commit(sub.consumer, *request.Offset+stream.RecordSize)
+			}
+		default:
+			sendEvent(ws, &wsEvent{Type: wsError, Stream: request.Stream, Error: fmt.Sprintf("unknown request type %q", request.Type)})
+		}
+	}
+}
+
+// Check the request and work out where the subscription starts
+func newSubscription(stream *runnel.RawStream, request *wsRequest) (*subscription, uint64, error) {
+	if !validConsumer(request.Consumer) {
+		return nil, 0, fmt.Errorf("consumer names may only use letters, digits, - and _")
+	}
+	sub := &subscription{stream: stream, consumer: request.Consumer, done: make(chan struct{})}
+	if request.Filter != "" {
+		filter, err := stream.Filter(request.Filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		sub.filter = filter
+	}
+	start := stream.LastMessage()
+	if request.Offset != nil {
+		start = *request.Offset
+	} else if committed, ok := stream.Committed(request.Consumer); ok && request.Consumer != "" {
+		start = committed
+	}
+	if start%stream.RecordSize != 0 {
+		return nil, 0, fmt.Errorf("offset %d is not a multiple of the record size %d", start, stream.RecordSize)
+	}
+	return sub, start, nil
+}
+
+func (sub *subscription) start(ws *websocket, name string, offset uint64) {
+	sub.reader = sub.stream.Reader(offset)
+	go sub.forward(ws, name)
+}
+
+// Send the messages which pass the filter until closed
+func (sub *subscription) forward(ws *websocket, name string) {
+	defer close(sub.done)
+	for {
+		message, ok := sub.reader.ReadMessage()
+		if !ok {
+			return
+		}
+		if sub.filter != nil && !sub.filter.Matches(message) {
+			continue
+		}
+		event := &wsEvent{Type: wsMessage, Stream: name}
+		event.Message, _ = toJSON(sub.stream, message)
+		if sendEvent(ws, event) != nil {
+			return
+		}
+	}
+}
+
+// Stop forwarding and wait for the last send to finish, so that
+// no messages from the subscription follow its replacement's
+func (sub *subscription) close() {
+	sub.reader.Close()
+	<-sub.done
+}
+
+func sendEvent(ws *websocket, event *wsEvent) error {
+	data, _ := json.Marshal(event)
+	return ws.WriteMessage(data)
+}
+
+// Consumer names end up in file names
+func validConsumer(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
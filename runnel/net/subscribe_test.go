@@ -0,0 +1,178 @@
+package net
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestSubscribeWithFilter(t *testing.T) {
+	stream := openStream()
+	stream.DeclareProperty("parity", func(n *int) string {
+		return strconv.Itoa(*n % 2)
+	})
+	gateway, server := serveStream(stream)
+	defer teardownGateway(stream, gateway, server)
+	writeAuthored(stream, 0, 20)
+
+	ws := dialSubscribe(server, t)
+	defer ws.Close()
+	request(ws, `{"type": "subscribe", "stream": "ints", "offset": 0, "filter": "authorType(1).property(parity=\"0\")"}`, t)
+	testutils.CheckString(wsSubscribed, nextEvent(ws, t).Type, t)
+	// Multiples of 3 which are even, so multiples of 6
+	for _, n := range []int{0, 6, 12, 18} {
+		checkMessage(n, nextEvent(ws, t), t)
+	}
+	// Followed live
+	writeAuthored(stream, 20, 30)
+	checkMessage(24, nextEvent(ws, t), t)
+
+	request(ws, `{"type": "subscribe", "stream": "ints", "filter": "property(size=\"big\")"}`, t)
+	event := nextEvent(ws, t)
+	testutils.CheckString(wsError, event.Type, t)
+	testutils.ExpectTrue(strings.Contains(event.Error, "not been declared"), "Expected an undeclared property error", t)
+}
+
+func TestSubscribeResumesFromAck(t *testing.T) {
+	stream := openStream()
+	gateway, server := serveStream(stream)
+	defer teardownGateway(stream, gateway, server)
+	writeAuthored(stream, 0, 10)
+
+	ws := dialSubscribe(server, t)
+	request(ws, `{"type": "subscribe", "stream": "ints", "offset": 0, "consumer": "dash"}`, t)
+	nextEvent(ws, t)
+	for n := 0; n < 4; n++ {
+		checkMessage(n, nextEvent(ws, t), t)
+	}
+	request(ws, `{"type": "ack", "stream": "ints", "offset": 24}`, t)
+	request(ws, `{"type": "unsubscribe", "stream": "ints"}`, t)
+	ws.Close()
+
+	ws = dialSubscribe(server, t)
+	defer ws.Close()
+	request(ws, `{"type": "subscribe", "stream": "ints", "consumer": "dash"}`, t)
+	event := nextEvent(ws, t)
+	testutils.CheckString(wsSubscribed, event.Type, t)
+	testutils.CheckUint64(4*8, event.Offset, t)
+	checkMessage(4, nextEvent(ws, t), t)
+
+	// Acks need a consumer
+	request(ws, `{"type": "subscribe", "stream": "ints", "offset": 0}`, t)
+	for event = nextEvent(ws, t); event.Type != wsSubscribed; event = nextEvent(ws, t) {
+	}
+	request(ws, `{"type": "ack", "stream": "ints", "offset": 0}`, t)
+	for event = nextEvent(ws, t); event.Type == wsMessage; event = nextEvent(ws, t) {
+	}
+	testutils.CheckString(wsError, event.Type, t)
+}
+
+func TestSubscribeChecksUpgrades(t *testing.T) {
+	stream, gateway, server := setupGateway(t)
+	defer teardownGateway(stream, gateway, server)
+
+	testutils.CheckInt(http.StatusSwitchingProtocols, upgrade(server, "13", "", t), t)
+	testutils.CheckInt(http.StatusUpgradeRequired, upgrade(server, "8", "", t), t)
+	// A page on another site can't subscribe as its user
+	testutils.CheckInt(http.StatusForbidden, upgrade(server, "13", "http://evil.example", t), t)
+	testutils.CheckInt(http.StatusSwitchingProtocols, upgrade(server, "13", server.URL, t), t)
+	gateway.AllowedOrigins = []string{"http://dashboard.example"}
+	testutils.CheckInt(http.StatusSwitchingProtocols, upgrade(server, "13", "http://dashboard.example", t), t)
+	testutils.CheckInt(http.StatusForbidden, upgrade(server, "13", "http://evil.example", t), t)
+}
+
+func TestSubscribeRefusesUnmaskedFrames(t *testing.T) {
+	stream, gateway, server := setupGateway(t)
+	defer teardownGateway(stream, gateway, server)
+
+	ws := dialSubscribe(server, t)
+	defer ws.conn.Close()
+	// A final text frame holding "hi", without a mask
+	ws.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	_, opcode, payload, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckInt(wsClose, int(opcode), t)
+	testutils.CheckInt(wsProtocolError, int(binary.BigEndian.Uint16(payload)), t)
+}
+
+// Ask to upgrade to a websocket, returning the response status
+func upgrade(server *httptest.Server, version, origin string, t *testing.T) int {
+	r, _ := http.NewRequest("GET", server.URL+"/subscribe", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", version)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func serveStream(stream *runnel.IntStream) (*Gateway, *httptest.Server) {
+	gateway := NewGateway()
+	gateway.Expose("ints", stream.Raw())
+	return gateway, httptest.NewServer(gateway)
+}
+
+func dialSubscribe(server *httptest.Server, t *testing.T) *websocket {
+	ws, err := dialWebsocket("ws://" + strings.TrimPrefix(server.URL, "http://") + "/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func request(ws *websocket, request string, t *testing.T) {
+	if err := ws.WriteMessage([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextEvent(ws *websocket, t *testing.T) *wsEvent {
+	data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &wsEvent{}
+	if err := json.Unmarshal(data, event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func checkMessage(expected int, event *wsEvent, t *testing.T) {
+	testutils.CheckString(wsMessage, event.Type, t)
+	var value int
+	json.Unmarshal(event.Message.Data, &value)
+	testutils.CheckInt(expected, value, t)
+	testutils.CheckUint64(uint64(expected*8), event.Message.Offset, t)
+}
+
+// Messages which are multiples of 3 have author type 1
+func writeAuthored(stream *runnel.IntStream, from, to int) {
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := from; n < to; n++ {
+		v := n
+		env := i.Envelope{}
+		if n%3 == 0 {
+			env.AuthorType = 1
+		}
+		writer.WriteMessage(&v, env)
+	}
+}
@@ -0,0 +1,282 @@
+package net
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Just enough of RFC 6455 to exchange text messages with browsers
+
+// Appended to the client's key to prove the server speaks websockets
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest message either side will accept
+const maxWebsocketMessage = 1 << 20
+
+// Frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Status sent when closing on a frame which breaks the protocol
+const wsProtocolError = 1002
+
+var errWebsocketClosed = errors.New("websocket closed")
+
+type websocket struct {
+	conn   stdnet.Conn
+	reader *bufio.Reader
+	// Guards writes, which may come from several goroutines
+	lock   sync.Mutex
+	writer *bufio.Writer
+	// Clients mask the frames they send, servers don't
+	isClient bool
+}
+
+// Take over the connection of an upgrade request. Browsers send
+// the cookies of the page's origin with an upgrade, so requests
+// from pages on other origins are refused unless allowed, lest
+// any site can subscribe as the page's user.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (*websocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	if !originAllowed(r, allowedOrigins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %q not allowed", r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets unsupported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocket{conn: conn, reader: rw.Reader, writer: rw.Writer}, nil
+}
+
+// Connect to a websocket endpoint, e.g. ws://host:port/subscribe
+func dialWebsocket(url string) (*websocket, error) {
+	if !strings.HasPrefix(url, "ws://") {
+		return nil, fmt.Errorf("unsupported websocket url %q", url)
+	}
+	hostPath := strings.TrimPrefix(url, "ws://")
+	host, path := hostPath, "/"
+	if slash := strings.IndexByte(hostPath, '/'); slash >= 0 {
+		host, path = hostPath[:slash], hostPath[slash:]
+	}
+	conn, err := stdnet.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade refused: %s", response.Status)
+	}
+	return &websocket{conn: conn, reader: reader, writer: bufio.NewWriter(conn), isClient: true}, nil
+}
+
+// Whether a request may be upgraded given its origin. Requests without
+// one don't come from browsers, and a page may always connect to its
+// own host. Otherwise the origin has to be allowed, or "*" given.
+func originAllowed(r *http.Request, allowedOrigins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Whether the comma separated header has the given token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read the next text or binary message, answering pings along the way
+func (ws *websocket) ReadMessage() ([]byte, error) {
+	var message []byte
+	for {
+		final, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			return nil, errWebsocketClosed
+		}
+		message = append(message, payload...)
+		if len(message) > maxWebsocketMessage {
+			return nil, errors.New("websocket message too large")
+		}
+		if final {
+			return message, nil
+		}
+	}
+}
+
+func (ws *websocket) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	final := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	// Clients have to mask their frames, and servers mustn't
+	if masked == ws.isClient {
+		ws.fail(wsProtocolError)
+		return false, 0, nil, errors.New("websocket frame masked incorrectly")
+	}
+	if length > maxWebsocketMessage {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for n := range payload {
+			payload[n] ^= mask[n%4]
+		}
+	}
+	return final, opcode, payload, nil
+}
+
+// Send a text message
+func (ws *websocket) WriteMessage(data []byte) error {
+	return ws.writeFrame(wsText, data)
+}
+
+func (ws *websocket) writeFrame(opcode byte, payload []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	head := []byte{0x80 | opcode, 0}
+	length := len(payload)
+	switch {
+	case length < 126:
+		head[1] = byte(length)
+	case length <= 0xffff:
+		head[1] = 126
+		head = append(head, 0, 0)
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+	default:
+		head[1] = 127
+		head = append(head, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+	}
+	if ws.isClient {
+		var mask [4]byte
+		rand.Read(mask[:])
+		head[1] |= 0x80
+		head = append(head, mask[:]...)
+		masked := make([]byte, length)
+		for n := range payload {
+			masked[n] = payload[n] ^ mask[n%4]
+		}
+		payload = masked
+	}
+	ws.writer.Write(head)
+	ws.writer.Write(payload)
+	return ws.writer.Flush()
+}
+
+// Close the connection with the given status
+func (ws *websocket) fail(status uint16) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], status)
+	ws.writeFrame(wsClose, payload[:])
+	ws.conn.Close()
+}
+
+func (ws *websocket) Close() error {
+	ws.writeFrame(wsClose, nil)
+	return ws.conn.Close()
+}
@@ -0,0 +1,64 @@
+package runnel
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/asp2insp/runnel-go/runnel/s"
+)
+
+// Partition n of a partitioned stream is stored as <id>_p<n>
+const partitionSuffix = "_p"
+
+// The number of partitions a stream was created with is kept
+// in <id>_partitions, as keys would move if it changed
+const partitionCountSuffix = "_partitions"
+
+func partitionId(id string, n int) string {
+	return id + partitionSuffix + strconv.Itoa(n)
+}
+
+// The partition of the given number of partitions a key belongs to.
+// The same key always goes to the same partition, so messages with
+// a key stay in order as long as the number of partitions is fixed.
+// Returns -1 if there are no partitions.
+func PartitionForKey(key string, partitions int) int {
+	if partitions <= 0 {
+		return -1
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// Check the number of partitions against the one the stream was
+// created with in the given root, recording it if the stream is new
+func checkPartitionCount(id, root string, partitions int) error {
+	if partitions <= 0 {
+		return fmt.Errorf("partitioned stream %s needs at least one partition, not %d", id, partitions)
+	}
+	storage := s.NewFileStorage(root).Init(id + partitionCountSuffix)
+	defer storage.Close()
+	// Held so that streams created at once agree on a count
+	if err := storage.Lock(true, true); err != nil {
+		return err
+	}
+	data, _ := readBlob(storage)
+	if data == nil {
+		_, err := writeBlob(storage, []byte(strconv.Itoa(partitions)))
+		return err
+	}
+	count, err := strconv.Atoi(string(data))
+	if err != nil {
+		return fmt.Errorf("partitioned stream %s has a corrupt partition count: %v", id, err)
+	}
+	if count != partitions {
+		return fmt.Errorf("partitioned stream %s has %d partitions, not %d", id, count, partitions)
+	}
+	return nil
+}
+
+// For each partition of a partitioned stream, the
+// offset to read from next in that partition
+type PartitionOffsets []uint64
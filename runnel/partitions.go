@@ -0,0 +1,246 @@
+package runnel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+	"github.com/asp2insp/runnel-go/runnel/s"
+)
+
+// Picks which of the given number of partitions a message goes to
+type TypedPartitioner func(data *Typed, env i.Envelope, partitions int) int
+
+// Route messages by the hash of a key, so that messages
+// with the same key go to the same partition in order
+func TypedHashPartitioner(key TypedPropertyFunc) TypedPartitioner {
+	return func(data *Typed, env i.Envelope, partitions int) int {
+		return PartitionForKey(key(data), partitions)
+	}
+}
+
+// Spread messages evenly over the partitions, one after the other
+func TypedRoundRobinPartitioner() TypedPartitioner {
+	var next uint64
+	return func(data *Typed, env i.Envelope, partitions int) int {
+		if partitions <= 0 {
+			return -1
+		}
+		return int((atomic.AddUint64(&next, 1) - 1) % uint64(partitions))
+	}
+}
+
+// A stream split over several underlying streams, so that writes
+// to different partitions don't contend for a single tail. Order
+// is only kept within a partition.
+type TypedPartitionedStream struct {
+	Name        string
+	Id          string
+	Partitions  []*TypedStream
+	partitioner TypedPartitioner
+}
+
+// Open a stream of the given number of partitions, stored in the given
+// root as <id>_p0, <id>_p1, ... An empty root stores them in the default
+// location, as for NewTypedStream. The number of partitions must stay the
+// same each time the stream is opened for keys to keep to their partitions,
+// so opening it with a different number fails.
+func NewTypedPartitionedStream(name, id, root string, partitions int, partitioner TypedPartitioner) (*TypedPartitionedStream, error) {
+	if err := checkPartitionCount(id, root, partitions); err != nil {
+		return nil, err
+	}
+	ret := &TypedPartitionedStream{
+		Name:        name,
+		Id:          id,
+		Partitions:  make([]*TypedStream, partitions),
+		partitioner: partitioner,
+	}
+	for n := range ret.Partitions {
+		store := s.NewFileStorage(root).Init(partitionId(id, n))
+		ret.Partitions[n] = NewTypedStream(name, partitionId(id, n), store)
+	}
+	return ret, nil
+}
+
+// Total number of messages across every partition
+func (p *TypedPartitionedStream) Size() uint64 {
+	var size uint64
+	for _, partition := range p.Partitions {
+		size += partition.Size()
+	}
+	return size
+}
+
+// Read a single partition from the given offset within it
+func (p *TypedPartitionedStream) PartitionReader(partition int, base uint64) *TypedStreamReader {
+	return p.Partitions[partition].Reader(base)
+}
+
+func (p *TypedPartitionedStream) Close() {
+	for _, partition := range p.Partitions {
+		partition.Close()
+	}
+}
+
+// =================== WRITERS ==================
+
+// Writes each message to the partition picked by the stream's partitioner
+type TypedPartitionedWriter struct {
+	parent  *TypedPartitionedStream
+	writers []*TypedStreamWriter
+}
+
+func (p *TypedPartitionedStream) Writer() *TypedPartitionedWriter {
+	ret := &TypedPartitionedWriter{
+		parent:  p,
+		writers: make([]*TypedStreamWriter, len(p.Partitions)),
+	}
+	for n, partition := range p.Partitions {
+		ret.writers[n] = partition.Writer()
+	}
+	return ret
+}
+
+// Stamp messages written without an author with this one
+func (writer *TypedPartitionedWriter) SetAuthor(author uint64, authorType uint32) {
+	for _, w := range writer.writers {
+		w.SetAuthor(author, authorType)
+	}
+}
+
+func (writer *TypedPartitionedWriter) Write(data *Typed) error {
+	return writer.WriteMessage(data, i.Envelope{})
+}
+
+// Fails without writing the message if the partitioner
+// picks a partition the stream doesn't have
+func (writer *TypedPartitionedWriter) WriteMessage(data *Typed, env i.Envelope) error {
+	partition := writer.parent.partitioner(data, env, len(writer.writers))
+	if partition < 0 || partition >= len(writer.writers) {
+		return fmt.Errorf("partitioner picked partition %d of stream %s, which has %d", partition, writer.parent.Id, len(writer.writers))
+	}
+	return writer.writers[partition].WriteMessage(data, env)
+}
+
+func (writer *TypedPartitionedWriter) Close() {
+	for _, w := range writer.writers {
+		w.Close()
+	}
+}
+
+// =================== MERGED READERS ==================
+
+// A message read from one of the partitions of a partitioned stream
+type TypedPartitionedMessage struct {
+	Partition int
+	// Offset within the partition
+	Offset   uint64
+	Envelope i.Envelope
+	Data     Typed
+}
+
+// Reads every partition of a partitioned stream at once. Messages
+// of a partition come in order, but those of different partitions
+// are interleaved as they're read.
+type TypedMergedReader struct {
+	outChannel chan TypedPartitionedMessage
+	// Closed when the reader is closed
+	done    chan struct{}
+	readers []*TypedStreamReader
+	parent  *TypedPartitionedStream
+	// Guards everything below
+	lock    sync.Mutex
+	offsets PartitionOffsets
+	isAlive bool
+}
+
+// Build a reader of every partition, starting each at its offset.
+// Nil offsets start every partition from the beginning.
+func (p *TypedPartitionedStream) MergedReader(offsets PartitionOffsets) *TypedMergedReader {
+	ret := &TypedMergedReader{
+		outChannel: make(chan TypedPartitionedMessage),
+		done:       make(chan struct{}),
+		readers:    make([]*TypedStreamReader, len(p.Partitions)),
+		parent:     p,
+		offsets:    make(PartitionOffsets, len(p.Partitions)),
+		isAlive:    true,
+	}
+	copy(ret.offsets, offsets)
+	var forwarding sync.WaitGroup
+	for n, partition := range p.Partitions {
+		ret.readers[n] = partition.Reader(ret.offsets[n])
+		forwarding.Add(1)
+		go ret.forward(n, &forwarding)
+	}
+	go func() {
+		forwarding.Wait()
+		close(ret.outChannel)
+	}()
+	return ret
+}
+
+// Pass on the messages of a partition's reader
+func (reader *TypedMergedReader) forward(partition int, forwarding *sync.WaitGroup) {
+	defer forwarding.Done()
+	for {
+		message, ok := reader.readers[partition].ReadMessage()
+		if !ok {
+			return
+		}
+		select {
+		case reader.outChannel <- TypedPartitionedMessage{
+			Partition: partition,
+			Offset:    message.Offset,
+			Envelope:  message.Envelope,
+			Data:      message.Data,
+		}:
+		case <-reader.done:
+			return
+		}
+	}
+}
+
+// Read a single value from any partition (in a blocking fashion)
+func (reader *TypedMergedReader) Read() Typed {
+	message, _ := reader.ReadMessage()
+	return message.Data
+}
+
+// Read a single message from any partition (in a blocking fashion).
+// Returns false once the reader has been closed.
+func (reader *TypedMergedReader) ReadMessage() (TypedPartitionedMessage, bool) {
+	select {
+	case message, ok := <-reader.outChannel:
+		if !ok {
+			return message, false
+		}
+		reader.lock.Lock()
+		reader.offsets[message.Partition] = message.Offset + reader.parent.Partitions[message.Partition].typeSize
+		reader.lock.Unlock()
+		return message, true
+	case <-reader.done:
+		return TypedPartitionedMessage{}, false
+	}
+}
+
+// The offset to resume each partition from to carry on after the
+// messages read so far, e.g. to pass to MergedReader after a restart
+func (reader *TypedMergedReader) Offsets() PartitionOffsets {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+	return append(PartitionOffsets{}, reader.offsets...)
+}
+
+func (reader *TypedMergedReader) Close() {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+	if !reader.isAlive {
+		return
+	}
+	reader.isAlive = false
+	close(reader.done)
+	for _, r := range reader.readers {
+		r.Close()
+	}
+}
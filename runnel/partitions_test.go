@@ -0,0 +1,172 @@
+package runnel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestHashPartitioner(t *testing.T) {
+	cleanupFiles()
+	key := func(n *int) string { return strconv.Itoa(*n % 10) }
+	stream := mustPartition("partitioned", "id", 4, IntHashPartitioner(key), t)
+	defer stream.Close()
+	writer := stream.Writer()
+	for n := 0; n < 100; n++ {
+		v := n
+		writer.Write(&v)
+	}
+	writer.Close()
+	testutils.CheckUint64(100, stream.Size(), t)
+
+	// Each key goes to a single partition, in order
+	for p, partition := range stream.Partitions {
+		reader := stream.PartitionReader(p, 0)
+		last := make(map[string]int)
+		for m := uint64(0); m < partition.Size(); m++ {
+			v := reader.Read()
+			k := key(&v)
+			testutils.CheckInt(p, PartitionForKey(k, 4), t)
+			if previous, ok := last[k]; ok {
+				testutils.ExpectTrue(v > previous, "Expected messages of a key in order", t)
+			}
+			last[k] = v
+		}
+		reader.Close()
+	}
+}
+
+func TestRoundRobinPartitioner(t *testing.T) {
+	cleanupFiles()
+	stream := mustPartition("partitioned", "id", 3, IntRoundRobinPartitioner(), t)
+	defer stream.Close()
+	writer := stream.Writer()
+	for n := 0; n < 9; n++ {
+		v := n
+		writer.Write(&v)
+	}
+	writer.Close()
+	for p, partition := range stream.Partitions {
+		testutils.CheckUint64(3, partition.Size(), t)
+		reader := stream.PartitionReader(p, 0)
+		testutils.CheckInt(p, reader.Read(), t)
+		reader.Close()
+	}
+}
+
+func TestMergedReader(t *testing.T) {
+	cleanupFiles()
+	stream := mustPartition("partitioned", "id", 3, IntRoundRobinPartitioner(), t)
+	defer stream.Close()
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := 0; n < 30; n++ {
+		v := n
+		writer.Write(&v)
+	}
+
+	reader := stream.MergedReader(nil)
+	seen := make(map[int]bool)
+	for n := 0; n < 30; n++ {
+		message, ok := reader.ReadMessage()
+		testutils.ExpectTrue(ok, "Expected a message", t)
+		testutils.CheckInt(message.Data%3, message.Partition, t)
+		testutils.CheckUint64(uint64(message.Data/3*8), message.Offset, t)
+		seen[message.Data] = true
+	}
+	testutils.CheckInt(30, len(seen), t)
+	offsets := reader.Offsets()
+	reader.Close()
+	for _, offset := range offsets {
+		testutils.CheckUint64(10*8, offset, t)
+	}
+
+	// Resumes after the messages already read
+	for n := 30; n < 33; n++ {
+		v := n
+		writer.Write(&v)
+	}
+	reader = stream.MergedReader(offsets)
+	defer reader.Close()
+	sum := 0
+	for n := 0; n < 3; n++ {
+		sum += reader.Read()
+	}
+	testutils.CheckInt(30+31+32, sum, t)
+}
+
+func TestPartitionCount(t *testing.T) {
+	cleanupFiles()
+	_, err := NewIntPartitionedStream("partitioned", "id", "", 0, IntRoundRobinPartitioner())
+	testutils.ExpectTrue(err != nil, "Expected a stream without partitions to fail", t)
+	testutils.CheckInt(-1, PartitionForKey("key", 0), t)
+
+	stream := mustPartition("partitioned", "id", 3, IntRoundRobinPartitioner(), t)
+	stream.Close()
+	_, err = NewIntPartitionedStream("partitioned", "id", "", 4, IntRoundRobinPartitioner())
+	testutils.ExpectTrue(err != nil, "Expected a different number of partitions to fail", t)
+	stream = mustPartition("partitioned", "id", 3, IntRoundRobinPartitioner(), t)
+	stream.Close()
+}
+
+func TestPartitionedStreamRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "partitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	stream, err := NewIntPartitionedStream("partitioned", "rooted", root, 2, IntRoundRobinPartitioner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := stream.Writer()
+	for n := 0; n < 4; n++ {
+		writer.Write(&n)
+	}
+	writer.Close()
+	stream.Close()
+
+	// The partitions and their count live in the root
+	for _, name := range []string{"rooted" + partitionCountSuffix, partitionId("rooted", 0), partitionId("rooted", 1)} {
+		_, err := os.Stat(filepath.Join(root, name))
+		testutils.ExpectTrue(err == nil, "Expected "+name+" in the root", t)
+		_, err = os.Stat(filepath.Join(os.TempDir(), name))
+		testutils.ExpectTrue(os.IsNotExist(err), "Expected no "+name+" in the default location", t)
+	}
+	_, err = NewIntPartitionedStream("partitioned", "rooted", root, 3, IntRoundRobinPartitioner())
+	testutils.ExpectTrue(err != nil, "Expected the count in the root to be checked", t)
+	stream, err = NewIntPartitionedStream("partitioned", "rooted", root, 2, IntRoundRobinPartitioner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	testutils.CheckUint64(4, stream.Size(), t)
+}
+
+func TestBadPartitioner(t *testing.T) {
+	cleanupFiles()
+	partitioner := func(data *int, env i.Envelope, partitions int) int { return *data }
+	stream := mustPartition("partitioned", "id", 2, partitioner, t)
+	defer stream.Close()
+	writer := stream.Writer()
+	for n := 0; n < 3; n++ {
+		v := n
+		err := writer.Write(&v)
+		testutils.ExpectTrue((err == nil) == (n < 2), "Expected only partitions in range to be written", t)
+	}
+	writer.Close()
+	testutils.CheckUint64(2, stream.Size(), t)
+}
+
+func mustPartition(name, id string, partitions int, partitioner IntPartitioner, t *testing.T) *IntPartitionedStream {
+	stream, err := NewIntPartitionedStream(name, id, "", partitions, partitioner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
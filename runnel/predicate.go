@@ -0,0 +1,418 @@
+package runnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Filter operations
+const (
+	OpFrom       = "from"
+	OpUntil      = "until"
+	OpBefore     = "before"
+	OpAfter      = "after"
+	OpAround     = "around"
+	OpProperty   = "property"
+	OpAuthorType = "authorType"
+	OpSample     = "sample"
+	OpDedup      = "dedup"
+)
+
+// A Predicate is a single step of a filter. Predicates are plain
+// data so that composed filters can be inspected and compared.
+type Predicate struct {
+	Op string
+	// Stream offset for from and until
+	Offset uint64
+	// Unix nanoseconds for before, after and around
+	Time int64
+	// Nanoseconds either side of Time for around
+	Window int64
+	// Property name for property, sample and dedup
+	Name string
+	// Property value for property
+	Value string
+	// Class of author for authorType
+	AuthorType uint32
+	// Fraction of messages kept by sample. When Name is set the
+	// sample is of the values of that property rather than of
+	// the messages.
+	Rate float64
+	// Nanoseconds and number of keys a dedup remembers,
+	// 0 for no bound
+	Horizon int64
+	Limit   uint64
+}
+
+func (p Predicate) String() string {
+	switch p.Op {
+	case OpFrom, OpUntil:
+		return fmt.Sprintf("%s(%d)", p.Op, p.Offset)
+	case OpBefore, OpAfter:
+		return fmt.Sprintf("%s(%s)", p.Op, time.Unix(0, p.Time).UTC().Format(time.RFC3339Nano))
+	case OpAround:
+		return fmt.Sprintf("%s(%s, %s)", p.Op, time.Unix(0, p.Time).UTC().Format(time.RFC3339Nano), time.Duration(p.Window))
+	case OpProperty:
+		return fmt.Sprintf("%s(%s=%q)", p.Op, p.Name, p.Value)
+	case OpAuthorType:
+		return fmt.Sprintf("%s(%d)", p.Op, p.AuthorType)
+	case OpSample:
+		if p.Name != "" {
+			return fmt.Sprintf("%s(%s, %g)", p.Op, p.Name, p.Rate)
+		}
+		return fmt.Sprintf("%s(%g)", p.Op, p.Rate)
+	case OpDedup:
+		args := p.Name
+		if p.Horizon > 0 {
+			args += ", " + time.Duration(p.Horizon).String()
+		}
+		if p.Limit > 0 {
+			args += fmt.Sprintf(", %d", p.Limit)
+		}
+		return fmt.Sprintf("%s(%s)", p.Op, args)
+	}
+	return fmt.Sprintf("%s(?)", p.Op)
+}
+
+// Whether the predicate needs a declared property to be evaluated
+func (p Predicate) usesProperty() bool {
+	return p.Op == OpProperty || ((p.Op == OpDedup || p.Op == OpSample) && p.Name != "")
+}
+
+// A message as seen by a predicate
+type candidate struct {
+	offset   uint64
+	envelope i.Envelope
+	data     []byte
+	property func(name string) string
+	// Set when replaying a message which already passed,
+	// so that persisted state isn't updated twice
+	replay bool
+	// Updates to persisted state made by evaluating the candidate,
+	// held back until its outcome is recorded
+	updates []func()
+}
+
+// Apply the updates to persisted state held back while evaluating the
+// candidate. Views call this once the candidate is in their index, so
+// that if they stop in between they evaluate it again rather than find
+// it has already been seen.
+func (c *candidate) commit() {
+	for _, update := range c.updates {
+		update()
+	}
+	c.updates = nil
+}
+
+// Evaluates a candidate. Matchers may be stateful (e.g. dedup),
+// so each message should only be evaluated once.
+type matcher func(*candidate) bool
+
+// Combine the predicates into a single matcher which
+// accepts only candidates accepted by every predicate.
+// Predicates which persist their state open it with state,
+// passing a suffix unique to the predicate, and fail to
+// compile if state is nil.
+func compilePredicates(predicates []Predicate, state func(suffix string) i.Storage) (matcher, error) {
+	matchers := make([]matcher, len(predicates))
+	for n, p := range predicates {
+		var open func() i.Storage
+		if state != nil {
+			suffix := fmt.Sprintf("%s%d", dedupSuffix, n)
+			open = func() i.Storage { return state(suffix) }
+		}
+		m, err := p.compile(open)
+		if err != nil {
+			return nil, err
+		}
+		matchers[n] = m
+	}
+	return func(c *candidate) bool {
+		for _, m := range matchers {
+			if !m(c) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Compile the predicate. State opens the storage for predicates
+// which persist their state, and may be nil for those which don't.
+func (p Predicate) compile(state func() i.Storage) (matcher, error) {
+	switch p.Op {
+	case OpFrom:
+		return func(c *candidate) bool { return c.offset >= p.Offset }, nil
+	case OpUntil:
+		return func(c *candidate) bool { return c.offset < p.Offset }, nil
+	case OpBefore:
+		return func(c *candidate) bool { return c.envelope.Timestamp < p.Time }, nil
+	case OpAfter:
+		return func(c *candidate) bool { return c.envelope.Timestamp > p.Time }, nil
+	case OpAround:
+		return func(c *candidate) bool {
+			return c.envelope.Timestamp >= p.Time-p.Window && c.envelope.Timestamp <= p.Time+p.Window
+		}, nil
+	case OpProperty:
+		return func(c *candidate) bool { return c.property(p.Name) == p.Value }, nil
+	case OpAuthorType:
+		return func(c *candidate) bool { return c.envelope.AuthorType == p.AuthorType }, nil
+	case OpSample:
+		if p.Name != "" {
+			return func(c *candidate) bool { return sampledKey(c.property(p.Name), p.Rate) }, nil
+		}
+		return func(c *candidate) bool { return sampled(c.offset, p.Rate) }, nil
+	case OpDedup:
+		if p.Horizon > 0 || p.Limit > 0 {
+			if state == nil {
+				return nil, fmt.Errorf("%s needs somewhere to keep its state", p)
+			}
+			set := openSeenSet(state(), p.Horizon, p.Limit)
+			return func(c *candidate) bool {
+				if c.replay {
+					return true
+				}
+				key, t := p.dedupKey(c), c.envelope.Timestamp
+				if set.seen(key, t) {
+					return false
+				}
+				c.updates = append(c.updates, func() { set.add(key, t) })
+				return true
+			}, nil
+		}
+		// Unbounded, so kept exactly in memory and rebuilt
+		// by replaying the messages which passed
+		seen := make(map[string]bool)
+		return func(c *candidate) bool {
+			key := p.dedupKey(c)
+			if seen[key] {
+				return false
+			}
+			seen[key] = true
+			return true
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown filter %q", p.Op)
+}
+
+func (p Predicate) dedupKey(c *candidate) string {
+	if p.Name != "" {
+		return c.property(p.Name)
+	}
+	return string(c.data)
+}
+
+// Deterministically decide whether the message at the given
+// offset is part of a sample of the given rate
+func sampled(offset uint64, rate float64) bool {
+	return float64(offsetPriority(offset)) < rate*math.MaxUint64
+}
+
+// Deterministically decide whether a key is part of a sample of the
+// given rate, so that every message with the key is kept or dropped
+func sampledKey(key string, rate float64) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
+
+// A pseudo-random but stable rank for the message at an offset
+func offsetPriority(offset uint64) uint64 {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], offset)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// A stable key identifying a list of predicates, used to name
+// the index backing a filtered view
+func predicatesKey(predicates []Predicate) string {
+	h := fnv.New64a()
+	h.Write([]byte(FormatPredicates(predicates)))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Returned when a filter is composed of predicates
+// which can never all match the same message
+type ContradictionError struct {
+	First  Predicate
+	Second Predicate
+	Reason string
+}
+
+func (e *ContradictionError) Error() string {
+	return fmt.Sprintf("contradictory filters %s and %s: %s", e.First, e.Second, e.Reason)
+}
+
+// Check the predicates for contradictions and simplify away
+// the redundant ones. Returns the simplified predicates along
+// with a warning for each one that was changed.
+func simplifyPredicates(predicates []Predicate) ([]Predicate, []string, error) {
+	if err := checkContradictions(predicates); err != nil {
+		return nil, nil, err
+	}
+	// Dedup is stateful, so predicates can't be moved across it
+	var simplified []Predicate
+	var warnings []string
+	start := 0
+	for n, p := range predicates {
+		if p.Op == OpDedup {
+			segment, segmentWarnings := simplifySegment(predicates[start:n])
+			simplified = append(simplified, segment...)
+			warnings = append(warnings, segmentWarnings...)
+			simplified = append(simplified, p)
+			start = n + 1
+		}
+	}
+	segment, segmentWarnings := simplifySegment(predicates[start:])
+	simplified = append(simplified, segment...)
+	warnings = append(warnings, segmentWarnings...)
+	return simplified, warnings, nil
+}
+
+// Merge stateless predicates which constrain the same thing.
+// The merged predicate takes the place of the first one.
+func simplifySegment(predicates []Predicate) ([]Predicate, []string) {
+	var out []Predicate
+	var warnings []string
+	first := make(map[string]int)
+	for _, p := range predicates {
+		key := p.Op
+		switch p.Op {
+		case OpProperty, OpAround:
+			key = p.String()
+		case OpSample:
+			// Samples of different keys are independent
+			key = p.Op + "(" + p.Name
+		}
+		n, ok := first[key]
+		if !ok {
+			first[key] = len(out)
+			out = append(out, p)
+			continue
+		}
+		prev := out[n]
+		merged := prev
+		switch p.Op {
+		case OpFrom:
+			merged.Offset = maxUint64(prev.Offset, p.Offset)
+		case OpUntil:
+			merged.Offset = minUint64(prev.Offset, p.Offset)
+		case OpBefore:
+			merged.Time = minInt64(prev.Time, p.Time)
+		case OpAfter:
+			merged.Time = maxInt64(prev.Time, p.Time)
+		case OpSample:
+			if p.Name != "" {
+				// Keyed samples of the same key keep the same keys
+				merged.Rate = math.Min(prev.Rate, p.Rate)
+			} else {
+				merged.Rate = prev.Rate * p.Rate
+			}
+		}
+		out[n] = merged
+		if p.Op == OpSample {
+			warnings = append(warnings, fmt.Sprintf("%s and %s combined into %s", prev, p, merged))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("%s and %s are redundant, kept %s", prev, p, merged))
+		}
+	}
+	for _, p := range out {
+		if p.Op == OpSample && p.Rate <= 0 {
+			warnings = append(warnings, fmt.Sprintf("%s never matches", p))
+		}
+	}
+	return out, warnings
+}
+
+// Find a pair of predicates which can never both match
+func checkContradictions(predicates []Predicate) error {
+	var from, until, lower, upper *Predicate
+	// Inclusive bounds on the timestamp, in nanoseconds
+	var lo, hi int64 = math.MinInt64, math.MaxInt64
+	properties := make(map[string]*Predicate)
+	var authorType *Predicate
+	for n := range predicates {
+		p := &predicates[n]
+		switch p.Op {
+		case OpFrom:
+			if from == nil || p.Offset > from.Offset {
+				from = p
+			}
+		case OpUntil:
+			if until == nil || p.Offset < until.Offset {
+				until = p
+			}
+		case OpBefore, OpAfter, OpAround:
+			plo, phi := timeBounds(p)
+			if plo > lo {
+				lo, lower = plo, p
+			}
+			if phi < hi {
+				hi, upper = phi, p
+			}
+		case OpProperty:
+			if prev, ok := properties[p.Name]; ok && prev.Value != p.Value {
+				return &ContradictionError{*prev, *p, fmt.Sprintf("property %s can't equal both %q and %q", p.Name, prev.Value, p.Value)}
+			}
+			properties[p.Name] = p
+		case OpAuthorType:
+			if authorType != nil && authorType.AuthorType != p.AuthorType {
+				return &ContradictionError{*authorType, *p, "a message has only one author type"}
+			}
+			authorType = p
+		}
+	}
+	if from != nil && until != nil && until.Offset <= from.Offset {
+		return &ContradictionError{*from, *until, "until is not after from"}
+	}
+	if lower != nil && upper != nil && lo > hi {
+		return &ContradictionError{*lower, *upper, "the time ranges don't overlap"}
+	}
+	return nil
+}
+
+// The inclusive range of timestamps matched by a time predicate
+func timeBounds(p *Predicate) (int64, int64) {
+	switch p.Op {
+	case OpBefore:
+		return math.MinInt64, p.Time - 1
+	case OpAfter:
+		return p.Time + 1, math.MaxInt64
+	}
+	return p.Time - p.Window, p.Time + p.Window
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,604 @@
+package runnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// A replicated stream keeps its raft state in side files: the term
+// of each entry in <id>_terms, and the current term and vote in <id>_raft
+const (
+	raftTermsSuffix = "_terms"
+	raftStateSuffix = "_raft"
+)
+
+// In a replicated stream, the stream's records are the raft log. Tail
+// marks the end of the log and LastMessage the end of the committed
+// part of it, so readers only ever see committed records. Entries are
+// numbered from 0, and a log of n entries holds entries 0 to n-1.
+
+type RaftRole int
+
+const (
+	RaftFollower RaftRole = iota
+	RaftCandidate
+	RaftLeader
+)
+
+func (role RaftRole) String() string {
+	switch role {
+	case RaftFollower:
+		return "follower"
+	case RaftCandidate:
+		return "candidate"
+	case RaftLeader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// Carries requests between the nodes of a replicated stream. The
+// receiving node's HandleVote or HandleAppend answers each one.
+type RaftTransport interface {
+	RequestVote(peer string, request *VoteRequest) (*VoteReply, error)
+	AppendEntries(peer string, request *AppendRequest) (*AppendReply, error)
+}
+
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	// Length of the candidate's log and the term of its last entry
+	LogLength uint64
+	LastTerm  uint64
+}
+
+type VoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type RaftEntry struct {
+	Term     uint64
+	Envelope i.Envelope
+	Data     []byte
+}
+
+type AppendRequest struct {
+	Term   uint64
+	Leader string
+	// The entries follow the first PrevLength entries of the
+	// leader's log, the last of which has PrevTerm
+	PrevLength uint64
+	PrevTerm   uint64
+	Entries    []RaftEntry
+	// Length of the leader's committed log
+	Committed uint64
+}
+
+type AppendReply struct {
+	Term    uint64
+	Success bool
+	// Length of the follower's log matching the leader's
+	// on success, and of its whole log otherwise
+	LogLength uint64
+}
+
+type RaftConfig struct {
+	// How often a leader sends entries or heartbeats to its followers
+	Heartbeat time.Duration
+	// How long a follower waits to hear from a leader before standing
+	// for election. Each node waits a random time between this and twice this.
+	ElectionTimeout time.Duration
+	// How long an append waits to be committed
+	CommitTimeout time.Duration
+	// The most entries sent in one request
+	MaxBatch int
+}
+
+var DefaultRaftConfig = RaftConfig{
+	Heartbeat:       50 * time.Millisecond,
+	ElectionTimeout: 500 * time.Millisecond,
+	CommitTimeout:   5 * time.Second,
+	MaxBatch:        256,
+}
+
+// Returned by appends to a node which isn't the leader
+type NotLeaderError struct {
+	// The node believed to be the leader, if any
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not the leader, and no leader is known"
+	}
+	return fmt.Sprintf("not the leader, try %s", e.Leader)
+}
+
+// The persisted part of a node's state besides its log
+type raftState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// One of the nodes of a replicated stream. Appends go through the
+// leader, which commits them once a majority of the nodes have
+// persisted them.
+type RaftNode struct {
+	Id        string
+	peers     []string
+	stream    *RawStream
+	terms     i.Storage
+	state     i.Storage
+	transport RaftTransport
+	config    RaftConfig
+	// Guards everything below
+	lock        sync.Mutex
+	role        RaftRole
+	term        uint64
+	votedFor    string
+	leader      string
+	lastContact time.Time
+	timeout     time.Duration
+	// For each peer, the length of log to send from next, and
+	// the length known to match the leader's. Only kept by leaders.
+	nextLength  map[string]uint64
+	matchLength map[string]uint64
+	// Peers with a request in flight, so that slow peers
+	// don't pile up requests
+	sending map[string]bool
+	isAlive bool
+	done    chan struct{}
+}
+
+// Start a node of a replicated stream. The stream mustn't be written
+// to other than through the node, but can be read as usual. Fails if
+// the node's persisted term and vote can't be read, as starting over
+// from nothing could have it vote twice in a term.
+func NewRaftNode(id string, peers []string, stream *RawStream, transport RaftTransport, config RaftConfig) (*RaftNode, error) {
+	node := &RaftNode{
+		Id:          id,
+		peers:       peers,
+		stream:      stream,
+		terms:       stream.storage.Sibling(raftTermsSuffix),
+		state:       stream.storage.Sibling(raftStateSuffix),
+		transport:   transport,
+		config:      config,
+		lastContact: time.Now(),
+		sending:     make(map[string]bool),
+		isAlive:     true,
+		done:        make(chan struct{}),
+	}
+	var state raftState
+	if data, _ := readBlob(node.state); data != nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			node.terms.Close()
+			node.state.Close()
+			return nil, fmt.Errorf("raft state of %s is corrupt: %v", stream.Id, err)
+		}
+		node.term, node.votedFor = state.Term, state.VotedFor
+	}
+	node.resetTimeout()
+	go node.tickLoop()
+	return node, nil
+}
+
+// The node's role and term, and the leader it knows of
+func (node *RaftNode) Status() (RaftRole, uint64, string) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.role, node.term, node.leader
+}
+
+// Append a record to the replicated stream, waiting until it's
+// committed. Only the leader takes appends; other nodes return a
+// *NotLeaderError. A zero timestamp is replaced with the current time.
+func (node *RaftNode) Append(data []byte, env i.Envelope) (uint64, error) {
+	if uint64(len(data)) != node.stream.RecordSize {
+		return 0, fmt.Errorf("record is %d bytes, stream %s holds %d byte records", len(data), node.stream.Id, node.stream.RecordSize)
+	}
+	if env.Timestamp == 0 {
+		env.Timestamp = time.Now().UnixNano()
+	}
+	node.lock.Lock()
+	if node.role != RaftLeader {
+		node.lock.Unlock()
+		return 0, &NotLeaderError{Leader: node.leader}
+	}
+	term := node.term
+	index := node.length()
+	node.write(index, RaftEntry{Term: term, Envelope: env, Data: data})
+	node.advanceCommit()
+	node.lock.Unlock()
+	node.replicate()
+
+	// Committed once the entry is in the committed log with the
+	// term it was written with, as a new leader could replace it
+	deadline := time.Now().Add(node.config.CommitTimeout)
+	for time.Now().Before(deadline) {
+		node.lock.Lock()
+		committed := node.committed() > index
+		replaced := index >= node.length() || node.entryTerm(index) != term
+		node.lock.Unlock()
+		if replaced {
+			return 0, fmt.Errorf("entry %d was replaced by a new leader", index)
+		}
+		if committed {
+			return index * node.stream.RecordSize, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return 0, fmt.Errorf("entry %d wasn't committed within %s", index, node.config.CommitTimeout)
+}
+
+// Stop taking part in the replicated stream
+func (node *RaftNode) Close() {
+	node.lock.Lock()
+	if !node.isAlive {
+		node.lock.Unlock()
+		return
+	}
+	node.isAlive = false
+	node.lock.Unlock()
+	<-node.done
+	node.terms.Close()
+	node.state.Close()
+}
+
+func (node *RaftNode) tickLoop() {
+	defer close(node.done)
+	for {
+		time.Sleep(node.config.Heartbeat / 2)
+		node.lock.Lock()
+		if !node.isAlive {
+			node.lock.Unlock()
+			return
+		}
+		role := node.role
+		electionDue := role != RaftLeader && time.Since(node.lastContact) > node.timeout
+		node.lock.Unlock()
+		if role == RaftLeader {
+			node.replicate()
+		} else if electionDue {
+			node.stand()
+		}
+	}
+}
+
+// =================== ELECTIONS ==================
+
+// Stand for election in a new term
+func (node *RaftNode) stand() {
+	node.lock.Lock()
+	node.role = RaftCandidate
+	node.term++
+	node.votedFor = node.Id
+	node.leader = ""
+	node.lastContact = time.Now()
+	node.resetTimeout()
+	if node.saveState() != nil {
+		// Try again at the next timeout rather than ask for
+		// votes in a term we might not remember
+		node.lock.Unlock()
+		return
+	}
+	request := &VoteRequest{
+		Term:      node.term,
+		Candidate: node.Id,
+		LogLength: node.length(),
+		LastTerm:  node.lastTerm(),
+	}
+	node.lock.Unlock()
+
+	// Peers which don't answer in time are counted as votes against,
+	// so that a hung transport can't hold up the next election
+	votes := 1
+	deadline := time.After(node.config.ElectionTimeout)
+	replies := make(chan *VoteReply, len(node.peers))
+	for _, peer := range node.peers {
+		go func(peer string) {
+			reply, err := node.transport.RequestVote(peer, request)
+			if err != nil {
+				reply = nil
+			}
+			replies <- reply
+		}(peer)
+	}
+	for range node.peers {
+		var reply *VoteReply
+		select {
+		case reply = <-replies:
+		case <-deadline:
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		node.lock.Lock()
+		if reply.Term > node.term {
+			node.stepDown(reply.Term)
+		}
+		stillStanding := node.role == RaftCandidate && node.term == request.Term
+		node.lock.Unlock()
+		if !stillStanding {
+			return
+		}
+		if reply.Granted {
+			votes++
+		}
+		if node.isMajority(votes) {
+			node.lead(request.Term)
+			return
+		}
+	}
+	if node.isMajority(votes) {
+		node.lead(request.Term)
+	}
+}
+
+// Take the lead in the given term, unless the node has moved on
+func (node *RaftNode) lead(term uint64) {
+	node.lock.Lock()
+	if node.role != RaftCandidate || node.term != term {
+		node.lock.Unlock()
+		return
+	}
+	node.role = RaftLeader
+	node.leader = node.Id
+	node.nextLength = make(map[string]uint64)
+	node.matchLength = make(map[string]uint64)
+	for _, peer := range node.peers {
+		node.nextLength[peer] = node.length()
+	}
+	node.lock.Unlock()
+	node.replicate()
+}
+
+// Answer a request for a vote
+func (node *RaftNode) HandleVote(request *VoteRequest) *VoteReply {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if request.Term > node.term {
+		node.stepDown(request.Term)
+	}
+	reply := &VoteReply{Term: node.term}
+	if request.Term < node.term || (node.votedFor != "" && node.votedFor != request.Candidate) {
+		return reply
+	}
+	// Only vote for candidates whose logs are at least as up to date
+	lastTerm := node.lastTerm()
+	if request.LastTerm < lastTerm || (request.LastTerm == lastTerm && request.LogLength < node.length()) {
+		return reply
+	}
+	node.votedFor = request.Candidate
+	if node.saveState() != nil {
+		// A vote which isn't persisted could be given twice
+		node.votedFor = ""
+		return reply
+	}
+	node.lastContact = time.Now()
+	reply.Granted = true
+	return reply
+}
+
+// Must be called with the lock held
+func (node *RaftNode) stepDown(term uint64) {
+	if term > node.term {
+		node.term = term
+		node.votedFor = ""
+		node.saveState()
+	}
+	node.role = RaftFollower
+}
+
+func (node *RaftNode) isMajority(votes int) bool {
+	return votes > (len(node.peers)+1)/2
+}
+
+// Must be called with the lock held
+func (node *RaftNode) resetTimeout() {
+	node.timeout = node.config.ElectionTimeout + time.Duration(rand.Int63n(int64(node.config.ElectionTimeout)))
+}
+
+// Persist the term and vote before acting on them.
+// Must be called with the lock held.
+func (node *RaftNode) saveState() error {
+	data, _ := json.Marshal(raftState{Term: node.term, VotedFor: node.votedFor})
+	if _, err := writeBlob(node.state, data); err != nil {
+		return err
+	}
+	node.state.Flush()
+	return nil
+}
+
+// =================== REPLICATION ==================
+
+// Send each peer the entries it's missing, or a heartbeat
+func (node *RaftNode) replicate() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.role != RaftLeader {
+		return
+	}
+	for _, peer := range node.peers {
+		if node.sending[peer] {
+			continue
+		}
+		next := node.nextLength[peer]
+		request := &AppendRequest{
+			Term:       node.term,
+			Leader:     node.Id,
+			PrevLength: next,
+			Committed:  node.committed(),
+		}
+		if next > 0 {
+			request.PrevTerm = node.entryTerm(next - 1)
+		}
+		for n := next; n < node.length() && len(request.Entries) < node.config.MaxBatch; n++ {
+			request.Entries = append(request.Entries, node.entry(n))
+		}
+		node.sending[peer] = true
+		go node.send(peer, request)
+	}
+}
+
+func (node *RaftNode) send(peer string, request *AppendRequest) {
+	reply, err := node.transport.AppendEntries(peer, request)
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.sending[peer] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > node.term {
+		node.stepDown(reply.Term)
+		return
+	}
+	if node.role != RaftLeader || node.term != request.Term {
+		return
+	}
+	if reply.Success {
+		match := request.PrevLength + uint64(len(request.Entries))
+		if match > node.matchLength[peer] {
+			node.matchLength[peer] = match
+		}
+		node.nextLength[peer] = match
+		node.advanceCommit()
+	} else {
+		// Back up to where the logs might match
+		if request.PrevLength > 0 {
+			node.nextLength[peer] = minUint64(request.PrevLength-1, reply.LogLength)
+		}
+	}
+}
+
+// Commit the longest log a majority has, as long as it ends in an
+// entry from the current term. Must be called with the lock held.
+func (node *RaftNode) advanceCommit() {
+	lengths := make(offsetList, 0, len(node.peers)+1)
+	lengths = append(lengths, node.length())
+	for _, peer := range node.peers {
+		lengths = append(lengths, node.matchLength[peer])
+	}
+	sort.Sort(lengths)
+	// The majority have at least the length a minority of
+	// the nodes are below
+	majority := lengths[len(lengths)-(len(lengths)/2+1)]
+	if majority > node.committed() && node.entryTerm(majority-1) == node.term {
+		node.commit(majority)
+	}
+}
+
+// Answer a request to append entries
+func (node *RaftNode) HandleAppend(request *AppendRequest) *AppendReply {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if request.Term > node.term || (request.Term == node.term && node.role == RaftCandidate) {
+		node.stepDown(request.Term)
+	}
+	reply := &AppendReply{Term: node.term, LogLength: node.length()}
+	if request.Term < node.term {
+		return reply
+	}
+	node.leader = request.Leader
+	node.lastContact = time.Now()
+	if request.PrevLength > node.length() ||
+		(request.PrevLength > 0 && node.entryTerm(request.PrevLength-1) != request.PrevTerm) {
+		return reply
+	}
+	for n, entry := range request.Entries {
+		index := request.PrevLength + uint64(n)
+		if index < node.length() {
+			if node.entryTerm(index) == entry.Term {
+				continue
+			}
+			// Conflicts with the leader, so this and everything
+			// after it was never committed
+			node.truncate(index)
+		}
+		node.write(index, entry)
+	}
+	match := request.PrevLength + uint64(len(request.Entries))
+	if commit := minUint64(request.Committed, match); commit > node.committed() {
+		node.commit(commit)
+	}
+	reply.Success = true
+	reply.LogLength = match
+	return reply
+}
+
+// =================== LOG ==================
+
+// The following must be called with the node's lock held
+
+func (node *RaftNode) length() uint64 {
+	return atomic.LoadUint64(&node.stream.storage.Header().Tail) / node.stream.RecordSize
+}
+
+func (node *RaftNode) committed() uint64 {
+	return node.stream.LastMessage() / node.stream.RecordSize
+}
+
+func (node *RaftNode) entryTerm(index uint64) uint64 {
+	return readOffset(node.terms, index)
+}
+
+func (node *RaftNode) lastTerm() uint64 {
+	if length := node.length(); length > 0 {
+		return node.entryTerm(length - 1)
+	}
+	return 0
+}
+
+func (node *RaftNode) entry(index uint64) RaftEntry {
+	raw := node.stream
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	offset := index * raw.RecordSize
+	return RaftEntry{
+		Term:     node.entryTerm(index),
+		Envelope: readEnvelope(raw.envelopes, index),
+		Data:     append([]byte{}, raw.storage.GetBytes(offset, offset+raw.RecordSize)...),
+	}
+}
+
+// Write the entry at the given index, which must be at
+// most the length of the log, and persist it
+func (node *RaftNode) write(index uint64, entry RaftEntry) {
+	raw := node.stream
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	writeOffset(node.terms, index, entry.Term)
+	writeEnvelope(raw.envelopes, index, &entry.Envelope)
+	// Written past LastMessage, so not yet visible to readers
+	storage := raw.storage
+	offset := index * raw.RecordSize
+	atomic.StoreUint64(&storage.Header().Tail, offset+raw.RecordSize)
+	for storage.Utilization() > 75 {
+		storage.Resize(2 * storage.Capacity())
+	}
+	copy(storage.GetBytes(offset, offset+raw.RecordSize), entry.Data)
+	storage.Flush()
+	raw.envelopes.Flush()
+	node.terms.Flush()
+}
+
+// Drop the entries from the given index on
+func (node *RaftNode) truncate(index uint64) {
+	atomic.StoreUint64(&node.stream.storage.Header().Tail, index*node.stream.RecordSize)
+}
+
+// Make the first length entries visible to readers
+func (node *RaftNode) commit(length uint64) {
+	header := node.stream.storage.Header()
+	atomic.StoreUint64(&header.EntryCount, length)
+	atomic.StoreUint64(&header.LastMessage, length*node.stream.RecordSize)
+	node.stream.storage.Flush()
+}
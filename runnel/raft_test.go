@@ -0,0 +1,352 @@
+package runnel
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+var testRaftConfig = RaftConfig{
+	Heartbeat:       10 * time.Millisecond,
+	ElectionTimeout: 50 * time.Millisecond,
+	CommitTimeout:   time.Second,
+	MaxBatch:        16,
+}
+
+func TestRaftCommit(t *testing.T) {
+	cluster := newRaftCluster(3, t)
+	defer cluster.close()
+	leader := cluster.awaitLeader(t)
+
+	for n := 0; n < 50; n++ {
+		offset, err := leader.Append(intRecord(n), i.Envelope{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.CheckUint64(uint64(n*8), offset, t)
+	}
+	// Every node ends up with the same records
+	for _, stream := range cluster.streams {
+		waitFor(func() bool { return stream.Size() == 50 }, t)
+		reader := stream.Reader(0)
+		for n := 0; n < 50; n++ {
+			testutils.CheckInt(n, reader.Read(), t)
+		}
+		reader.Close()
+	}
+
+	// Other nodes point at the leader
+	for _, node := range cluster.nodes {
+		if node == leader {
+			continue
+		}
+		_, err := node.Append(intRecord(0), i.Envelope{})
+		notLeader, ok := err.(*NotLeaderError)
+		testutils.ExpectTrue(ok, "Expected a not leader error", t)
+		testutils.CheckString(leader.Id, notLeader.Leader, t)
+	}
+}
+
+func TestRaftUncommittedInvisible(t *testing.T) {
+	cluster := newRaftCluster(3, t)
+	defer cluster.close()
+	leader := cluster.awaitLeader(t)
+	leader.Append(intRecord(1), i.Envelope{})
+
+	// Cut off from the others, the leader can't commit
+	cluster.network.isolate(leader.Id)
+	_, err := leader.Append(intRecord(2), i.Envelope{})
+	testutils.ExpectTrue(err != nil, "Expected the append not to commit", t)
+	stream := cluster.stream(leader.Id)
+	testutils.CheckUint64(1, stream.Size(), t)
+	testutils.CheckUint64(8, cluster.raws[cluster.index(leader.Id)].LastMessage(), t)
+
+	// The others elect a new leader, whose records replace
+	// the old leader's uncommitted one once it rejoins
+	next := cluster.awaitLeader(t, leader.Id)
+	if _, err := next.Append(intRecord(3), i.Envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	cluster.network.heal()
+	waitFor(func() bool { return stream.Size() == 2 }, t)
+	reader := stream.Reader(0)
+	defer reader.Close()
+	testutils.CheckInt(1, reader.Read(), t)
+	testutils.CheckInt(3, reader.Read(), t)
+	role, _, _ := leader.Status()
+	testutils.ExpectTrue(role == RaftFollower, "Expected the old leader to step down", t)
+}
+
+func TestRaftRestart(t *testing.T) {
+	cluster := newRaftCluster(3, t)
+	defer cluster.close()
+	leader := cluster.awaitLeader(t)
+	for n := 0; n < 10; n++ {
+		leader.Append(intRecord(n), i.Envelope{})
+	}
+	_, term, _ := leader.Status()
+
+	// A restarted node keeps its term and log
+	cluster.restart(leader.Id)
+	node := cluster.node(leader.Id)
+	_, restartedTerm, _ := node.Status()
+	testutils.ExpectTrue(restartedTerm >= term, "Expected the term to persist", t)
+	testutils.CheckUint64(10, cluster.stream(leader.Id).Size(), t)
+
+	next := cluster.awaitLeader(t)
+	if _, err := next.Append(intRecord(10), i.Envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { return cluster.stream(leader.Id).Size() == 11 }, t)
+}
+
+func TestRaftCorruptState(t *testing.T) {
+	cleanupRaftFiles()
+	defer cleanupRaftFiles()
+	stream := NewIntStream("raft_a", "raft_a", nil)
+	defer stream.Close()
+	raw := stream.Raw()
+	defer raw.Close()
+	state := raw.storage.Sibling(raftStateSuffix)
+	writeBlob(state, []byte("{\"Term\": 3, \"Vot"))
+	state.Close()
+
+	_, err := NewRaftNode("raft_a", []string{"raft_b"}, raw, &hungTransport{}, testRaftConfig)
+	testutils.ExpectTrue(err != nil, "Expected corrupt state to fail the node", t)
+}
+
+func TestRaftHungPeers(t *testing.T) {
+	cleanupRaftFiles()
+	defer cleanupRaftFiles()
+	stream := NewIntStream("raft_a", "raft_a", nil)
+	defer stream.Close()
+	raw := stream.Raw()
+	defer raw.Close()
+	transport := &hungTransport{release: make(chan struct{})}
+	defer close(transport.release)
+	node, err := NewRaftNode("raft_a", []string{"raft_b", "raft_c"}, raw, transport, testRaftConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	// The node keeps standing for election rather than
+	// waiting on peers which never answer
+	waitFor(func() bool {
+		_, term, _ := node.Status()
+		return term > 2
+	}, t)
+}
+
+// =================== SIMULATED NETWORK ==================
+
+var errUnreachable = errors.New("unreachable")
+
+// Delivers requests between nodes in the same process, dropping
+// those to or from isolated nodes
+type simulatedNetwork struct {
+	lock     sync.Mutex
+	nodes    map[string]*RaftNode
+	isolated map[string]bool
+}
+
+type simulatedTransport struct {
+	from    string
+	network *simulatedNetwork
+}
+
+func (network *simulatedNetwork) route(from, to string) (*RaftNode, error) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	node := network.nodes[to]
+	if node == nil || network.isolated[from] || network.isolated[to] {
+		return nil, errUnreachable
+	}
+	return node, nil
+}
+
+func (network *simulatedNetwork) isolate(id string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.isolated[id] = true
+}
+
+func (network *simulatedNetwork) heal() {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.isolated = make(map[string]bool)
+}
+
+func (transport *simulatedTransport) RequestVote(peer string, request *VoteRequest) (*VoteReply, error) {
+	node, err := transport.network.route(transport.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleVote(request), nil
+}
+
+func (transport *simulatedTransport) AppendEntries(peer string, request *AppendRequest) (*AppendReply, error) {
+	node, err := transport.network.route(transport.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppend(request), nil
+}
+
+// Holds every request until released
+type hungTransport struct {
+	release chan struct{}
+}
+
+func (transport *hungTransport) RequestVote(peer string, request *VoteRequest) (*VoteReply, error) {
+	<-transport.release
+	return nil, errUnreachable
+}
+
+func (transport *hungTransport) AppendEntries(peer string, request *AppendRequest) (*AppendReply, error) {
+	<-transport.release
+	return nil, errUnreachable
+}
+
+type raftCluster struct {
+	ids     []string
+	network *simulatedNetwork
+	nodes   []*RaftNode
+	streams []*IntStream
+	raws    []*RawStream
+}
+
+func newRaftCluster(size int, t *testing.T) *raftCluster {
+	cleanupRaftFiles()
+	cluster := &raftCluster{
+		network: &simulatedNetwork{nodes: make(map[string]*RaftNode), isolated: make(map[string]bool)},
+	}
+	for n := 0; n < size; n++ {
+		cluster.ids = append(cluster.ids, "raft_"+string(rune('a'+n)))
+	}
+	for n := range cluster.ids {
+		cluster.streams = append(cluster.streams, nil)
+		cluster.raws = append(cluster.raws, nil)
+		cluster.nodes = append(cluster.nodes, nil)
+		cluster.start(n)
+	}
+	return cluster
+}
+
+func (cluster *raftCluster) start(n int) {
+	id := cluster.ids[n]
+	var peers []string
+	for _, peer := range cluster.ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	cluster.streams[n] = NewIntStream(id, id, nil)
+	cluster.raws[n] = cluster.streams[n].Raw()
+	transport := &simulatedTransport{from: id, network: cluster.network}
+	node, err := NewRaftNode(id, peers, cluster.raws[n], transport, testRaftConfig)
+	if err != nil {
+		panic(err)
+	}
+	cluster.nodes[n] = node
+	cluster.network.lock.Lock()
+	cluster.network.nodes[id] = cluster.nodes[n]
+	cluster.network.lock.Unlock()
+}
+
+func (cluster *raftCluster) stop(n int) {
+	cluster.network.lock.Lock()
+	delete(cluster.network.nodes, cluster.ids[n])
+	cluster.network.lock.Unlock()
+	cluster.nodes[n].Close()
+	cluster.raws[n].Close()
+	cluster.streams[n].Close()
+}
+
+func (cluster *raftCluster) restart(id string) {
+	n := cluster.index(id)
+	cluster.stop(n)
+	cluster.start(n)
+}
+
+func (cluster *raftCluster) index(id string) int {
+	for n, candidate := range cluster.ids {
+		if candidate == id {
+			return n
+		}
+	}
+	return -1
+}
+
+func (cluster *raftCluster) node(id string) *RaftNode {
+	return cluster.nodes[cluster.index(id)]
+}
+
+func (cluster *raftCluster) stream(id string) *IntStream {
+	return cluster.streams[cluster.index(id)]
+}
+
+// Wait for a single leader among the nodes other than those excluded
+func (cluster *raftCluster) awaitLeader(t *testing.T, excluded ...string) *RaftNode {
+	var leader *RaftNode
+	waitFor(func() bool {
+		leader = nil
+		for _, node := range cluster.nodes {
+			if role, _, _ := node.Status(); role != RaftLeader || contains(excluded, node.Id) {
+				continue
+			}
+			if leader != nil {
+				return false
+			}
+			leader = node
+		}
+		return leader != nil
+	}, t)
+	return leader
+}
+
+func (cluster *raftCluster) close() {
+	for n := range cluster.nodes {
+		cluster.stop(n)
+	}
+	cleanupRaftFiles()
+}
+
+func contains(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+func intRecord(n int) []byte {
+	record := make([]byte, 8)
+	for b := range record {
+		record[b] = byte(uint64(n) >> uint(8*b))
+	}
+	return record
+}
+
+// Wait for the condition to hold, failing after a few seconds
+func waitFor(condition func() bool, t *testing.T) {
+	for start := time.Now(); !condition(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Timed out waiting for condition")
+		}
+	}
+}
+
+func cleanupRaftFiles() {
+	files, _ := filepath.Glob(filepath.Join(os.TempDir(), "raft_*"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
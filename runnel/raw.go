@@ -0,0 +1,307 @@
+package runnel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Consumers of a raw stream record the offset to
+// resume from in <id>_consumer_<name>
+const consumerSuffix = "_consumer_"
+
+// Untyped access to the records of a stream, for code which moves
+// messages around without knowing their type, such as servers
+type RawStream struct {
+	Id string
+	// Size of every record in the stream
+	RecordSize uint64
+	// The stream's codec
+	Codec     i.Codec
+	storage   i.Storage
+	envelopes i.Storage
+	// The stream's declared properties, as of when
+	// the raw stream was made
+	properties map[string]func([]byte) string
+	// How appends coordinate with the stream's other writers
+	mode    LockMode
+	slots   *slotPublisher
+	commits i.Storage
+	// The stream's handle, which shared appends claim slots for
+	handle uint64
+	// Serializes access through this handle, as an
+	// append may remap the storage
+	lock      sync.Mutex
+	consumers map[string]i.Storage
+	isAlive   bool
+}
+
+// A record along with its envelope and position in the stream
+type RawMessage struct {
+	Offset   uint64
+	Envelope i.Envelope
+	Data     []byte
+}
+
+func newRawStream(id string, recordSize uint64, storage, envelopes i.Storage, codec i.Codec, properties map[string]func([]byte) string, mode LockMode, slots *slotPublisher, handle uint64) *RawStream {
+	ret := &RawStream{
+		Id:         id,
+		RecordSize: recordSize,
+		Codec:      codec,
+		storage:    storage.Clone(),
+		envelopes:  envelopes.Clone(),
+		properties: properties,
+		mode:       mode,
+		slots:      slots,
+		handle:     handle,
+		consumers:  make(map[string]i.Storage),
+		isAlive:    true,
+	}
+	if mode == LockShared {
+		ret.commits = storage.Sibling(commitsSuffix)
+	}
+	return ret
+}
+
+// Append a record with the given envelope and return its offset.
+// As with a writer, a zero timestamp is replaced with the current
+// time, and appends to a stream opened read-only fail.
+func (raw *RawStream) Append(data []byte, env i.Envelope) (uint64, error) {
+	if raw.mode == LockReadOnly {
+		return 0, fmt.Errorf("stream %s was opened read-only", raw.Id)
+	}
+	if uint64(len(data)) != raw.RecordSize {
+		return 0, fmt.Errorf("record is %d bytes, stream %s holds %d byte records", len(data), raw.Id, raw.RecordSize)
+	}
+	if env.Timestamp == 0 {
+		env.Timestamp = time.Now().UnixNano()
+	}
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if !raw.isAlive {
+		return 0, fmt.Errorf("stream %s is closed", raw.Id)
+	}
+	// Written through the same slots as the stream's writers, so
+	// that appends never share a slot with their writes
+	offset, err := raw.slots.write(raw.storage, raw.envelopes, raw.commits, raw.handle, raw.RecordSize, &env, func(slot []byte) {
+		copy(slot, data)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("appending to stream %s: %v", raw.Id, err)
+	}
+	return offset, nil
+}
+
+// Write a record copied from another stream at the same offset,
+// keeping its envelope as is. The record must be the next one.
+func (raw *RawStream) Replicate(message RawMessage) error {
+	if uint64(len(message.Data)) != raw.RecordSize {
+		return fmt.Errorf("record is %d bytes, stream %s holds %d byte records", len(message.Data), raw.Id, raw.RecordSize)
+	}
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if !raw.isAlive {
+		return fmt.Errorf("stream %s is closed", raw.Id)
+	}
+	header := raw.storage.Header()
+	if message.Offset != header.Tail {
+		return fmt.Errorf("record at %d doesn't follow the end of stream %s at %d", message.Offset, raw.Id, header.Tail)
+	}
+	writeEnvelope(raw.envelopes, message.Offset/raw.RecordSize, &message.Envelope)
+	writeAt(raw.storage, message.Offset, message.Data)
+	atomic.AddUint64(&header.EntryCount, 1)
+	raw.storage.Flush()
+	return nil
+}
+
+// A copy of the record at the given offset along with its
+// envelope. Returns false if there is no record there yet.
+func (raw *RawStream) Read(offset uint64) ([]byte, i.Envelope, bool) {
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if !raw.isAlive || offset%raw.RecordSize != 0 || offset+raw.RecordSize > raw.LastMessage() {
+		return nil, i.Envelope{}, false
+	}
+	data := append([]byte{}, raw.storage.GetBytes(offset, offset+raw.RecordSize)...)
+	return data, readEnvelope(raw.envelopes, offset/raw.RecordSize), true
+}
+
+// One past the end of the last record available to read
+func (raw *RawStream) LastMessage() uint64 {
+	return atomic.LoadUint64(&raw.storage.Header().LastMessage)
+}
+
+// A consistent copy of the stream's header
+func (raw *RawStream) Header() i.StreamHeader {
+	return snapshotHeader(raw.storage.Header())
+}
+
+// Record that the named consumer should resume reading at the
+// given offset, e.g. once it has processed everything before it
+func (raw *RawStream) Commit(consumer string, next uint64) {
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if !raw.isAlive {
+		return
+	}
+	header := raw.consumer(consumer).Header()
+	atomic.StoreUint64(&header.Source, next)
+	atomic.StoreUint64(&header.EntryCount, 1)
+}
+
+// The offset the named consumer last committed. Returns
+// false if it has never committed one.
+func (raw *RawStream) Committed(consumer string) (uint64, bool) {
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if !raw.isAlive {
+		return 0, false
+	}
+	header := raw.consumer(consumer).Header()
+	return atomic.LoadUint64(&header.Source), atomic.LoadUint64(&header.EntryCount) > 0
+}
+
+// Must be called with the lock held
+func (raw *RawStream) consumer(name string) i.Storage {
+	storage, ok := raw.consumers[name]
+	if !ok {
+		storage = raw.storage.Sibling(consumerSuffix + name)
+		raw.consumers[name] = storage
+	}
+	return storage
+}
+
+func (raw *RawStream) Close() {
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if !raw.isAlive {
+		return
+	}
+	raw.isAlive = false
+	raw.storage.Close()
+	raw.envelopes.Close()
+	if raw.commits != nil {
+		raw.commits.Close()
+	}
+	for _, storage := range raw.consumers {
+		storage.Close()
+	}
+}
+
+func (raw *RawStream) alive() bool {
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	return raw.isAlive
+}
+
+// =================== READERS ==================
+
+// Reads records in order from a given offset, waiting for
+// more when it reaches the end of the stream
+type RawReader struct {
+	// Out channel to allow blocking reads
+	outChannel chan RawMessage
+	// Closed when the reader is closed, to release
+	// a pending send on the out channel
+	done chan struct{}
+	// The stream that this reader will read from
+	parent *RawStream
+	// The offset of the next record to read
+	offset  uint64
+	isAlive bool
+}
+
+// Build a reader starting at the given offset
+func (raw *RawStream) Reader(base uint64) *RawReader {
+	ret := &RawReader{
+		outChannel: make(chan RawMessage),
+		done:       make(chan struct{}),
+		parent:     raw,
+		offset:     base,
+		isAlive:    true,
+	}
+	go ret.readLoop()
+	return ret
+}
+
+// Loop endlessly to read the data from the stream
+func (reader *RawReader) readLoop() {
+	defer close(reader.outChannel)
+	for reader.parent.alive() {
+		data, env, ok := reader.parent.Read(reader.offset)
+		if !ok {
+			select {
+			case <-time.After(pollInterval):
+				continue
+			case <-reader.done:
+				return
+			}
+		}
+		select {
+		case reader.outChannel <- RawMessage{Offset: reader.offset, Envelope: env, Data: data}:
+		case <-reader.done:
+			return
+		}
+		reader.offset += reader.parent.RecordSize
+	}
+}
+
+// Read a single message from the stream (in a blocking fashion).
+// Returns false once the reader or its stream has been closed.
+func (reader *RawReader) ReadMessage() (RawMessage, bool) {
+	message, ok := <-reader.outChannel
+	return message, ok
+}
+
+func (reader *RawReader) Close() {
+	if !reader.isAlive {
+		return
+	}
+	reader.isAlive = false
+	close(reader.done)
+}
+
+// =================== FILTERS ==================
+
+// A filter expression compiled for the messages of a raw stream
+type RawFilter struct {
+	Predicates []Predicate
+	parent     *RawStream
+	match      matcher
+}
+
+// Compile the filter expression. Properties must have been declared
+// on the stream before it was made raw. Filters which persist their
+// state, such as bounded dedups, aren't supported.
+func (raw *RawStream) Filter(expr string) (*RawFilter, error) {
+	predicates, err := ParsePredicates(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range predicates {
+		if p.usesProperty() && raw.properties[p.Name] == nil {
+			return nil, fmt.Errorf("%s: property %q has not been declared", p, p.Name)
+		}
+	}
+	match, err := compilePredicates(predicates, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &RawFilter{Predicates: predicates, parent: raw, match: match}, nil
+}
+
+// Whether the message passes the filter. Filters may be stateful
+// (e.g. dedup), so each message should only be checked once.
+func (f *RawFilter) Matches(message RawMessage) bool {
+	return f.match(&candidate{
+		offset:   message.Offset,
+		envelope: message.Envelope,
+		data:     message.Data,
+		property: func(name string) string {
+			return f.parent.properties[name](message.Data)
+		},
+	})
+}
@@ -0,0 +1,115 @@
+package runnel
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Envelopes are stored in a side file, one per message, at the
+// same index as the message they describe
+const envelopeSuffix = "_envelope"
+
+const envelopeSize = uint64(unsafe.Sizeof(i.Envelope{}))
+
+// Derived streams keep the source offset of each
+// of their messages in a side file
+const sourcesSuffix = "_sources"
+
+// Size of a single entry in an index of offsets
+const offsetSize = 8
+
+// Append the given bytes to the storage, growing it as needed.
+// Returns the offset the record was written at.
+func appendRecord(storage i.Storage, data []byte) uint64 {
+	offset := storage.Header().Tail
+	writeAt(storage, offset, data)
+	storage.Header().EntryCount += 1
+	return offset
+}
+
+// Write the given bytes at the given offset, growing the storage
+// as needed. Used for side files whose records are addressed by
+// position rather than appended.
+func writeAt(storage i.Storage, offset uint64, data []byte) {
+	end := offset + uint64(len(data))
+	header := storage.Header()
+	atomicMax(&header.Tail, end)
+	for storage.Utilization() > 75 {
+		storage.Resize(2 * storage.Capacity())
+	}
+	copy(storage.GetBytes(offset, end), data)
+	atomicMax(&header.LastMessage, end)
+}
+
+// Write the envelope for the message at the given index
+func writeEnvelope(storage i.Storage, index uint64, env *i.Envelope) {
+	data := (*[envelopeSize]byte)(unsafe.Pointer(env))[:]
+	writeAt(storage, index*envelopeSize, data)
+}
+
+// Read the envelope for the message at the given index. Messages
+// written without an envelope get the zero envelope.
+func readEnvelope(storage i.Storage, index uint64) i.Envelope {
+	start := index * envelopeSize
+	if start+envelopeSize > atomic.LoadUint64(&storage.Header().LastMessage) {
+		return i.Envelope{}
+	}
+	slice := storage.GetBytes(start, start+envelopeSize)
+	return *(*i.Envelope)(unsafe.Pointer(&slice[0]))
+}
+
+// Append an offset to an index of offsets
+func appendOffset(storage i.Storage, offset uint64) {
+	appendRecord(storage, (*[offsetSize]byte)(unsafe.Pointer(&offset))[:])
+}
+
+// Write an offset at the given position of an index
+func writeOffset(storage i.Storage, position, offset uint64) {
+	writeAt(storage, position*offsetSize, (*[offsetSize]byte)(unsafe.Pointer(&offset))[:])
+}
+
+// Read the offset stored at the given position of an index
+func readOffset(storage i.Storage, position uint64) uint64 {
+	start := position * offsetSize
+	slice := storage.GetBytes(start, start+offsetSize)
+	return *(*uint64)(unsafe.Pointer(&slice[0]))
+}
+
+// Replace the whole contents of a side file which holds a single
+// document, such as a checkpoint. The document is replaced as a
+// whole, and the header's EntryCount is bumped on every write so
+// that readers can tell when it has changed. Returns the new version.
+func writeBlob(storage i.Storage, data []byte) (uint64, error) {
+	if err := storage.WriteDocument(data); err != nil {
+		return atomic.LoadUint64(&storage.Header().EntryCount), err
+	}
+	return atomic.AddUint64(&storage.Header().EntryCount, 1), nil
+}
+
+// Read a copy of the document in a side file, along with its version.
+// Side files written before documents were kept aside hold the
+// document in the storage itself.
+func readBlob(storage i.Storage) ([]byte, uint64) {
+	header := storage.Header()
+	version := atomic.LoadUint64(&header.EntryCount)
+	if data, err := storage.ReadDocument(); data != nil || err != nil {
+		return data, version
+	}
+	size := atomic.LoadUint64(&header.LastMessage)
+	if size == 0 {
+		return nil, version
+	}
+	return append([]byte{}, storage.GetBytes(0, size)...), version
+}
+
+// Raise the value at addr to v if it is currently lower
+func atomicMax(addr *uint64, v uint64) {
+	for {
+		cur := atomic.LoadUint64(addr)
+		if cur >= v || atomic.CompareAndSwapUint64(addr, cur, v) {
+			return
+		}
+	}
+}
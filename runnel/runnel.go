@@ -1,13 +1,18 @@
 package runnel
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
-	"code.google.com/p/go-uuid/uuid"
 	"github.com/asp2insp/runnel-go/runnel/i"
 	"github.com/asp2insp/runnel-go/runnel/s"
 	"github.com/cheekybits/genny/generic"
+	"github.com/pborman/uuid"
 )
 
 type Typed generic.Type
@@ -16,9 +21,34 @@ type TypedStream struct {
 	Name              string
 	Id                string
 	storage           i.Storage
+	envelopes         i.Storage
 	IsAlive           bool
 	lastKnownFileSize uint64
-	typeSize          uint64
+	// The size of a record, not of a pointer to one. See
+	// Upgrading in API.md for streams written before this.
+	typeSize uint64
+	watcher  *hookWatcher
+	// Marks this handle as open, and logs opens and closes for hooks
+	handle       uint64
+	handleEvents *handleEvents
+	properties   map[string]TypedPropertyFunc
+	indexes      map[string]*propertyIndex
+	// When enabled, views register their filters in the stream's
+	// subscriptions, so that whatever delivers the stream's messages
+	// elsewhere can skip those no view wants. Writers store every
+	// message regardless, as plain readers still see them all.
+	PubSideFilters    bool
+	subscriptions     *Subscriptions
+	subscriptionsOnce sync.Once
+	times             *timeIndex
+	timesOnce         sync.Once
+	// Converts messages to and from their external form,
+	// TypedJSONCodec unless set otherwise
+	Codec i.Codec
+	// How this handle coordinates with other writers
+	mode LockMode
+	// Shared with the stream's other handles in this process
+	slots *slotPublisher
 }
 
 type TypedRef struct {
@@ -33,21 +63,104 @@ func NewTypedStream(name, id string, store i.Storage) *TypedStream {
 	if store == nil {
 		store = s.NewFileStorage("").Init(id)
 	}
+	events := &handleEvents{storage: store.Sibling(handleEventsSuffix)}
 	ret := &TypedStream{
 		Name:              name,
 		Id:                id,
 		storage:           store,
+		envelopes:         store.Sibling(envelopeSuffix),
 		IsAlive:           true,
 		lastKnownFileSize: store.Capacity(),
-		typeSize:          uint64(unsafe.Sizeof(new(Typed))),
+		typeSize:          uint64(unsafe.Sizeof(*new(Typed))),
+		watcher:           newHookWatcher(id, store, events),
+		handleEvents:      events,
+		properties:        make(map[string]TypedPropertyFunc),
+		indexes:           make(map[string]*propertyIndex),
+		Codec:             TypedJSONCodec{},
+		slots:             acquirePublisher(id),
 	}
+	// Correct the count for handles whose processes died holding them
+	events.reap(store)
+	atomic.AddUint64(&store.Header().OpenCount, 1)
+	ret.handle, _ = store.OpenHandle()
+	events.append(ret.handle, false)
 	return ret
 }
 
+// Open a stream, locking it in the given mode against other handles
+// in any process. Returns a *i.LockedError if another handle holds a
+// conflicting lock, such as when a second exclusive writer tries to
+// open it. Handles opened with NewTypedStream don't take part in locking.
+func OpenTypedStream(name, id string, store i.Storage, mode LockMode) (*TypedStream, error) {
+	if id == "" {
+		id = uuid.New()
+	}
+	if store == nil {
+		store = s.NewFileStorage("").Init(id)
+	}
+	if err := lockStorage(store, mode); err != nil {
+		store.Close()
+		return nil, err
+	}
+	ret := NewTypedStream(name, id, store)
+	ret.mode = mode
+	return ret, nil
+}
+
+// Encodes messages as JSON
+type TypedJSONCodec struct{}
+
+func (TypedJSONCodec) Encode(record []byte) ([]byte, error) {
+	var value Typed
+	if uintptr(len(record)) != unsafe.Sizeof(value) {
+		return nil, fmt.Errorf("record is %d bytes, expected %d", len(record), unsafe.Sizeof(value))
+	}
+	value = *(*Typed)(unsafe.Pointer(&record[0]))
+	return json.Marshal(value)
+}
+
+func (TypedJSONCodec) Decode(data []byte) ([]byte, error) {
+	var value Typed
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	size := unsafe.Sizeof(value)
+	return append([]byte{}, (*[1 << 30]byte)(unsafe.Pointer(&value))[:size:size]...), nil
+}
+
 func (stream *TypedStream) header() *i.StreamHeader {
 	return stream.storage.Header()
 }
 
+// The filters registered by views of this stream
+func (stream *TypedStream) Subscriptions() *Subscriptions {
+	stream.subscriptionsOnce.Do(func() {
+		stream.subscriptions = OpenSubscriptions(stream.storage)
+	})
+	return stream.subscriptions
+}
+
+// Whether any subscriber of the stream wants the given message.
+// Only delivery may be skipped on the strength of this, never
+// storage, as readers of the stream don't subscribe.
+func (stream *TypedStream) Wants(data *Typed, env i.Envelope) bool {
+	properties := stream.properties
+	return stream.Subscriptions().Wants(env, func(name string) (string, bool) {
+		if extract, ok := properties[name]; ok {
+			return extract(data), true
+		}
+		return "", false
+	})
+}
+
+// The sparse index of message timestamps
+func (stream *TypedStream) timeIndex() *timeIndex {
+	stream.timesOnce.Do(func() {
+		stream.times = openTimeIndex(stream.storage, stream.envelopes, stream.typeSize)
+	})
+	return stream.times
+}
+
 // ==================== WRITER ===================
 
 type TypedStreamWriter struct {
@@ -58,6 +171,13 @@ type TypedStreamWriter struct {
 	parent *TypedStream
 	// The storage to write into
 	storage i.Storage
+	// The storage to write envelopes into
+	envelopes i.Storage
+	// The marks of filled slots, kept by shared writers only
+	commits i.Storage
+	// Stamped on messages written without an author
+	author     uint64
+	authorType uint32
 	// Whether this writer is alive
 	isAlive bool
 }
@@ -68,10 +188,17 @@ type TypedStreamWriter struct {
 // as long as the writer and the stream that it operates
 // on are both alive
 func (stream *TypedStream) Writer() *TypedStreamWriter {
+	if stream.mode == LockReadOnly {
+		panic(fmt.Sprintf("Stream %s was opened read-only", stream.Id))
+	}
 	ret := &TypedStreamWriter{
 		parent:    stream,
 		inChannel: make(<-chan *Typed, 10),
 		storage:   stream.storage.Clone(),
+		envelopes: stream.envelopes.Clone(),
+	}
+	if stream.mode == LockShared {
+		ret.commits = stream.storage.Sibling(commitsSuffix)
 	}
 	go ret.writeLoop()
 	ret.isAlive = true
@@ -88,69 +215,74 @@ func (writer *TypedStreamWriter) writeLoop() {
 	}
 }
 
+// Set the author stamped on messages written without one
+func (writer *TypedStreamWriter) SetAuthor(author uint64, authorType uint32) {
+	writer.author = author
+	writer.authorType = authorType
+}
+
 // Write the given data into the stream
-// TODO: Prefix with header
+func (writer *TypedStreamWriter) Write(data *Typed) error {
+	return writer.WriteMessage(data, i.Envelope{})
+}
+
+// Write the given data into the stream with the given envelope.
+// A zero timestamp is replaced with the current time, and a
+// missing author with the writer's author.
 // The data is written in 3 steps:
 // 1. Allocate space by bumping tail
-// 2. Write data into allocated space
+// 2. Write envelope and data into allocated space
 // 3. Declare data is available by bumping lastMessage
-func (writer *TypedStreamWriter) Write(data *Typed) {
+// In shared mode, the last step waits for the slots reserved before,
+// and fails if the message's own slot was skipped meanwhile.
+func (writer *TypedStreamWriter) WriteMessage(data *Typed, env i.Envelope) error {
 	if !writer.parent.IsAlive || !writer.isAlive {
 		// If the stream/writer isn't alive, there's no point
-		return
+		return nil
 	}
-	storage := writer.storage
-	header := storage.Header()
-	// Check to see if we need to resize
-	if storage.Utilization() > 75 {
-		// TODO: Work out how to handle multiple writers here, maybe through buffer swap
-		storage.Resize(uint64(2 * storage.Capacity()))
-		writer.parent.lastKnownFileSize = header.FileSize
+	if env.Timestamp == 0 {
+		env.Timestamp = time.Now().UnixNano()
 	}
-
-	// TODO make this atomic
-	// Get old tail
-	offset := header.Tail
-	// Bump tail
-	header.Tail += writer.parent.typeSize
-
-	// Check before we write
-	if header.Tail > storage.Capacity() {
-		panic(fmt.Sprintf("No Room! Header: %+v", header))
+	if env.Author == 0 && env.AuthorType == 0 {
+		env.Author, env.AuthorType = writer.author, writer.authorType
 	}
-
-	// Write data
-	slice := storage.GetBytes(offset, offset+writer.parent.typeSize)
-	address := &slice[0]
-	var pointer *Typed = (*Typed)(unsafe.Pointer(address))
-	var datum Typed = *data
-	*pointer = datum
-
-	// Declare data available
-	header.LastMessage = writer.max(header.LastMessage, offset+writer.parent.typeSize)
-	header.EntryCount += 1
-	storage.Flush()
+	parent := writer.parent
+	_, err := parent.slots.write(writer.storage, writer.envelopes, writer.commits, parent.handle, parent.typeSize, &env, func(slot []byte) {
+		var pointer *Typed = (*Typed)(unsafe.Pointer(&slot[0]))
+		var datum Typed = *data
+		*pointer = datum
+	})
+	if err != nil {
+		return fmt.Errorf("writing to stream %s: %v", parent.Id, err)
+	}
+	return nil
 }
 
 // Close the writer
 func (writer *TypedStreamWriter) Close() {
 	writer.isAlive = false
 	writer.storage.Close()
-}
-
-func (writer *TypedStreamWriter) max(a, b uint64) uint64 {
-	if a > b {
-		return a
-	} else {
-		return b
+	writer.envelopes.Close()
+	if writer.commits != nil {
+		writer.commits.Close()
 	}
 }
 
 // =================== OUTPUT ===================
 
+// A message along with its envelope and position in the stream
+type TypedMessage struct {
+	Offset   uint64
+	Envelope i.Envelope
+	Data     Typed
+}
+
 type TypedStreamReader struct {
 	// Out channel to allow blocking reads
-	outChannel chan Typed
+	outChannel chan TypedMessage
+	// Closed when the reader is closed, to release
+	// a pending send on the out channel
+	done chan struct{}
 	// The stream that this reader will read from
 	parent *TypedStream
 	// The position in the stream that this reader
@@ -162,7 +294,8 @@ type TypedStreamReader struct {
 	// Whether this reader is alive
 	isAlive bool
 	// The storage to read from
-	storage i.Storage
+	storage   i.Storage
+	envelopes i.Storage
 }
 
 // Build a new stream reader which maintains its place in the stream
@@ -171,18 +304,26 @@ type TypedStreamReader struct {
 func (stream *TypedStream) Reader(base uint64) *TypedStreamReader {
 	ret := &TypedStreamReader{
 		parent:     stream,
-		outChannel: make(chan Typed),
+		outChannel: make(chan TypedMessage),
+		done:       make(chan struct{}),
 		base:       base,
 		offset:     0,
 		storage:    stream.storage.Clone(),
+		envelopes:  stream.envelopes.Clone(),
 	}
-	go ret.readLoop()
 	ret.isAlive = true
+	go ret.readLoop()
 	return ret
 }
 
+// Build a reader starting at the first message written at or after t
+func (stream *TypedStream) ReaderFromTime(t time.Time) *TypedStreamReader {
+	return stream.Reader(stream.seekTime(t.UnixNano()))
+}
+
 // Loop endlessly to read the data from the stream
 func (reader *TypedStreamReader) readLoop() {
+	defer close(reader.outChannel)
 	header := reader.storage.Header()
 	for reader.isAlive && reader.parent.IsAlive {
 		if reader.parent.lastKnownFileSize != header.FileSize {
@@ -195,33 +336,809 @@ func (reader *TypedStreamReader) readLoop() {
 			slice := reader.storage.GetBytes(bot, bot+reader.parent.typeSize)
 			address := &slice[0]
 			pointer := (*Typed)(unsafe.Pointer(address))
-			reader.outChannel <- *pointer
+			message := TypedMessage{
+				Offset:   bot,
+				Envelope: readEnvelope(reader.envelopes, bot/reader.parent.typeSize),
+				Data:     *pointer,
+			}
+			select {
+			case reader.outChannel <- message:
+			case <-reader.done:
+				return
+			}
 			reader.offset += reader.parent.typeSize
+			continue
+		}
+		// Caught up, so wait for more to be written
+		select {
+		case <-time.After(pollInterval):
+		case <-reader.done:
+			return
 		}
 	}
 }
 
 // Read a single value from the stream (in a blocking fashion)
 func (reader *TypedStreamReader) Read() Typed {
-	return <-reader.outChannel
+	return (<-reader.outChannel).Data
+}
+
+// Read a single message from the stream (in a blocking fashion).
+// Returns false once the reader has been closed.
+func (reader *TypedStreamReader) ReadMessage() (TypedMessage, bool) {
+	message, ok := <-reader.outChannel
+	return message, ok
 }
 
 func (reader *TypedStreamReader) Close() {
+	if !reader.isAlive {
+		return
+	}
 	reader.isAlive = false
+	close(reader.done)
+}
+
+// =================== CURSORS ==================
+
+// A position in a stream which can be moved in either direction.
+// Records are fixed size, so stepping back is as cheap as stepping
+// forward and needs no framing.
+type TypedCursor struct {
+	stream *TypedStream
+	// Offset of the message Next will return
+	offset uint64
+}
+
+// A cursor positioned just before the message at the given offset,
+// which is rounded down to the start of a message
+func (s *TypedStream) Cursor(offset uint64) *TypedCursor {
+	return &TypedCursor{stream: s, offset: offset - offset%s.typeSize}
+}
+
+// Return the message after the cursor and move past it.
+// Returns false at the end of the stream.
+func (c *TypedCursor) Next() (TypedMessage, bool) {
+	if c.offset+c.stream.typeSize > atomic.LoadUint64(&c.stream.header().LastMessage) {
+		return TypedMessage{}, false
+	}
+	message := c.stream.message(c.offset)
+	c.offset += c.stream.typeSize
+	return message, true
+}
+
+// Return the message before the cursor and move back past it.
+// Returns false at the head of the stream.
+func (c *TypedCursor) Prev() (TypedMessage, bool) {
+	if c.offset < c.stream.typeSize {
+		return TypedMessage{}, false
+	}
+	c.offset -= c.stream.typeSize
+	return c.stream.message(c.offset), true
+}
+
+// The offset of the message Next would return
+func (c *TypedCursor) Offset() uint64 {
+	return c.offset
+}
+
+// Reads a stream backwards, from the newest message to the head.
+// Unlike a TypedStreamReader it never waits for new messages.
+type TypedReverseReader struct {
+	cursor *TypedCursor
+}
+
+// Build a reader which starts with the latest message in the
+// stream and walks back to the head
+func (s *TypedStream) ReverseReader() *TypedReverseReader {
+	return s.ReverseReaderFrom(atomic.LoadUint64(&s.header().LastMessage))
+}
+
+// Build a reader which starts with the message before the
+// given offset and walks back to the head
+func (s *TypedStream) ReverseReaderFrom(offset uint64) *TypedReverseReader {
+	return &TypedReverseReader{cursor: s.Cursor(offset)}
+}
+
+// Read the next value back. Returns false at the head of the stream.
+func (reader *TypedReverseReader) Read() (Typed, bool) {
+	message, ok := reader.cursor.Prev()
+	return message.Data, ok
+}
+
+// Read the next message back. Returns false at the head of the stream.
+func (reader *TypedReverseReader) ReadMessage() (TypedMessage, bool) {
+	return reader.cursor.Prev()
+}
+
+// Up to the latest n messages in the stream, newest first
+func (s *TypedStream) Latest(n int) []TypedMessage {
+	var ret []TypedMessage
+	reader := s.ReverseReader()
+	for len(ret) < n {
+		message, ok := reader.ReadMessage()
+		if !ok {
+			break
+		}
+		ret = append(ret, message)
+	}
+	return ret
+}
+
+// The message at the given offset, with up to n messages either
+// side of it, in stream order
+func (s *TypedStream) AroundOffset(offset uint64, n int) []TypedMessage {
+	var before []TypedMessage
+	back := s.Cursor(offset)
+	for len(before) < n {
+		message, ok := back.Prev()
+		if !ok {
+			break
+		}
+		before = append(before, message)
+	}
+	ret := reverseTypedMessages(before)
+	forward := s.Cursor(offset)
+	for len(ret) < len(before)+n+1 {
+		message, ok := forward.Next()
+		if !ok {
+			break
+		}
+		ret = append(ret, message)
+	}
+	return ret
+}
+
+// Every message written within d of t, in stream order. Assumes
+// timestamps are in order, as they are when stamped by writers.
+func (s *TypedStream) AroundTime(t time.Time, d time.Duration) []TypedMessage {
+	at, lo, hi := t.UnixNano(), t.Add(-d).UnixNano(), t.Add(d).UnixNano()
+	start := s.seekTime(at)
+
+	// Walk out from t in both directions
+	var before []TypedMessage
+	back := s.Cursor(start)
+	for {
+		message, ok := back.Prev()
+		if !ok || message.Envelope.Timestamp < lo {
+			break
+		}
+		before = append(before, message)
+	}
+	ret := reverseTypedMessages(before)
+	forward := s.Cursor(start)
+	for {
+		message, ok := forward.Next()
+		if !ok || message.Envelope.Timestamp > hi {
+			break
+		}
+		ret = append(ret, message)
+	}
+	return ret
+}
+
+// The offset of the first message stamped at or after t, found
+// through the time index. Returns the end of the stream if there
+// is no such message yet.
+func (s *TypedStream) seekTime(t int64) uint64 {
+	cursor := s.Cursor(s.timeIndex().seek(t))
+	for {
+		message, ok := cursor.Next()
+		if !ok {
+			return cursor.Offset()
+		}
+		if message.Envelope.Timestamp >= t {
+			return message.Offset
+		}
+	}
+}
+
+// The message at the given offset, along with its envelope
+func (s *TypedStream) message(offset uint64) TypedMessage {
+	return TypedMessage{
+		Offset:   offset,
+		Envelope: readEnvelope(s.envelopes, offset/s.typeSize),
+		Data:     s.at(offset),
+	}
+}
+
+func reverseTypedMessages(messages []TypedMessage) []TypedMessage {
+	ret := make([]TypedMessage, 0, len(messages))
+	for n := len(messages) - 1; n >= 0; n-- {
+		ret = append(ret, messages[n])
+	}
+	return ret
+}
+
+// =================== HOOKS ====================
+
+// Call the given hook whenever a handle to this stream is opened
+func (s *TypedStream) OnOpen(hook Hook) {
+	s.watcher.on(EventOpen, hook)
+}
+
+// Call the given hook whenever a handle to this stream is closed,
+// including this one
+func (s *TypedStream) OnClose(hook Hook) {
+	s.watcher.on(EventClose, hook)
+}
+
+// Call the given hook whenever messages are made available
+func (s *TypedStream) OnInsert(hook Hook) {
+	s.watcher.on(EventInsert, hook)
+}
+
+// Call the given hook whenever the header changes
+func (s *TypedStream) OnChange(hook Hook) {
+	s.watcher.on(EventChange, hook)
+}
+
+// Call the given hook for every event
+func (s *TypedStream) OnAny(hook Hook) {
+	s.watcher.onAny(hook)
 }
 
 // =================== FILTERS ==================
 
+// Extracts a named property from a message
+type TypedPropertyFunc func(*Typed) string
+
+// Declare a named property that filters can match on.
+// Properties should be declared before building filters.
+func (s *TypedStream) DeclareProperty(name string, extract TypedPropertyFunc) {
+	s.properties[name] = extract
+}
+
+// Declare a property and keep an index of its values on disk next
+// to the stream. The index is kept up to date as messages are
+// written, and views filtering on the property use it to find
+// matching messages instead of scanning the whole stream.
+// Any number of handles, in any process, can declare the same
+// index, but only one at a time adds to it.
+func (s *TypedStream) DeclareIndex(name string, extract TypedPropertyFunc) {
+	s.DeclareProperty(name, extract)
+	if s.indexes[name] != nil {
+		return
+	}
+	idx := openPropertyIndex(s.storage, name)
+	s.indexes[name] = idx
+	go s.indexLoop(idx, extract)
+}
+
+// Index every message in the stream exactly once, first
+// through the history and then as new messages arrive
+func (s *TypedStream) indexLoop(idx *propertyIndex, extract TypedPropertyFunc) {
+	defer close(idx.done)
+	alive := func() bool { return idx.isAlive && s.IsAlive }
+	if !idx.maintain(alive) {
+		return
+	}
+	storage := s.storage.Clone()
+	defer storage.Close()
+	for alive() {
+		offset := idx.source()
+		if offset+s.typeSize > atomic.LoadUint64(&storage.Header().LastMessage) {
+			time.Sleep(pollInterval)
+			continue
+		}
+		slice := storage.GetBytes(offset, offset+s.typeSize)
+		idx.add(extract((*Typed)(unsafe.Pointer(&slice[0]))), offset, offset+s.typeSize)
+	}
+}
+
+// Builds a filtered view of a stream. Each filter narrows
+// the set of messages in the view.
+type TypedFilter struct {
+	parent     *TypedStream
+	predicates []Predicate
+}
+
+// Start building a filtered view of this stream
+func (s *TypedStream) Filter() *TypedFilter {
+	return &TypedFilter{parent: s}
+}
+
+// Keep messages at or after the given offset
+func (f *TypedFilter) From(offset uint64) *TypedFilter {
+	return f.add(Predicate{Op: OpFrom, Offset: offset})
+}
+
+// Keep messages before the given offset
+func (f *TypedFilter) Until(offset uint64) *TypedFilter {
+	return f.add(Predicate{Op: OpUntil, Offset: offset})
+}
+
+// Keep messages written before the given time
+func (f *TypedFilter) Before(t time.Time) *TypedFilter {
+	return f.add(Predicate{Op: OpBefore, Time: t.UnixNano()})
+}
+
+// Keep messages written after the given time
+func (f *TypedFilter) After(t time.Time) *TypedFilter {
+	return f.add(Predicate{Op: OpAfter, Time: t.UnixNano()})
+}
+
+// Keep messages written within window of the given time
+func (f *TypedFilter) Around(t time.Time, window time.Duration) *TypedFilter {
+	return f.add(Predicate{Op: OpAround, Time: t.UnixNano(), Window: int64(window)})
+}
+
+// Keep messages whose declared property has the given value
+func (f *TypedFilter) Property(name, value string) *TypedFilter {
+	return f.add(Predicate{Op: OpProperty, Name: name, Value: value})
+}
+
+// Keep messages written by the given class of author
+func (f *TypedFilter) AuthorType(authorType uint32) *TypedFilter {
+	return f.add(Predicate{Op: OpAuthorType, AuthorType: authorType})
+}
+
+// Keep the given fraction of messages. The sample is
+// deterministic, so rebuilding the view keeps the same messages.
+func (f *TypedFilter) Sample(rate float64) *TypedFilter {
+	return f.add(Predicate{Op: OpSample, Rate: rate})
+}
+
+// Keep the messages for the given fraction of the values of a
+// declared property. Every message with the same value is either
+// kept or dropped, so the sample follows whole entities.
+func (f *TypedFilter) SampleBy(name string, rate float64) *TypedFilter {
+	return f.add(Predicate{Op: OpSample, Name: name, Rate: rate})
+}
+
+// Keep only the first message for each value of the given
+// declared property, or of the whole message if name is empty
+func (f *TypedFilter) Dedup(name string) *TypedFilter {
+	return f.add(Predicate{Op: OpDedup, Name: name})
+}
+
+// As Dedup, but only remember the keys seen within the horizon.
+// The seen-set is kept on disk next to the view's index.
+func (f *TypedFilter) DedupWithin(name string, horizon time.Duration) *TypedFilter {
+	return f.add(Predicate{Op: OpDedup, Name: name, Horizon: int64(horizon)})
+}
+
+// As Dedup, but only remember the last limit keys.
+// The seen-set is kept on disk next to the view's index.
+func (f *TypedFilter) DedupLast(name string, limit uint64) *TypedFilter {
+	return f.add(Predicate{Op: OpDedup, Name: name, Limit: limit})
+}
+
+// Add predicates, such as those parsed from an expression
+func (f *TypedFilter) Where(predicates ...Predicate) *TypedFilter {
+	f.predicates = append(f.predicates, predicates...)
+	return f
+}
+
+// The filter as an expression which can be parsed by ParsePredicates
+func (f *TypedFilter) String() string {
+	return FormatPredicates(f.predicates)
+}
+
+func (f *TypedFilter) add(p Predicate) *TypedFilter {
+	f.predicates = append(f.predicates, p)
+	return f
+}
+
+// Build the filtered view. The view is backed by a persisted
+// index of matching offsets which is shared by every view built
+// with the same filters, so reopening a view picks up where the
+// last one left off rather than rescanning the stream. Only one
+// of the views sharing an index, in any process, adds to it.
+// Filters which can never match return a *ContradictionError,
+// and redundant filters are simplified with a warning on the view.
+func (f *TypedFilter) Build() (*TypedView, error) {
+	predicates, warnings, err := simplifyPredicates(f.predicates)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range predicates {
+		if p.usesProperty() && f.parent.properties[p.Name] == nil {
+			return nil, fmt.Errorf("%s: property %q has not been declared", p, p.Name)
+		}
+	}
+	parent := f.parent
+	id := parent.Id + "_view_" + predicatesKey(predicates)
+	view := &TypedView{
+		Id:         id,
+		Predicates: predicates,
+		Warnings:   warnings,
+		IsAlive:    true,
+		parent:     parent,
+		index:      parent.storage.Sibling(id[len(parent.Id):]),
+		done:       make(chan struct{}),
+	}
+	if err := view.compile(); err != nil {
+		view.closeStorage()
+		return nil, err
+	}
+	view.storage = parent.storage.Clone()
+	view.envelopes = parent.envelopes.Clone()
+	view.useIndex()
+	view.useTimeBounds()
+	if parent.PubSideFilters {
+		parent.Subscriptions().Register(id, predicates)
+	}
+	go view.followLoop()
+	return view, nil
+}
+
+// A read-only view of the messages in a stream which
+// pass a filter
+type TypedView struct {
+	Id         string
+	Predicates []Predicate
+	// Describes any simplifications made while building
+	Warnings []string
+	// The secondary index used to find candidates, if any
+	Index   string
+	IsAlive bool
+	// The stream being filtered
+	parent *TypedStream
+	// Accepts messages which belong in the view
+	match matcher
+	// Offsets of the matching messages, in stream order
+	index i.Storage
+	// Persisted state of the filters, such as seen-sets
+	state []i.Storage
+	// Finds the messages with lookupValue, when the view
+	// can use a secondary index
+	lookup      *propertyIndex
+	lookupValue string
+	// Bounds on the timestamps the filters accept, used to skip
+	// through the time index. Only set when bounded.
+	timeFrom  *int64
+	timeUntil *int64
+	// The storage to read messages and envelopes from
+	storage   i.Storage
+	envelopes i.Storage
+	// Closed when the follow loop exits
+	done chan struct{}
+}
+
+// Compile the view's predicates, opening the state they persist
+func (view *TypedView) compile() error {
+	var err error
+	view.match, err = compilePredicates(view.Predicates, func(suffix string) i.Storage {
+		state := view.index.Sibling(suffix)
+		view.state = append(view.state, state)
+		return state
+	})
+	return err
+}
+
+// Wait to become the only view, in any process, writing to the
+// index. Views built with the same filters share the index, so
+// the rest wait to take over in case the writer closes or dies.
+// Returns false if the view was closed while waiting.
+func (view *TypedView) takeIndex() bool {
+	for waited := false; view.IsAlive && view.parent.IsAlive; waited = true {
+		err := view.index.Lock(true, false)
+		if _, locked := err.(*i.LockedError); locked {
+			time.Sleep(pollInterval)
+			continue
+		}
+		// Without locking on this platform, every view writes
+		if waited {
+			// The state persisted by the last writer has moved on
+			view.closeState()
+			view.compile()
+		}
+		view.prime()
+		return true
+	}
+	return false
+}
+
+// Replay the messages already in the index through the
+// matcher so that stateful filters pick up where they left off
+func (view *TypedView) prime() {
+	for n := uint64(0); n < view.index.Header().EntryCount; n++ {
+		c := view.candidate(readOffset(view.index, n))
+		c.replay = true
+		view.match(c)
+	}
+}
+
+// Look for a property predicate on an indexed property. Only
+// predicates before any dedup are considered, since dedup has to
+// see every message to pick the first of each key.
+func (view *TypedView) useIndex() {
+	for _, p := range view.Predicates {
+		if p.Op == OpDedup {
+			return
+		}
+		if idx := view.parent.indexes[p.Name]; p.Op == OpProperty && idx != nil {
+			view.Index = p.Name
+			view.lookup = idx
+			view.lookupValue = p.Value
+			return
+		}
+	}
+}
+
+// Gather the time bounds of the filters before any dedup, so that
+// messages outside them can be skipped without being evaluated
+func (view *TypedView) useTimeBounds() {
+	var from, until int64 = math.MinInt64, math.MaxInt64
+	for _, p := range view.Predicates {
+		if p.Op == OpDedup {
+			break
+		}
+		switch p.Op {
+		case OpAfter:
+			from = maxInt64(from, p.Time+1)
+		case OpBefore:
+			until = minInt64(until, p.Time)
+		case OpAround:
+			from = maxInt64(from, p.Time-p.Window)
+			until = minInt64(until, p.Time+p.Window+1)
+		}
+	}
+	if from != math.MinInt64 {
+		view.timeFrom = &from
+	}
+	if until != math.MaxInt64 {
+		view.timeUntil = &until
+	}
+}
+
+// Where to evaluate next instead of offset, given the time bounds.
+// Returns offset when it can't be skipped.
+func (view *TypedView) skipTime(offset uint64) uint64 {
+	times := view.parent.timeIndex()
+	if view.timeFrom != nil {
+		if start := times.seek(*view.timeFrom); start > offset {
+			return start
+		}
+	}
+	if view.timeUntil != nil {
+		if stop, ok := times.stop(*view.timeUntil); ok && offset >= stop {
+			// Nothing from here on can match
+			last := atomic.LoadUint64(&view.storage.Header().LastMessage)
+			return maxUint64(offset, last-last%view.parent.typeSize)
+		}
+	}
+	return offset
+}
+
+// Evaluate every message in the stream exactly once, first
+// through the history and then as new messages arrive
+func (view *TypedView) followLoop() {
+	defer close(view.done)
+	if !view.takeIndex() {
+		return
+	}
+	if view.lookup != nil {
+		view.followIndex()
+		return
+	}
+	header := view.index.Header()
+	size := view.parent.typeSize
+	for view.IsAlive && view.parent.IsAlive {
+		offset := header.Source
+		if offset+size > atomic.LoadUint64(&view.storage.Header().LastMessage) {
+			time.Sleep(pollInterval)
+			continue
+		}
+		if view.timeFrom != nil || view.timeUntil != nil {
+			if skip := view.skipTime(offset); skip != offset {
+				header.Source = skip
+				continue
+			}
+		}
+		view.evaluate(offset)
+		header.Source = offset + size
+	}
+}
+
+// As followLoop, but only evaluate the messages the secondary
+// index says have the right value. Other messages can't match,
+// so they're skipped over a batch at a time.
+func (view *TypedView) followIndex() {
+	header := view.index.Header()
+	for view.IsAlive && view.parent.IsAlive {
+		from, to := header.Source, view.lookup.source()
+		if to <= from {
+			time.Sleep(pollInterval)
+			continue
+		}
+		for _, offset := range view.lookup.lookup(view.lookupValue, from, to) {
+			view.evaluate(offset)
+		}
+		header.Source = to
+	}
+}
+
+// Add the message at the given offset to the index if it matches,
+// then record what evaluating it changed, such as the keys seen by a
+// dedup. The message may already be in the index if the last view
+// to write it stopped before recording the changes.
+func (view *TypedView) evaluate(offset uint64) {
+	c := view.candidate(offset)
+	if view.match(c) && !view.indexed(offset) {
+		appendOffset(view.index, offset)
+	}
+	c.commit()
+}
+
+// Whether the index already holds the message at the given offset
+func (view *TypedView) indexed(offset uint64) bool {
+	n := view.index.Header().EntryCount
+	return n > 0 && readOffset(view.index, n-1) >= offset
+}
+
+func (view *TypedView) candidate(offset uint64) *candidate {
+	size := view.parent.typeSize
+	data := view.storage.GetBytes(offset, offset+size)
+	value := (*Typed)(unsafe.Pointer(&data[0]))
+	return &candidate{
+		offset:   offset,
+		envelope: readEnvelope(view.envelopes, offset/size),
+		data:     data,
+		property: func(name string) string {
+			return view.parent.properties[name](value)
+		},
+	}
+}
+
+// The number of messages in the view so far
+func (view *TypedView) Size() uint64 {
+	return view.index.Header().EntryCount
+}
+
+// Close the view. The index is kept so that the
+// view can be reopened without rescanning.
+func (view *TypedView) Close() {
+	if !view.IsAlive {
+		return
+	}
+	view.IsAlive = false
+	<-view.done
+	if view.parent.PubSideFilters && view.parent.IsAlive {
+		view.parent.Subscriptions().Unregister(view.Id)
+	}
+	view.storage.Close()
+	view.envelopes.Close()
+	view.closeStorage()
+}
+
+func (view *TypedView) closeStorage() {
+	view.closeState()
+	view.index.Close()
+}
+
+func (view *TypedView) closeState() {
+	for _, state := range view.state {
+		state.Flush()
+		state.Close()
+	}
+	view.state = nil
+}
+
+type TypedViewReader struct {
+	// Out channel to allow blocking reads
+	outChannel chan Typed
+	// Closed when the reader is closed, to release
+	// a pending send on the out channel
+	done chan struct{}
+	// The view that this reader will read from
+	view *TypedView
+	// The number of messages into the view that
+	// this reader has reached
+	position uint64
+	// Whether this reader is alive
+	isAlive bool
+	// The storage to read offsets and messages from
+	index   i.Storage
+	storage i.Storage
+}
+
+// Build a new reader which starts from the given
+// number of messages into the view
+func (view *TypedView) Reader(base uint64) *TypedViewReader {
+	ret := &TypedViewReader{
+		outChannel: make(chan Typed),
+		done:       make(chan struct{}),
+		view:       view,
+		position:   base,
+		index:      view.index.Clone(),
+		storage:    view.storage.Clone(),
+	}
+	ret.isAlive = true
+	go ret.readLoop()
+	return ret
+}
+
+func (reader *TypedViewReader) readLoop() {
+	defer reader.storage.Close()
+	defer reader.index.Close()
+	header := reader.index.Header()
+	size := reader.view.parent.typeSize
+	for reader.isAlive && reader.view.IsAlive {
+		if reader.position >= atomic.LoadUint64(&header.EntryCount) {
+			time.Sleep(pollInterval)
+			continue
+		}
+		offset := readOffset(reader.index, reader.position)
+		slice := reader.storage.GetBytes(offset, offset+size)
+		select {
+		case reader.outChannel <- *(*Typed)(unsafe.Pointer(&slice[0])):
+		case <-reader.done:
+			return
+		}
+		reader.position++
+	}
+}
+
+// Read a single value from the view (in a blocking fashion)
+func (reader *TypedViewReader) Read() Typed {
+	return <-reader.outChannel
+}
+
+func (reader *TypedViewReader) Close() {
+	if !reader.isAlive {
+		return
+	}
+	reader.isAlive = false
+	close(reader.done)
+}
+
 // =================== STREAMS ==================
 
 func (s *TypedStream) Size() uint64 {
 	return s.header().EntryCount
 }
 
+// Untyped access to the stream's records. Close the
+// returned stream when done with it.
+func (s *TypedStream) Raw() *RawStream {
+	properties := make(map[string]func([]byte) string, len(s.properties))
+	for name, extract := range s.properties {
+		properties[name] = rawTypedProperty(extract)
+	}
+	return newRawStream(s.Id, s.typeSize, s.storage, s.envelopes, s.Codec, properties, s.mode, s.slots, s.handle)
+}
+
+// Extract the property from a record given as bytes
+func rawTypedProperty(extract TypedPropertyFunc) func([]byte) string {
+	return func(record []byte) string {
+		return extract((*Typed)(unsafe.Pointer(&record[0])))
+	}
+}
+
+// The message at the given offset
+func (s *TypedStream) at(offset uint64) Typed {
+	slice := s.storage.GetBytes(offset, offset+s.typeSize)
+	return *(*Typed)(unsafe.Pointer(&slice[0]))
+}
+
 // Close out the stream
 func (s *TypedStream) Close() {
+	if !s.IsAlive {
+		return
+	}
 	s.IsAlive = false
+	s.watcher.close()
+	header := s.header()
+	decrementOpenCount(header)
+	s.storage.CloseHandle(s.handle)
+	s.handleEvents.append(s.handle, true)
+	s.watcher.fire(Event{Type: EventClose, Id: s.Id, Header: snapshotHeader(header)})
+	for _, idx := range s.indexes {
+		idx.isAlive = false
+		<-idx.done
+		idx.close()
+	}
 	s.storage.Close()
+	s.envelopes.Close()
+	s.handleEvents.storage.Close()
+	releasePublisher(s.Id)
+	if s.subscriptions != nil {
+		s.subscriptions.Close()
+	}
+	if s.times != nil {
+		s.times.close()
+	}
 }
 
 // ==================== UTILS ===================
@@ -311,4 +311,9 @@ func TestMultiStreamMultipleWritersMultipleReaders(t *testing.T) {
 func cleanupFiles() {
 	os.Remove(filepath.Join(os.TempDir(), "id"))
 	os.Remove(filepath.Join(os.TempDir(), "id_header"))
+	// Side files such as envelopes and indexes
+	sideFiles, _ := filepath.Glob(filepath.Join(os.TempDir(), "id_*"))
+	for _, f := range sideFiles {
+		os.Remove(f)
+	}
 }
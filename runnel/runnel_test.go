@@ -9,6 +9,15 @@ import (
 )
 
 //go:generate genny -in=runnel.go -out=IntStream.go gen "Typed=int"
+//go:generate genny -in=modifiers.go -out=IntModifiers.go gen "Typed=int"
+//go:generate genny -in=aggregators.go -out=IntAggregators.go gen "Typed=int"
+//go:generate genny -in=joins.go -out=IntJoins.go gen "Typed=int"
+//go:generate genny -in=partitions.go -out=IntPartitions.go gen "Typed=int"
+//go:generate genny -in=catalogs.go -out=IntCatalog.go gen "Typed=int"
+//go:generate genny -in=catalogs.go -out=AggregateCatalog.go gen "Typed=Aggregate"
+//go:generate genny -in=runnel.go -out=AggregateStream.go gen "Typed=Aggregate"
+//go:generate genny -in=runnel.go -out=JoinedStream.go gen "Typed=Joined"
+//go:generate genny -in=runnel.go -out=TranslationStream.go gen "Typed=Translation"
 
 func TestCreation(t *testing.T) {
 	cleanupFiles()
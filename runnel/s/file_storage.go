@@ -1,8 +1,13 @@
 package s
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"unsafe"
 
 	"github.com/asp2insp/go-misc/utils"
@@ -15,6 +20,8 @@ type fileStorage struct {
 	rootPath     string
 	file         *os.File
 	headerFile   *os.File
+	lockFile     *os.File
+	handles      map[uint64]*os.File
 	mappedMemory mmap.MMap
 	headerMemory mmap.MMap
 	header       *i.StreamHeader
@@ -46,6 +53,10 @@ func (store *fileStorage) Clone() i.Storage {
 	return NewFileStorage(store.rootPath).Init(store.fileId)
 }
 
+func (store *fileStorage) Sibling(suffix string) i.Storage {
+	return NewFileStorage(store.rootPath).Init(store.fileId + suffix)
+}
+
 func (store *fileStorage) Resize(size uint64) i.Storage {
 	// Check to ensure the resize is still necessary
 	if store.Utilization() < 75 {
@@ -107,6 +118,173 @@ func (store *fileStorage) Refresh() {
 	store.header.FileSize = utils.Filesize(store.file)
 }
 
+// LOCKABLE
+
+// Lock the storage through its lock file. An exclusive holder writes
+// its pid into the file so that others can tell who holds it. The
+// lock itself dies with its holder, so a pid left behind by a process
+// which died holding the lock is stale and is simply overwritten.
+func (store *fileStorage) Lock(exclusive, wait bool) error {
+	if store.lockFile == nil {
+		file, err := os.OpenFile(flockname(store.fileId, store.rootPath), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		store.lockFile = file
+	}
+	locked, err := flock(store.lockFile, exclusive, wait)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return &i.LockedError{Id: store.fileId, Pid: readPid(store.lockFile)}
+	}
+	store.lockFile.Truncate(0)
+	if exclusive {
+		store.lockFile.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return nil
+}
+
+func (store *fileStorage) Unlock() {
+	if store.lockFile == nil {
+		return
+	}
+	funlock(store.lockFile)
+	store.lockFile.Close()
+	store.lockFile = nil
+}
+
+// DOCUMENTS
+
+func (store *fileStorage) WriteDocument(data []byte) error {
+	path := fdocument(store.fileId, store.rootPath)
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (store *fileStorage) ReadDocument() ([]byte, error) {
+	data, err := ioutil.ReadFile(fdocument(store.fileId, store.rootPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// HANDLES
+
+// Each open handle is marked by a file of its own alongside the storage,
+// which it holds an flock on. The flock dies with the process, so a
+// handle file which nobody holds a lock on was left by a dead process.
+func (store *fileStorage) OpenHandle() (uint64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	handle := binary.LittleEndian.Uint64(buf[:])
+	path := fhandle(store.fileId, store.rootPath, handle)
+	// Locked before it is moved into place, so that it is
+	// never mistaken for the handle of a dead process
+	tmp := path + "_new"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := flock(file, true, false); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if store.handles == nil {
+		store.handles = make(map[uint64]*os.File)
+	}
+	store.handles[handle] = file
+	return handle, nil
+}
+
+func (store *fileStorage) CloseHandle(handle uint64) {
+	file, ok := store.handles[handle]
+	if !ok {
+		return
+	}
+	delete(store.handles, handle)
+	os.Remove(fhandle(store.fileId, store.rootPath, handle))
+	funlock(file)
+	file.Close()
+}
+
+// Find the handle files nobody holds a lock on. Whoever manages to lock
+// one removes it, while the file is still in place, so that when several
+// processes reap at once only one of them returns each handle.
+func (store *fileStorage) ReapHandles() []uint64 {
+	prefix := fname(store.fileId, store.rootPath) + handleSuffix
+	paths, _ := filepath.Glob(prefix + "*")
+	var reaped []uint64
+	for _, path := range paths {
+		handle, err := strconv.ParseUint(strings.TrimPrefix(path, prefix), 16, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := store.handles[handle]; ok {
+			continue
+		}
+		if reapHandle(path) {
+			reaped = append(reaped, handle)
+		}
+	}
+	return reaped
+}
+
+func (store *fileStorage) HandleOpen(handle uint64) bool {
+	if _, ok := store.handles[handle]; ok {
+		return true
+	}
+	file, err := os.OpenFile(fhandle(store.fileId, store.rootPath, handle), os.O_RDWR, 0666)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+	locked, err := flock(file, true, false)
+	if err != nil {
+		return true
+	}
+	if locked {
+		funlock(file)
+	}
+	return !locked
+}
+
 // CLOSABLE
 
 // Close this storage, by closing the file
@@ -118,6 +296,10 @@ func (store *fileStorage) Close() {
 	// store.file.Close()
 	store.headerMemory.Unmap()
 	// store.headerFile.Close()
+	store.Unlock()
+	for handle := range store.handles {
+		store.CloseHandle(handle)
+	}
 }
 
 // UTILS
@@ -158,6 +340,60 @@ func fheader(id, root string) string {
 	return fname(id, root) + "_header"
 }
 
+// Return a path to the lock file for the given id.
+// Will always be co-located with the file returned by fname
+func flockname(id, root string) string {
+	return fname(id, root) + "_lock"
+}
+
+// Return a path to the document kept for the given id.
+// Will always be co-located with the file returned by fname
+func fdocument(id, root string) string {
+	return fname(id, root) + "_document"
+}
+
+// Handle files are named by this suffix and the handle in hex
+const handleSuffix = "_handle_"
+
+// Return a path to the file marking the given handle as open.
+// Will always be co-located with the file returned by fname
+func fhandle(id, root string, handle uint64) string {
+	return fname(id, root) + handleSuffix + strconv.FormatUint(handle, 16)
+}
+
+// Remove the handle file at the given path if its process is gone,
+// returning whether it was
+func reapHandle(path string) bool {
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	locked, err := flock(file, true, false)
+	if !locked || err != nil {
+		return false
+	}
+	defer funlock(file)
+	// Another process may have reaped it before we took the lock
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	ours, err := file.Stat()
+	if err != nil || !os.SameFile(current, ours) {
+		return false
+	}
+	return os.Remove(path) == nil
+}
+
+// The pid written into a lock file by its exclusive holder, if any
+func readPid(file *os.File) int {
+	data := make([]byte, 32)
+	n, _ := file.ReadAt(data, 0)
+	pid, _ := strconv.Atoi(string(data[:n]))
+	return pid
+}
+
 // Unsafe cast the []byte represented by the mmapped region
 // to a streamHeader
 func mmapToHeader(data mmap.MMap) *i.StreamHeader {
@@ -1,10 +1,13 @@
 package s
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
 )
 
 var testData = []byte("0123456789ABCDEF")
@@ -57,7 +60,63 @@ func TestUtilization(t *testing.T) {
 	testutils.CheckInt(50, store.Utilization(), t)
 }
 
+func TestLock(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("").Init("id")
+	defer store.Close()
+	other := NewFileStorage("").Init("id")
+	defer other.Close()
+
+	if err := store.Lock(true, false); err != nil {
+		t.Fatal(err)
+	}
+	err := other.Lock(false, false)
+	locked, ok := err.(*i.LockedError)
+	testutils.ExpectTrue(ok, "Expected a locked error", t)
+	testutils.CheckInt(os.Getpid(), locked.Pid, t)
+
+	// Shared locks only conflict with exclusive ones
+	store.Unlock()
+	if err := store.Lock(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Lock(false, false); err != nil {
+		t.Fatal(err)
+	}
+	testutils.ExpectTrue(store.Lock(true, false) != nil, "Expected an exclusive lock to conflict", t)
+}
+
+func TestHandles(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("").Init("id")
+	defer store.Close()
+	other := NewFileStorage("").Init("id")
+	defer other.Close()
+
+	handle, err := store.OpenHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by a process which exited without closing it
+	if err := ioutil.WriteFile(fhandle("id", "", 0xdead), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	reaped := other.ReapHandles()
+	testutils.CheckInt(1, len(reaped), t)
+	testutils.CheckUint64(0xdead, reaped[0], t)
+	testutils.CheckInt(0, len(store.ReapHandles()), t)
+
+	store.CloseHandle(handle)
+	_, err = os.Stat(fhandle("id", "", handle))
+	testutils.ExpectTrue(os.IsNotExist(err), "Expected the handle's file to be removed", t)
+}
+
 func cleanup() {
 	os.Remove(fname("id", ""))
 	os.Remove(fheader("id", ""))
+	os.Remove(flockname("id", ""))
+	handles, _ := filepath.Glob(fname("id", "") + handleSuffix + "*")
+	for _, f := range handles {
+		os.Remove(f)
+	}
 }
@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package s
+
+import (
+	"errors"
+	"os"
+)
+
+func flock(file *os.File, exclusive, wait bool) (bool, error) {
+	return false, errors.New("stream locking is not supported on this platform")
+}
+
+func funlock(file *os.File) {}
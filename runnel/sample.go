@@ -0,0 +1,117 @@
+package runnel
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+)
+
+// A sample of a fixed number of messages, as checkpointed.
+//
+// Rather than drawing a random number for each message, messages are
+// ranked by a hash of their offset, seeded per reservoir, and the
+// reservoir keeps the lowest ranked ones. The sample is only as
+// uniform as the hash is well mixed, which is close enough for
+// monitoring but not for statistics which need a true random draw.
+// The seed is checkpointed with the sample, so a reservoir which
+// resumes ranks messages as it did before.
+type reservoir struct {
+	Size uint64
+	// Mixed into each message's rank, so that reservoirs
+	// over the same stream draw independent samples
+	Seed uint64
+	// Offset in the source stream that the sample reflects
+	Source uint64
+	// Messages considered for the sample
+	Seen uint64
+	// The sample, as a heap with the highest rank on top
+	Entries reservoirHeap
+}
+
+type reservoirEntry struct {
+	Offset   uint64
+	Priority uint64
+}
+
+func newReservoir(size uint64) *reservoir {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return &reservoir{Size: size, Seed: binary.LittleEndian.Uint64(buf[:])}
+}
+
+// Load the checkpointed sample, if there is one of the right size
+func loadReservoir(size uint64, data []byte) *reservoir {
+	r := newReservoir(size)
+	if data == nil || json.Unmarshal(data, r) != nil || r.Size != size {
+		return newReservoir(size)
+	}
+	heap.Init(&r.Entries)
+	return r
+}
+
+// Consider the message at the given offset for the sample.
+// Returns whether the sample changed.
+func (r *reservoir) add(offset uint64) bool {
+	r.Seen++
+	if r.Size == 0 {
+		return false
+	}
+	entry := reservoirEntry{Offset: offset, Priority: seededPriority(r.Seed, offset)}
+	if uint64(len(r.Entries)) < r.Size {
+		heap.Push(&r.Entries, entry)
+		return true
+	}
+	if entry.Priority >= r.Entries[0].Priority {
+		return false
+	}
+	r.Entries[0] = entry
+	heap.Fix(&r.Entries, 0)
+	return true
+}
+
+// The offsets in the sample, in stream order
+func (r *reservoir) offsets() []uint64 {
+	ret := make([]uint64, len(r.Entries))
+	for n, entry := range r.Entries {
+		ret[n] = entry.Offset
+	}
+	sort.Sort(offsetList(ret))
+	return ret
+}
+
+// The rank of the message at an offset in a reservoir with the given
+// seed. Reservoirs checkpointed before they were seeded have a seed
+// of 0, and rank messages as the sample filter does.
+func seededPriority(seed, offset uint64) uint64 {
+	if seed == 0 {
+		return offsetPriority(offset)
+	}
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], seed)
+	binary.LittleEndian.PutUint64(buf[8:], offset)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+type reservoirHeap []reservoirEntry
+
+func (h reservoirHeap) Len() int            { return len(h) }
+func (h reservoirHeap) Less(x, y int) bool  { return h[x].Priority > h[y].Priority }
+func (h reservoirHeap) Swap(x, y int)       { h[x], h[y] = h[y], h[x] }
+func (h *reservoirHeap) Push(x interface{}) { *h = append(*h, x.(reservoirEntry)) }
+func (h *reservoirHeap) Pop() interface{} {
+	old := *h
+	ret := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return ret
+}
+
+type offsetList []uint64
+
+func (a offsetList) Len() int           { return len(a) }
+func (a offsetList) Less(x, y int) bool { return a[x] < a[y] }
+func (a offsetList) Swap(x, y int)      { a[x], a[y] = a[y], a[x] }
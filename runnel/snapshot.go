@@ -0,0 +1,87 @@
+package runnel
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Snapshots are kept in side files of the stream, one per
+// version, named <id>_snapshot_<name>_<offset>. The offsets
+// which have been written are indexed in <id>_snapshot_<name>.
+const snapshotSuffix = "_snapshot_"
+
+// A snapshot as persisted. Values are the raw bytes of the
+// latest message for each key.
+type snapshotFile struct {
+	// One past the last message reflected
+	Offset uint64
+	// Timestamp of the last message reflected
+	Time   int64
+	Values map[string][]byte
+}
+
+// The versions of a named snapshot of a stream
+type snapshotStore struct {
+	stream   i.Storage
+	prefix   string
+	versions i.Storage
+}
+
+func openSnapshotStore(stream i.Storage, name string) *snapshotStore {
+	prefix := snapshotSuffix + name
+	return &snapshotStore{
+		stream:   stream,
+		prefix:   prefix,
+		versions: stream.Sibling(prefix),
+	}
+}
+
+// Persist the snapshot as a new version
+func (store *snapshotStore) write(snapshot *snapshotFile) {
+	data, _ := json.Marshal(snapshot)
+	file := store.stream.Sibling(store.versionSuffix(snapshot.Offset))
+	writeBlob(file, data)
+	file.Flush()
+	file.Close()
+	appendOffset(store.versions, snapshot.Offset)
+	store.versions.Flush()
+}
+
+// Find the newest snapshot reflecting nothing past the given
+// offset and time. Returns an empty snapshot if there is none.
+func (store *snapshotStore) latest(offset uint64, t int64) *snapshotFile {
+	for n := store.versions.Header().EntryCount; n > 0; n-- {
+		version := readOffset(store.versions, n-1)
+		if version > offset {
+			continue
+		}
+		if snapshot := store.read(version); snapshot != nil && snapshot.Time <= t {
+			return snapshot
+		}
+	}
+	return &snapshotFile{Values: make(map[string][]byte)}
+}
+
+func (store *snapshotStore) read(version uint64) *snapshotFile {
+	file := store.stream.Sibling(store.versionSuffix(version))
+	defer file.Close()
+	data, _ := readBlob(file)
+	snapshot := &snapshotFile{}
+	if data == nil || json.Unmarshal(data, snapshot) != nil {
+		return nil
+	}
+	if snapshot.Values == nil {
+		snapshot.Values = make(map[string][]byte)
+	}
+	return snapshot
+}
+
+func (store *snapshotStore) versionSuffix(version uint64) string {
+	return fmt.Sprintf("%s_%016x", store.prefix, version)
+}
+
+func (store *snapshotStore) close() {
+	store.versions.Close()
+}
@@ -0,0 +1,176 @@
+package runnel
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Subscriptions are stored in a side file as a JSON object
+// mapping subscriber ids to filter expressions
+const subscriptionsSuffix = "_subscriptions"
+
+// The filters registered by the subscribers of a stream. They
+// are shared through a side file so that writers in other
+// processes, or anything forwarding the stream, can skip
+// messages which no subscriber wants.
+type Subscriptions struct {
+	lock    sync.Mutex
+	storage i.Storage
+	// The version of the file that filters was loaded from
+	version uint64
+	filters map[string][]Predicate
+	// The part of each filter which can be decided
+	// from the message alone
+	pushdown [][]pushdownStep
+}
+
+type pushdownStep struct {
+	predicate Predicate
+	match     matcher
+}
+
+// Open the subscriptions for the stream in the given storage
+func OpenSubscriptions(stream i.Storage) *Subscriptions {
+	subs := &Subscriptions{
+		storage: stream.Sibling(subscriptionsSuffix),
+		filters: make(map[string][]Predicate),
+	}
+	subs.reload()
+	return subs
+}
+
+// Register the filter for the given subscriber, replacing
+// any filter it had registered before
+func (subs *Subscriptions) Register(id string, predicates []Predicate) {
+	subs.update(func() { subs.filters[id] = predicates })
+}
+
+// Remove the filter for the given subscriber
+func (subs *Subscriptions) Unregister(id string) {
+	subs.update(func() { delete(subs.filters, id) })
+}
+
+// Change the filters and write them out. Every process shares
+// the file, so the change is made under its flock, to stop a
+// concurrent change from being lost.
+func (subs *Subscriptions) update(change func()) {
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	if err := subs.storage.Lock(true, true); err == nil {
+		defer subs.storage.Unlock()
+	}
+	subs.reload()
+	change()
+	subs.save()
+}
+
+// The filter expressions of all subscribers, by id
+func (subs *Subscriptions) Expressions() map[string]string {
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	subs.reload()
+	return subs.expressions()
+}
+
+// Whether any subscriber could want a message with the given
+// envelope and properties. Everything is wanted when there are
+// no subscribers. Properties which can't be computed should be
+// reported as ok = false, and are assumed to match.
+func (subs *Subscriptions) Wants(env i.Envelope, property func(name string) (string, bool)) bool {
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	subs.reload()
+	if len(subs.pushdown) == 0 {
+		return true
+	}
+	c := &candidate{envelope: env}
+	for _, steps := range subs.pushdown {
+		if wanted(steps, c, property) {
+			return true
+		}
+	}
+	return false
+}
+
+func wanted(steps []pushdownStep, c *candidate, property func(name string) (string, bool)) bool {
+	for _, step := range steps {
+		if step.predicate.Op == OpProperty {
+			value, ok := property(step.predicate.Name)
+			if ok && value != step.predicate.Value {
+				return false
+			}
+		} else if !step.match(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (subs *Subscriptions) Close() {
+	subs.storage.Close()
+}
+
+// Reload the filters if another handle has changed them
+func (subs *Subscriptions) reload() {
+	header := subs.storage.Header()
+	if atomic.LoadUint64(&header.EntryCount) == subs.version {
+		return
+	}
+	data, version := readBlob(subs.storage)
+	expressions := make(map[string]string)
+	if data != nil && json.Unmarshal(data, &expressions) != nil {
+		return
+	}
+	subs.filters = make(map[string][]Predicate)
+	for id, expr := range expressions {
+		if predicates, err := ParsePredicates(expr); err == nil {
+			subs.filters[id] = predicates
+		}
+	}
+	subs.version = version
+	subs.compile()
+}
+
+// Write the filters out and bump the version
+func (subs *Subscriptions) save() {
+	data, _ := json.Marshal(subs.expressions())
+	subs.version, _ = writeBlob(subs.storage, data)
+	subs.compile()
+}
+
+func (subs *Subscriptions) expressions() map[string]string {
+	expressions := make(map[string]string)
+	for id, predicates := range subs.filters {
+		expressions[id] = FormatPredicates(predicates)
+	}
+	return expressions
+}
+
+func (subs *Subscriptions) compile() {
+	subs.pushdown = subs.pushdown[:0]
+	for _, predicates := range subs.filters {
+		var steps []pushdownStep
+		for _, p := range predicates {
+			if !p.pushable() {
+				continue
+			}
+			if match, err := p.compile(nil); err == nil {
+				steps = append(steps, pushdownStep{p, match})
+			}
+		}
+		subs.pushdown = append(subs.pushdown, steps)
+	}
+}
+
+// Whether the predicate can be decided by a writer from the message
+// alone. Predicates on offsets, and stateful predicates, can't be.
+func (p Predicate) pushable() bool {
+	switch p.Op {
+	case OpBefore, OpAfter, OpAround, OpProperty, OpAuthorType:
+		return true
+	}
+	return false
+}
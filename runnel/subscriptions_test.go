@@ -0,0 +1,165 @@
+package runnel
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestExpressionRoundTrip(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 30, 0, 500, time.UTC)
+	stream := NewIntStream("test", "", nil)
+	defer stream.Close()
+
+	f := stream.Filter().
+		From(16).
+		Until(800).
+		Before(now).
+		After(now.Add(-time.Hour)).
+		Around(now, 90*time.Second).
+		Property("user", `a "quoted" (value)`).
+		AuthorType(3).
+		Sample(0.25).
+		SampleBy("user", 0.5).
+		Dedup("user").
+		DedupWithin("user", time.Hour).
+		DedupLast("", 500)
+	expr := f.String()
+
+	predicates, err := ParsePredicates(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.CheckInt(len(f.predicates), len(predicates), t)
+	for n := range predicates {
+		if predicates[n] != f.predicates[n] {
+			t.Errorf("Expected %+v got %+v", f.predicates[n], predicates[n])
+		}
+	}
+	testutils.CheckString(expr, FormatPredicates(predicates), t)
+}
+
+func TestExpressionErrors(t *testing.T) {
+	bad := []string{
+		"from",
+		"from(abc)",
+		"bogus(1)",
+		"property(user)",
+		"from(1)until(2)",
+		"property(user=\"unclosed)",
+		"dedup(user, soon)",
+	}
+	for _, expr := range bad {
+		if _, err := ParsePredicates(expr); err == nil {
+			t.Errorf("Expected an error parsing %q", expr)
+		}
+	}
+}
+
+func TestPubSideFilters(t *testing.T) {
+	cleanupFiles()
+	subscriber := NewIntStream("subscriber", "id", nil)
+	defer subscriber.Close()
+	subscriber.PubSideFilters = true
+	subscriber.DeclareProperty("parity", parity)
+
+	view, err := subscriber.Filter().Property("parity", "odd").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second handle on the same id behaves like another process
+	publisher := NewIntStream("publisher", "id", nil)
+	defer publisher.Close()
+	publisher.PubSideFilters = true
+	publisher.DeclareProperty("parity", parity)
+	testutils.CheckInt(1, len(publisher.Subscriptions().Expressions()), t)
+
+	odd, even := 1, 2
+	testutils.ExpectTrue(publisher.Wants(&odd, i.Envelope{}), "Expected odd to be wanted", t)
+	testutils.ExpectTrue(!publisher.Wants(&even, i.Envelope{}), "Expected even not to be wanted", t)
+
+	// Unwanted messages are still stored
+	writeInts(publisher, 100)
+	testutils.CheckUint64(100, publisher.Size(), t)
+
+	reader := view.Reader(0)
+	for i := 1; i < 100; i += 2 {
+		testutils.CheckInt(i, reader.Read(), t)
+	}
+	reader.Close()
+
+	// Once the view is gone everything is wanted
+	view.Close()
+	testutils.CheckInt(0, len(publisher.Subscriptions().Expressions()), t)
+	testutils.ExpectTrue(publisher.Wants(&even, i.Envelope{}), "Expected even to be wanted", t)
+}
+
+func TestPubSideFiltersPlainReader(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	stream.PubSideFilters = true
+	stream.DeclareProperty("parity", parity)
+
+	view, err := stream.Filter().Property("parity", "odd").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+
+	// A reader of the stream itself sees every message
+	reader := stream.Reader(0)
+	defer reader.Close()
+	writeInts(stream, 100)
+	for i := 0; i < 100; i++ {
+		testutils.CheckInt(i, reader.Read(), t)
+	}
+}
+
+func TestPubSideFiltersUnknownProperty(t *testing.T) {
+	cleanupFiles()
+	subscriber := NewIntStream("subscriber", "id", nil)
+	defer subscriber.Close()
+	subscriber.PubSideFilters = true
+	subscriber.DeclareProperty("parity", parity)
+
+	view, err := subscriber.Filter().Property("parity", "odd").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+
+	// The publisher can't evaluate parity, so it wants everything
+	publisher := NewIntStream("publisher", "id", nil)
+	defer publisher.Close()
+	publisher.PubSideFilters = true
+	even := 2
+	testutils.ExpectTrue(publisher.Wants(&even, i.Envelope{}), "Expected even to be wanted", t)
+}
+
+func TestConcurrentSubscriptions(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+
+	// Each handle behaves like another process registering at once
+	var registered sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		registered.Add(1)
+		go func(n int) {
+			defer registered.Done()
+			subs := OpenSubscriptions(stream.storage)
+			defer subs.Close()
+			for m := 0; m < 25; m++ {
+				subs.Register(strconv.Itoa(n*25+m), []Predicate{{Op: OpAuthorType, AuthorType: 1}})
+			}
+		}(n)
+	}
+	registered.Wait()
+	testutils.CheckInt(100, len(stream.Subscriptions().Expressions()), t)
+}
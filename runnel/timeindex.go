@@ -0,0 +1,165 @@
+package runnel
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+// Each stream keeps a sparse time index in <id>_time
+const timeIndexSuffix = "_time"
+
+// Messages between entries in a time index
+const timeIndexInterval = 64
+
+// How far a message's timestamp may be behind that of an earlier
+// message, as when concurrent writers race. Seeks stay exact as
+// long as timestamps are out of order by no more than this.
+const timestampSkew = int64(time.Second)
+
+// An entry in a time index. MaxTime is the latest timestamp of
+// any message before Offset, so entries are ordered by both.
+type timeEntry struct {
+	Offset  uint64
+	MaxTime int64
+}
+
+const timeEntrySize = uint64(unsafe.Sizeof(timeEntry{}))
+
+// A sparse index from time to stream offset, with an entry every
+// timeIndexInterval messages. It's brought up to date whenever
+// it's consulted, and rebuilt if it has been lost or is stale.
+type timeIndex struct {
+	storage   i.Storage
+	stream    i.Storage
+	envelopes i.Storage
+	typeSize  uint64
+	// Guards against concurrent updates through this handle. Other
+	// handles, in this process or others, are kept out by an flock.
+	lock    sync.Mutex
+	flocked bool
+}
+
+func openTimeIndex(stream, envelopes i.Storage, typeSize uint64) *timeIndex {
+	return &timeIndex{
+		storage:   stream.Sibling(timeIndexSuffix),
+		stream:    stream,
+		envelopes: envelopes,
+		typeSize:  typeSize,
+	}
+}
+
+// Take the index for this handle alone, across every process
+func (ti *timeIndex) acquire() {
+	ti.lock.Lock()
+	// Without locking on this platform, handles update it together
+	ti.flocked = ti.storage.Lock(true, true) == nil
+}
+
+func (ti *timeIndex) release() {
+	if ti.flocked {
+		ti.storage.Unlock()
+		ti.flocked = false
+	}
+	ti.lock.Unlock()
+}
+
+// Index any whole intervals written since the last update.
+// Must be called with the index acquired.
+func (ti *timeIndex) update() {
+	header := ti.storage.Header()
+	last := atomic.LoadUint64(&ti.stream.Header().LastMessage)
+	if header.Source > last {
+		// Indexes a previous incarnation of the stream
+		ti.reset()
+	}
+	if header.EntryCount == 0 {
+		ti.append(timeEntry{Offset: 0, MaxTime: math.MinInt64})
+	}
+	step := timeIndexInterval * ti.typeSize
+	for header.Source+step <= last {
+		prev := ti.entry(header.EntryCount - 1)
+		next := timeEntry{Offset: header.Source + step, MaxTime: prev.MaxTime}
+		for offset := header.Source; offset < next.Offset; offset += ti.typeSize {
+			if t := readEnvelope(ti.envelopes, offset/ti.typeSize).Timestamp; t > next.MaxTime {
+				next.MaxTime = t
+			}
+		}
+		ti.append(next)
+	}
+}
+
+func (ti *timeIndex) reset() {
+	header := ti.storage.Header()
+	header.Source = 0
+	header.EntryCount = 0
+	header.Tail = 0
+	header.LastMessage = 0
+}
+
+func (ti *timeIndex) append(entry timeEntry) {
+	appendRecord(ti.storage, (*[timeEntrySize]byte)(unsafe.Pointer(&entry))[:])
+	ti.storage.Header().Source = entry.Offset
+}
+
+func (ti *timeIndex) entry(n uint64) timeEntry {
+	start := n * timeEntrySize
+	slice := ti.storage.GetBytes(start, start+timeEntrySize)
+	return *(*timeEntry)(unsafe.Pointer(&slice[0]))
+}
+
+// An offset before which no message is stamped at or after t, so
+// a scan for such messages can start there
+func (ti *timeIndex) seek(t int64) uint64 {
+	ti.acquire()
+	defer ti.release()
+	ti.update()
+	// Find the last entry with MaxTime < t. The first entry
+	// always qualifies.
+	lo, hi := uint64(0), ti.storage.Header().EntryCount-1
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if ti.entry(mid).MaxTime < t {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return ti.entry(lo).Offset
+}
+
+// An offset after which no message is stamped before t, so a
+// scan for such messages can stop there. Returns false if every
+// message indexed so far could be followed by one.
+func (ti *timeIndex) stop(t int64) (uint64, bool) {
+	if t > math.MaxInt64-timestampSkew {
+		return 0, false
+	}
+	ti.acquire()
+	defer ti.release()
+	ti.update()
+	// Find the first entry with MaxTime >= t + skew, after which
+	// every message is stamped at MaxTime - skew or later
+	count := ti.storage.Header().EntryCount
+	lo, hi := uint64(0), count
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if ti.entry(mid).MaxTime < t+timestampSkew {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == count {
+		return 0, false
+	}
+	return ti.entry(lo).Offset, true
+}
+
+func (ti *timeIndex) close() {
+	ti.storage.Close()
+}
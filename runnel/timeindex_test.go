@@ -0,0 +1,138 @@
+package runnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestReaderFromTime(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeJittered(stream, 1000)
+
+	reader := stream.ReaderFromTime(windowBase.Add(51 * time.Second))
+	defer reader.Close()
+	// 510 is the first message stamped at 51s or later
+	testutils.CheckInt(510, reader.Read(), t)
+	testutils.CheckUint64(1000/timeIndexInterval+1, stream.timeIndex().storage.Header().EntryCount, t)
+}
+
+func TestTimeIndexedFilters(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeJittered(stream, 1000)
+
+	after := windowBase.Add(30 * time.Second)
+	before := windowBase.Add(60 * time.Second)
+	view, err := stream.Filter().After(after).Before(before).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	waitForSource(view, stream, t)
+
+	// Out of order messages are still found
+	expected := uint64(0)
+	for n := 0; n < 1000; n++ {
+		if when := jittered(n); when.After(after) && when.Before(before) {
+			expected++
+		}
+	}
+	testutils.CheckUint64(expected, view.Size(), t)
+
+	// The index lets the scan start and stop near the bounds
+	times := stream.timeIndex()
+	testutils.ExpectTrue(times.seek(after.UnixNano()) > 200*8, "Expected to skip the start of the stream", t)
+	stop, ok := times.stop(before.UnixNano())
+	testutils.ExpectTrue(ok && stop < 800*8, "Expected to skip the end of the stream", t)
+}
+
+func TestTimeIndexRebuilt(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	writeJittered(stream, 1000)
+	stream.timeIndex()
+	stream.Close()
+
+	// Missing
+	os.Remove(filepath.Join(os.TempDir(), "id"+timeIndexSuffix))
+	os.Remove(filepath.Join(os.TempDir(), "id"+timeIndexSuffix+"_header"))
+	stream = NewIntStream("test", "id", nil)
+	reader := stream.ReaderFromTime(windowBase.Add(21 * time.Second))
+	testutils.CheckInt(210, reader.Read(), t)
+	reader.Close()
+	stream.Close()
+
+	// Stale, indexing a longer stream than the one now on disk
+	os.Remove(filepath.Join(os.TempDir(), "id"))
+	os.Remove(filepath.Join(os.TempDir(), "id_header"))
+	os.Remove(filepath.Join(os.TempDir(), "id"+envelopeSuffix))
+	os.Remove(filepath.Join(os.TempDir(), "id"+envelopeSuffix+"_header"))
+	stream = NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeJittered(stream, 100)
+	reader = stream.ReaderFromTime(windowBase.Add(6 * time.Second))
+	defer reader.Close()
+	testutils.CheckInt(60, reader.Read(), t)
+	testutils.CheckUint64(100/timeIndexInterval+1, stream.timeIndex().storage.Header().EntryCount, t)
+}
+
+// Message n is stamped n tenths of a second after windowBase,
+// except every third message which is stamped half a second early
+// as if it had lost a race with the messages before it
+func jittered(n int) time.Time {
+	when := windowBase.Add(time.Duration(n) * 100 * time.Millisecond)
+	if n%3 == 2 {
+		when = when.Add(-500 * time.Millisecond)
+	}
+	return when
+}
+
+func writeJittered(stream *IntStream, count int) {
+	writer := stream.Writer()
+	defer writer.Close()
+	for n := 0; n < count; n++ {
+		writer.WriteMessage(&n, i.Envelope{Timestamp: jittered(n).UnixNano()})
+	}
+}
+
+func TestTimeIndexSharedUpdates(t *testing.T) {
+	cleanupFiles()
+	// Handles on the same id behave like other processes
+	var handles []*IntStream
+	for n := 0; n < 4; n++ {
+		stream := NewIntStream("test", "id", nil)
+		defer stream.Close()
+		handles = append(handles, stream)
+	}
+	writeJittered(handles[0], 1000)
+
+	done := make(chan bool)
+	for _, stream := range handles {
+		go func(stream *IntStream) {
+			stream.timeIndex().seek(jittered(500).UnixNano())
+			done <- true
+		}(stream)
+	}
+	for range handles {
+		<-done
+	}
+	// Each interval is indexed once
+	testutils.CheckUint64(1000/timeIndexInterval+1, handles[0].timeIndex().storage.Header().EntryCount, t)
+
+	// Other handles are kept out while one updates
+	times := handles[0].timeIndex()
+	other := handles[1].storage.Sibling(timeIndexSuffix)
+	defer other.Close()
+	times.acquire()
+	_, locked := other.Lock(true, false).(*i.LockedError)
+	times.release()
+	testutils.ExpectTrue(locked, "Expected updates to hold the time index's lock", t)
+}
@@ -0,0 +1,9 @@
+package runnel
+
+// Maps a position in a mirrored stream to the equivalent position
+// in its mirror: everything before Source in the mirrored stream
+// has been copied, or filtered out, before Target in the mirror
+type Translation struct {
+	Source uint64
+	Target uint64
+}
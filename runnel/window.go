@@ -0,0 +1,227 @@
+package runnel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Kinds of window
+const (
+	WindowTumbling = "tumbling"
+	WindowSliding  = "sliding"
+	WindowSession  = "session"
+)
+
+// Describes how an aggregator splits the stream into windows
+// by envelope timestamp.
+//
+// The watermark trails the latest timestamp seen by Delay, and a
+// window's result is published once the watermark passes its end.
+// Messages arriving up to Lateness after that are still folded in,
+// and publish a corrected result. Anything later is dropped.
+type WindowSpec struct {
+	Kind string
+	// Length of each window
+	Size time.Duration
+	// Distance between the starts of sliding windows
+	Slide time.Duration
+	// Inactivity which ends a session
+	Gap      time.Duration
+	Delay    time.Duration
+	Lateness time.Duration
+}
+
+// Fixed size windows which don't overlap
+func Tumbling(size time.Duration) WindowSpec {
+	return WindowSpec{Kind: WindowTumbling, Size: size, Slide: size}
+}
+
+// Fixed size windows starting every slide, so that
+// each message may fall in more than one
+func Sliding(size, slide time.Duration) WindowSpec {
+	return WindowSpec{Kind: WindowSliding, Size: size, Slide: slide}
+}
+
+// Windows which stay open as long as messages keep
+// arriving within gap of each other
+func Session(gap time.Duration) WindowSpec {
+	return WindowSpec{Kind: WindowSession, Gap: gap}
+}
+
+// Hold the watermark back by delay, to wait for
+// messages which arrive out of order
+func (spec WindowSpec) WithDelay(delay time.Duration) WindowSpec {
+	spec.Delay = delay
+	return spec
+}
+
+// Keep windows open for lateness after their result is
+// published, to correct it with late messages
+func (spec WindowSpec) WithLateness(lateness time.Duration) WindowSpec {
+	spec.Lateness = lateness
+	return spec
+}
+
+func (spec WindowSpec) String() string {
+	switch spec.Kind {
+	case WindowSession:
+		return fmt.Sprintf("%s(%s)", spec.Kind, spec.Gap)
+	case WindowSliding:
+		return fmt.Sprintf("%s(%s, %s)", spec.Kind, spec.Size, spec.Slide)
+	}
+	return fmt.Sprintf("%s(%s)", spec.Kind, spec.Size)
+}
+
+// The [start, end) bounds of the fixed windows containing t
+func (spec WindowSpec) bounds(t int64) [][2]int64 {
+	size, slide := int64(spec.Size), int64(spec.Slide)
+	if size <= 0 || slide <= 0 {
+		return nil
+	}
+	var ret [][2]int64
+	start := t - mod(t, slide)
+	for ; start > t-size; start -= slide {
+		ret = append(ret, [2]int64{start, start + size})
+	}
+	return ret
+}
+
+// A window which has not yet been discarded
+type window struct {
+	Group string
+	Start int64
+	End   int64
+	// Whether a result has been published
+	Fired bool
+	Acc   *accumulator
+}
+
+func (w *window) aggregate(kind string, source uint64) Aggregate {
+	return Aggregate{
+		Source: source,
+		Group:  GroupHash(w.Group),
+		Count:  w.Acc.Count,
+		Value:  w.Acc.value(kind),
+		Start:  w.Start,
+		End:    w.End,
+	}
+}
+
+// Fold a timestamped message into its windows, and
+// return the results of any windows which closed
+func (agg *aggregation) addWindowed(source uint64, group string, value float64, key string, t int64) []Aggregate {
+	spec := agg.Window
+	if t > agg.MaxTime {
+		agg.MaxTime = t
+	}
+	watermark := agg.MaxTime - int64(spec.Delay)
+	var updates []Aggregate
+
+	var touched []*window
+	if spec.Kind == WindowSession {
+		if w := agg.session(group, t, watermark); w != nil {
+			touched = append(touched, w)
+		}
+	} else {
+		for _, b := range spec.bounds(t) {
+			if b[1]+int64(spec.Lateness) <= watermark {
+				continue
+			}
+			touched = append(touched, agg.fixedWindow(group, b[0], b[1]))
+		}
+	}
+	if len(touched) == 0 {
+		agg.Dropped++
+	}
+	for _, w := range touched {
+		w.Acc.add(agg.Kind, value, key)
+		if w.Fired {
+			// A late message corrects a published result
+			updates = append(updates, w.aggregate(agg.Kind, source))
+		}
+	}
+	return append(updates, agg.advance(source, watermark)...)
+}
+
+// Publish the windows the watermark has passed, and
+// discard those which are past their lateness
+func (agg *aggregation) advance(source uint64, watermark int64) []Aggregate {
+	var updates []Aggregate
+	open := agg.Windows[:0]
+	for _, w := range agg.Windows {
+		if !w.Fired && w.End <= watermark {
+			w.Fired = true
+			updates = append(updates, w.aggregate(agg.Kind, source))
+		}
+		if w.End+int64(agg.Window.Lateness) > watermark {
+			open = append(open, w)
+		}
+	}
+	agg.Windows = open
+	// Publish in window order, which is stable across restarts
+	sort.Stable(byWindowEnd(updates))
+	return updates
+}
+
+type byWindowEnd []Aggregate
+
+func (a byWindowEnd) Len() int           { return len(a) }
+func (a byWindowEnd) Swap(x, y int)      { a[x], a[y] = a[y], a[x] }
+func (a byWindowEnd) Less(x, y int) bool { return a[x].End < a[y].End }
+
+func (agg *aggregation) fixedWindow(group string, start, end int64) *window {
+	for _, w := range agg.Windows {
+		if w.Group == group && w.Start == start {
+			return w
+		}
+	}
+	w := &window{Group: group, Start: start, End: end, Acc: &accumulator{}}
+	agg.Windows = append(agg.Windows, w)
+	return w
+}
+
+// Find or create the session containing t, merging any
+// sessions that t bridges. Returns nil if t is too late.
+func (agg *aggregation) session(group string, t, watermark int64) *window {
+	gap := int64(agg.Window.Gap)
+	var merged *window
+	open := agg.Windows[:0]
+	for _, w := range agg.Windows {
+		if w.Group != group || t+gap < w.Start || t >= w.End {
+			open = append(open, w)
+			continue
+		}
+		if merged == nil {
+			merged = w
+			open = append(open, w)
+			continue
+		}
+		// t bridges two sessions, fold this one into the first
+		merged.Acc.merge(w.Acc)
+		merged.Start = minInt64(merged.Start, w.Start)
+		merged.End = maxInt64(merged.End, w.End)
+		merged.Fired = merged.Fired || w.Fired
+	}
+	agg.Windows = open
+	if merged == nil {
+		if t+gap+int64(agg.Window.Lateness) <= watermark {
+			return nil
+		}
+		merged = &window{Group: group, Start: t, End: t + gap, Acc: &accumulator{}}
+		agg.Windows = append(agg.Windows, merged)
+	}
+	merged.Start = minInt64(merged.Start, t)
+	merged.End = maxInt64(merged.End, t+gap)
+	return merged
+}
+
+// Modulo which is never negative, so that windows
+// line up for timestamps before the epoch
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
@@ -0,0 +1,128 @@
+package runnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/runnel-go/runnel/i"
+)
+
+func TestTumblingWindow(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeTimed(stream, 0, 1, 5, 11, 12, 25)
+
+	count := stream.Aggregate("count").Window(Tumbling(10 * time.Second)).Count()
+	defer count.Close()
+	waitForAggregator(count, stream, t)
+	checkFloat(6, count.Value(), t)
+
+	reader := count.Output.Reader(0)
+	defer reader.Close()
+	checkWindow(reader.Read(), 0, 10, 3, t)
+	checkWindow(reader.Read(), 10, 20, 2, t)
+	testutils.CheckUint64(2, count.Output.Size(), t)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeTimed(stream, 0, 3, 7, 12, 30)
+
+	count := stream.Aggregate("count").Window(Sliding(10*time.Second, 5*time.Second)).Count()
+	defer count.Close()
+
+	reader := count.Output.Reader(0)
+	defer reader.Close()
+	checkWindow(reader.Read(), -5, 5, 2, t)
+	checkWindow(reader.Read(), 0, 10, 3, t)
+	checkWindow(reader.Read(), 5, 15, 2, t)
+	checkWindow(reader.Read(), 10, 20, 1, t)
+}
+
+func TestSessionWindow(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	// 4 bridges the sessions started at 0 and 8
+	writeTimed(stream, 0, 8, 4, 30, 32, 50)
+
+	spec := Session(5 * time.Second).WithDelay(5 * time.Second)
+	sum := stream.Aggregate("sum").Window(spec).Sum(func(data *int) float64 { return float64(*data) })
+	defer sum.Close()
+
+	reader := sum.Output.Reader(0)
+	defer reader.Close()
+	update := reader.Read()
+	checkWindow(update, 0, 13, 3, t)
+	checkFloat(0+1+2, update.Value, t)
+	checkWindow(reader.Read(), 30, 37, 2, t)
+}
+
+func TestWindowLateness(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	// 5 is late but within the allowed lateness, 3 is too late
+	writeTimed(stream, 0, 12, 5, 25, 3)
+
+	spec := Tumbling(10 * time.Second).WithLateness(10 * time.Second)
+	count := stream.Aggregate("count").Window(spec).Count()
+	defer count.Close()
+	waitForAggregator(count, stream, t)
+	testutils.CheckUint64(1, count.Dropped(), t)
+
+	reader := count.Output.Reader(0)
+	defer reader.Close()
+	checkWindow(reader.Read(), 0, 10, 1, t)
+	checkWindow(reader.Read(), 0, 10, 2, t)
+	checkWindow(reader.Read(), 10, 20, 1, t)
+}
+
+func TestWindowResumesFromCheckpoint(t *testing.T) {
+	cleanupFiles()
+	stream := NewIntStream("test", "id", nil)
+	defer stream.Close()
+	writeTimed(stream, 0, 1)
+
+	count := stream.Aggregate("count").Window(Tumbling(10 * time.Second)).Count()
+	waitForAggregator(count, stream, t)
+	count.Close()
+
+	// The open window survives the restart
+	writeTimed(stream, 2, 15)
+	count = stream.Aggregate("count").Window(Tumbling(10 * time.Second)).Count()
+	reader := count.Output.Reader(0)
+	checkWindow(reader.Read(), 0, 10, 3, t)
+	reader.Close()
+	count.Close()
+
+	// A different window starts over
+	count = stream.Aggregate("count").Window(Tumbling(time.Minute)).Count()
+	defer count.Close()
+	waitForAggregator(count, stream, t)
+	checkFloat(4, count.Value(), t)
+}
+
+// A minute boundary, so that every window in the tests lines up with it
+var windowBase = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// Write a message at each of the given times, in seconds after windowBase
+func writeTimed(stream *IntStream, seconds ...int) {
+	writer := stream.Writer()
+	defer writer.Close()
+	for n, s := range seconds {
+		when := windowBase.Add(time.Duration(s) * time.Second)
+		writer.WriteMessage(&n, i.Envelope{Timestamp: when.UnixNano()})
+	}
+}
+
+// Check the bounds, in seconds after windowBase, and count of a window result
+func checkWindow(update Aggregate, start, end int, count uint64, t *testing.T) {
+	testutils.CheckInt(start, int(time.Unix(0, update.Start).Sub(windowBase)/time.Second), t)
+	testutils.CheckInt(end, int(time.Unix(0, update.End).Sub(windowBase)/time.Second), t)
+	testutils.CheckUint64(count, update.Count, t)
+}